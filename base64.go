@@ -0,0 +1,41 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ReadBase64 decodes a jkr file that was base64-encoded with standard
+// padding, as saves pasted into forums usually are. Whitespace, such as the
+// line breaks of a wrapped paste, is ignored.
+func ReadBase64(s string, opts ...Option) (*lua.LTable, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		return nil, fmt.Errorf("jkr: invalid base64: %w", err)
+	}
+
+	out := &lua.LTable{}
+	if err := Unmarshal(data, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// MarshalBase64 marshals tbl and base64-encodes the result with standard
+// padding.
+func MarshalBase64(tbl *lua.LTable, opts ...Option) (string, error) {
+	data, err := Marshal(tbl, opts...)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
@@ -0,0 +1,70 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBase64RoundTrip(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "profile.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	s, err := MarshalBase64(tbl)
+	if err != nil {
+		t.Fatalf("MarshalBase64() error: %v", err)
+	}
+
+	// wrap the paste the way forums do
+	var wrapped strings.Builder
+	for i := 0; i < len(s); i += 76 {
+		wrapped.WriteString(s[i:min(i+76, len(s))])
+		wrapped.WriteString("\r\n")
+	}
+
+	for _, in := range []string{s, wrapped.String()} {
+		out, err := ReadBase64(in)
+		if err != nil {
+			t.Fatalf("ReadBase64() error: %v", err)
+		}
+		if !Equal(out, tbl) {
+			t.Errorf("tables not equal after base64 round-trip")
+		}
+	}
+}
+
+func TestReadBase64Malformed(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"invalid characters", "not*base64!"},
+		{"bad padding", "YWJj="},
+		{"not jkr", base64.StdEncoding.EncodeToString([]byte("hello"))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := ReadBase64(test.in); err == nil {
+				t.Errorf("expected error, got nil")
+			}
+		})
+	}
+
+	var corrupt base64.CorruptInputError
+	if _, err := ReadBase64("not*base64!"); !errors.As(err, &corrupt) || !strings.Contains(err.Error(), "invalid base64") {
+		t.Errorf("got %v; want an invalid base64 error", err)
+	}
+}
@@ -0,0 +1,243 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// binaryMagic starts every table written by ToBinary, followed by the
+// version of the format
+const binaryMagic = "JKRB\x01"
+
+// Tags of the values in the binary format.
+const (
+	binaryString byte = iota + 1
+	binaryNumber
+	binaryFalse
+	binaryTrue
+	binaryTable
+)
+
+var errBinaryTruncated = errors.New("jkr: truncated binary data")
+
+// ToBinary encodes tbl in a compact binary format that FromBinary decodes much
+// faster than Lua source. The format is private to this package and is not
+// something Balatro can read; it is meant for caching decoded saves. Strings,
+// numbers, booleans and tables round-trip exactly, including NaN and
+// infinities, while object tables are written as "MANUAL_REPLACE" like
+// Marshal writes them.
+//
+// The format has a version, and FromBinary rejects data written by a
+// different version, so a cache should fall back to the original file then.
+func ToBinary(tbl *lua.LTable, opts ...Option) ([]byte, error) {
+	e := &binaryEncoder{
+		enc:  newEncoder(opts),
+		data: []byte(binaryMagic),
+	}
+	if err := e.encodeTable(tbl); err != nil {
+		return nil, err
+	}
+	return e.data, nil
+}
+
+// binaryEncoder holds the state of a single ToBinary call
+type binaryEncoder struct {
+	enc  *encoder
+	data []byte
+}
+
+func (e *binaryEncoder) encodeTable(tbl *lua.LTable) error {
+	e.enc.depth++
+	defer func() { e.enc.depth-- }()
+	if err := e.enc.opts.checkDepth(e.enc.depth); err != nil {
+		return err
+	}
+	if e.enc.opts.cycleCheck {
+		if e.enc.visited.contains(tbl) {
+			return fmt.Errorf("circular reference detected in table")
+		}
+		e.enc.visited.push(tbl)
+		defer e.enc.visited.pop()
+	}
+
+	var n uint64
+	forEach(tbl, func(_, _ lua.LValue) {
+		n++
+	})
+	e.data = append(e.data, binaryTable)
+	e.data = binary.AppendUvarint(e.data, n)
+
+	var err error
+	e.enc.forEach(tbl, func(key, value lua.LValue) {
+		if err != nil {
+			return
+		}
+		switch k := key.(type) {
+		case lua.LString:
+		case lua.LNumber:
+			if math.IsNaN(float64(k)) {
+				err = fmt.Errorf("invalid key: NaN cannot be a table key")
+				return
+			}
+		default:
+			err = fmt.Errorf("invalid key type: table keys must be strings or numbers")
+			return
+		}
+		if err = e.encodeValue(key); err == nil {
+			err = e.encodeValue(value)
+		}
+	})
+	return err
+}
+
+func (e *binaryEncoder) encodeValue(value lua.LValue) error {
+	switch v := value.(type) {
+	case *lua.LTable:
+		if e.enc.opts.isObject(v) {
+			return e.encodeValue(lua.LString("MANUAL_REPLACE"))
+		}
+		return e.encodeTable(v)
+	case lua.LString:
+		e.data = append(e.data, binaryString)
+		e.data = binary.AppendUvarint(e.data, uint64(len(v)))
+		e.data = append(e.data, v...)
+	case lua.LNumber:
+		e.data = append(e.data, binaryNumber)
+		e.data = binary.LittleEndian.AppendUint64(e.data, math.Float64bits(float64(v)))
+	case lua.LBool:
+		if v {
+			e.data = append(e.data, binaryTrue)
+		} else {
+			e.data = append(e.data, binaryFalse)
+		}
+	default:
+		return unsupportedValue(value)
+	}
+	return nil
+}
+
+// FromBinary decodes a table written by ToBinary.
+func FromBinary(data []byte, opts ...Option) (*lua.LTable, error) {
+	if len(data) < len(binaryMagic) || string(data[:len(binaryMagic)]) != binaryMagic {
+		return nil, fmt.Errorf("jkr: not binary data of this version")
+	}
+	d := &binaryDecoder{opts: newOptions(opts), data: data[len(binaryMagic):]}
+	v, err := d.decodeValue()
+	if err != nil {
+		return nil, err
+	}
+	tbl, ok := v.(*lua.LTable)
+	if !ok {
+		return nil, ErrNotATable
+	}
+	if len(d.data) > 0 {
+		return nil, fmt.Errorf("jkr: unexpected data after binary table")
+	}
+	return tbl, nil
+}
+
+// binaryDecoder holds the state of a single FromBinary call
+type binaryDecoder struct {
+	opts   options
+	data   []byte
+	depth  int
+	tables int
+}
+
+func (d *binaryDecoder) decodeValue() (lua.LValue, error) {
+	if len(d.data) == 0 {
+		return nil, errBinaryTruncated
+	}
+	tag := d.data[0]
+	d.data = d.data[1:]
+	switch tag {
+	case binaryString:
+		n, err := d.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(d.data)) {
+			return nil, errBinaryTruncated
+		}
+		s := lua.LString(d.data[:n])
+		d.data = d.data[n:]
+		return s, nil
+	case binaryNumber:
+		if len(d.data) < 8 {
+			return nil, errBinaryTruncated
+		}
+		f := math.Float64frombits(binary.LittleEndian.Uint64(d.data))
+		d.data = d.data[8:]
+		return lua.LNumber(f), nil
+	case binaryFalse:
+		return lua.LFalse, nil
+	case binaryTrue:
+		return lua.LTrue, nil
+	case binaryTable:
+		return d.decodeTable()
+	default:
+		return nil, fmt.Errorf("jkr: invalid binary value tag %d", tag)
+	}
+}
+
+func (d *binaryDecoder) decodeTable() (*lua.LTable, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if err := d.opts.checkDepth(d.depth); err != nil {
+		return nil, err
+	}
+	d.tables++
+	if err := d.opts.checkTables(d.tables); err != nil {
+		return nil, err
+	}
+
+	n, err := d.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	// every entry takes at least two bytes, which bounds n before allocating
+	if n > uint64(len(d.data))/2 {
+		return nil, errBinaryTruncated
+	}
+	tbl := newTable()
+	for range n {
+		key, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case lua.LString:
+		case lua.LNumber:
+			if math.IsNaN(float64(k)) {
+				return nil, fmt.Errorf("jkr: invalid binary key NaN")
+			}
+		default:
+			return nil, fmt.Errorf("jkr: invalid binary key of type %s", key.Type())
+		}
+		value, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		tbl.RawSet(key, value)
+	}
+	return tbl, nil
+}
+
+func (d *binaryDecoder) uvarint() (uint64, error) {
+	n, size := binary.Uvarint(d.data)
+	if size <= 0 {
+		return 0, errBinaryTruncated
+	}
+	d.data = d.data[size:]
+	return n, nil
+}
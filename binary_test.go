@@ -0,0 +1,168 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestBinaryRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	save, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	special := newTable()
+	special.RawSetString("inf", lua.LNumber(math.Inf(1)))
+	special.RawSetString("negative zero", lua.LNumber(math.Copysign(0, -1)))
+	special.RawSetString("empty", newTable())
+	special.RawSetString("bytes", lua.LString("\x00\xff\n"))
+	special.RawSetInt(1, lua.LFalse)
+	special.RawSet(lua.LNumber(-2.5), lua.LTrue)
+
+	tests := []struct {
+		name string
+		tbl  *lua.LTable
+	}{
+		{"save", save},
+		{"special values", special},
+		{"empty", newTable()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := test.tbl
+			data, err := ToBinary(tbl)
+			if err != nil {
+				t.Fatalf("ToBinary() error: %v", err)
+			}
+			got, err := FromBinary(data)
+			if err != nil {
+				t.Fatalf("FromBinary() error: %v", err)
+			}
+			if !Equal(got, tbl) {
+				t.Errorf("tables not equal after round-trip")
+			}
+		})
+	}
+
+	nan := newTable()
+	nan.RawSetString("nan", lua.LNumber(math.NaN()))
+	data, err := ToBinary(nan)
+	if err != nil {
+		t.Fatalf("ToBinary() error: %v", err)
+	}
+	got, err := FromBinary(data)
+	if err != nil {
+		t.Fatalf("FromBinary() error: %v", err)
+	}
+	if f := float64(got.RawGetString("nan").(lua.LNumber)); !math.IsNaN(f) {
+		t.Errorf("got %v; want NaN", f)
+	}
+}
+
+func TestBinaryErrors(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	cyclic := newTable()
+	cyclic.RawSetString("self", cyclic)
+	fn := newTable()
+	fn.RawSetString("f", L.NewFunction(func(*lua.LState) int { return 0 }))
+	for _, tbl := range []*lua.LTable{cyclic, fn} {
+		if _, err := ToBinary(tbl); err == nil {
+			t.Errorf("expected ToBinary() error, got nil")
+		}
+	}
+
+	tbl := compileTable(t, `return {["a"]={1,2,"three",},["b"]=true,}`)
+	data, err := ToBinary(tbl)
+	if err != nil {
+		t.Fatalf("ToBinary() error: %v", err)
+	}
+	for i := range len(data) {
+		if _, err := FromBinary(data[:i]); err == nil {
+			t.Errorf("expected error for data truncated to %d bytes, got nil", i)
+		}
+	}
+	if _, err := FromBinary(append(data, 0)); err == nil {
+		t.Errorf("expected error for trailing data, got nil")
+	}
+	raw, err := os.ReadFile(filepath.Join("testdata", "meta.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if _, err := FromBinary(raw); err == nil {
+		t.Errorf("expected error for jkr data, got nil")
+	}
+	if _, err := FromBinary(append([]byte(binaryMagic), binaryTrue)); !errors.Is(err, ErrNotATable) {
+		t.Errorf("got %v; want ErrNotATable", err)
+	}
+
+	deep := bytes.Repeat([]byte{binaryTable, 1, binaryNumber, 0, 0, 0, 0, 0, 0, 0, 0}, 10)
+	deep = append([]byte(binaryMagic), deep...)
+	if _, err := FromBinary(deep, WithMaxDepth(5)); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("got %v; want ErrMaxDepthExceeded", err)
+	}
+}
+
+func BenchmarkBinary(b *testing.B) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		b.Fatalf("ReadFile() error: %v", err)
+	}
+	var tbl lua.LTable
+	if err := Unmarshal(raw, &tbl); err != nil {
+		b.Fatalf("Unmarshal() error: %v", err)
+	}
+	data, err := ToBinary(&tbl)
+	if err != nil {
+		b.Fatalf("ToBinary() error: %v", err)
+	}
+
+	b.Run("ToBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := ToBinary(&tbl); err != nil {
+				b.Fatalf("ToBinary() error: %v", err)
+			}
+		}
+	})
+	b.Run("Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := Marshal(&tbl); err != nil {
+				b.Fatalf("Marshal() error: %v", err)
+			}
+		}
+	})
+	b.Run("FromBinary", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := FromBinary(data); err != nil {
+				b.Fatalf("FromBinary() error: %v", err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var out lua.LTable
+			if err := Unmarshal(raw, &out); err != nil {
+				b.Fatalf("Unmarshal() error: %v", err)
+			}
+		}
+	})
+}
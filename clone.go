@@ -0,0 +1,66 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import lua "github.com/yuin/gopher-lua"
+
+// Clone returns a deep copy of tbl. Nested tables are copied, keeping tables
+// that are shared or that refer back to an ancestor shared in the copy, while
+// all other values, including functions, are copied by reference.
+func Clone(tbl *lua.LTable) *lua.LTable {
+	return clone(tbl, make(map[*lua.LTable]*lua.LTable))
+}
+
+func clone(tbl *lua.LTable, copies map[*lua.LTable]*lua.LTable) *lua.LTable {
+	if c, ok := copies[tbl]; ok {
+		return c
+	}
+	out := newTable()
+	out.Metatable = tbl.Metatable
+	copies[tbl] = out
+	forEach(tbl, func(key, value lua.LValue) {
+		if k, ok := key.(*lua.LTable); ok {
+			key = clone(k, copies)
+		}
+		if v, ok := value.(*lua.LTable); ok {
+			value = clone(v, copies)
+		}
+		out.RawSet(key, value)
+	})
+	return out
+}
+
+// Merge returns a deep copy of base with overlay merged over it. Where both
+// hold a table under the same key, the tables are merged recursively;
+// otherwise the value from overlay wins. Neither input is modified, and
+// cycles in either are merged once rather than followed forever.
+func Merge(base, overlay *lua.LTable) *lua.LTable {
+	copies := make(map[*lua.LTable]*lua.LTable)
+	out := clone(base, copies)
+	mergeInto(out, overlay, copies, make(map[[2]*lua.LTable]bool))
+	return out
+}
+
+// mergeInto merges overlay into dst in place, skipping pairs already merged
+func mergeInto(dst, overlay *lua.LTable, copies map[*lua.LTable]*lua.LTable, merged map[[2]*lua.LTable]bool) {
+	if merged[[2]*lua.LTable{dst, overlay}] {
+		return
+	}
+	merged[[2]*lua.LTable{dst, overlay}] = true
+	forEach(overlay, func(key, value lua.LValue) {
+		v, ok := value.(*lua.LTable)
+		if !ok {
+			dst.RawSet(key, value)
+			return
+		}
+		if d, ok := rawGet(dst, key).(*lua.LTable); ok {
+			mergeInto(d, v, copies, merged)
+			return
+		}
+		dst.RawSet(key, clone(v, copies))
+	})
+}
@@ -0,0 +1,131 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	c := Clone(tbl)
+	if !Equal(c, tbl) {
+		t.Fatalf("clone differs from the original")
+	}
+
+	SetPath(c, "GAME.dollars", lua.LNumber(9999))
+	if lookupPath(tbl, "GAME.dollars") == lua.LNumber(9999) {
+		t.Errorf("editing the clone changed the original")
+	}
+}
+
+func TestCloneShared(t *testing.T) {
+	t.Parallel()
+
+	shared := newTable()
+	tbl := newTable()
+	tbl.RawSetString("a", shared)
+	tbl.RawSetString("b", shared)
+	tbl.RawSetString("self", tbl)
+
+	c := Clone(tbl)
+	a, b := c.RawGetString("a"), c.RawGetString("b")
+	if a != b {
+		t.Errorf("shared table was copied twice")
+	}
+	if a == lua.LValue(shared) {
+		t.Errorf("shared table was not copied")
+	}
+	if c.RawGetString("self") != lua.LValue(c) {
+		t.Errorf("self reference does not point at the clone")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	base := compileTable(t, `return {["a"]=1,["b"]={["x"]=1,["y"]=2,},["c"]={1,2,},["d"]="base",}`)
+	overlay := compileTable(t, `return {["a"]=2,["b"]={["y"]=3,["z"]=4,},["c"]="replaced",["e"]={["new"]=true,},}`)
+	want := compileTable(t, `return {["a"]=2,["b"]={["x"]=1,["y"]=3,["z"]=4,},["c"]="replaced",["d"]="base",["e"]={["new"]=true,},}`)
+	baseCopy, overlayCopy := Clone(base), Clone(overlay)
+
+	got := Merge(base, overlay)
+	if !Equal(got, want) {
+		data, _ := Serialize(got)
+		t.Errorf("got %s", data)
+	}
+	if !Equal(base, baseCopy) || !Equal(overlay, overlayCopy) {
+		t.Errorf("Merge() modified its inputs")
+	}
+
+	got.RawGetString("e").(*lua.LTable).RawSetString("new", lua.LFalse)
+	if overlay.RawGetString("e").(*lua.LTable).RawGetString("new") != lua.LTrue {
+		t.Errorf("merged table shares a table with overlay")
+	}
+}
+
+func TestCyclicTables(t *testing.T) {
+	t.Parallel()
+
+	// cyclic returns a table holding itself and a nested table pointing back
+	cyclic := func(name string) *lua.LTable {
+		tbl := newTable()
+		tbl.RawSetString("name", lua.LString(name))
+		tbl.RawSetString("self", tbl)
+		child := newTable()
+		child.RawSetString("parent", tbl)
+		tbl.RawSetString("child", child)
+		return tbl
+	}
+	a, b, other := cyclic("a"), cyclic("a"), cyclic("other")
+
+	if !Equal(a, b) {
+		t.Errorf("Equal() got false for cyclic tables of the same shape")
+	}
+	if Equal(a, other) {
+		t.Errorf("Equal() got true for different cyclic tables")
+	}
+
+	if changes := Diff(a, b); len(changes) != 0 {
+		t.Errorf("Diff() got %v for cyclic tables of the same shape", changes)
+	}
+	if changes := Diff(a, other); len(changes) != 1 || changes[0].Path != "name" {
+		t.Errorf("Diff() got %v; want a single change to name", changes)
+	}
+
+	c := Clone(a)
+	if !Equal(c, a) {
+		t.Errorf("clone differs from the cyclic original")
+	}
+
+	m := Merge(a, other)
+	if got := m.RawGetString("name"); got != lua.LString("other") {
+		t.Errorf("merged name is %v; want other", got)
+	}
+	if !Equal(m, other) {
+		t.Errorf("merged cyclic table differs from overlay")
+	}
+	if a.RawGetString("name") != lua.LString("a") {
+		t.Errorf("Merge() modified base")
+	}
+}
+
+// compileTable decodes the Lua source of a table
+func compileTable(t *testing.T, src string) *lua.LTable {
+	t.Helper()
+	tbl, err := ReadPlain(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("ReadPlain() error: %v", err)
+	}
+	return tbl
+}
@@ -0,0 +1,158 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// container is the format wrapping the deflate data of a stream
+type container int
+
+const (
+	rawDeflate container = iota
+	zlibContainer
+	gzipContainer
+)
+
+// detectContainer tells from the first bytes of a stream whether its deflate
+// data is wrapped in a zlib or gzip container rather than written raw, as
+// Balatro writes it
+func detectContainer(head []byte) container {
+	if len(head) < 2 {
+		return rawDeflate
+	}
+	switch {
+	case head[0] == 0x1f && head[1] == 0x8b:
+		// 0x1f cannot start raw deflate data, as its block type is reserved
+		return gzipContainer
+	case head[0]&0x0f == 8 && head[0]>>4 <= 7 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 &&
+		!isStoredBlock(head):
+		// a zlib header reads as raw deflate only if it starts a stored block
+		return zlibContainer
+	default:
+		return rawDeflate
+	}
+}
+
+// isStoredBlock reports whether head starts a stored deflate block, whose
+// length is followed by its complement
+func isStoredBlock(head []byte) bool {
+	if len(head) < 5 || head[0]&0x06 != 0 {
+		return false
+	}
+	n := uint16(head[1]) | uint16(head[2])<<8
+	return n == ^(uint16(head[3]) | uint16(head[4])<<8)
+}
+
+// decompressReader decompresses its input, detecting the container on the
+// first read
+type decompressReader struct {
+	in  io.Reader
+	r   io.ReadCloser
+	err error
+}
+
+func (d *decompressReader) Read(p []byte) (int, error) {
+	if d.r == nil && d.err == nil {
+		d.r, d.err = d.open()
+	}
+	if d.err != nil {
+		return 0, decompressError(d.err)
+	}
+	n, err := d.r.Read(p)
+	return n, decompressError(err)
+}
+
+// decompressError wraps err in ErrDecompress if it reports invalid compressed
+// data, as opposed to a failure to read it
+func decompressError(err error) error {
+	var corrupt flate.CorruptInputError
+	switch {
+	case err == nil || err == io.EOF || errors.Is(err, ErrDecompress):
+		return err
+	case errors.As(err, &corrupt), errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, gzip.ErrHeader), errors.Is(err, gzip.ErrChecksum),
+		errors.Is(err, zlib.ErrHeader), errors.Is(err, zlib.ErrChecksum):
+		return fmt.Errorf("%w: %w", ErrDecompress, err)
+	default:
+		return err
+	}
+}
+
+func (d *decompressReader) Close() error {
+	if d.r == nil {
+		return nil
+	}
+	return d.r.Close()
+}
+
+// open peeks at the header of the input and opens the matching decompressor.
+// The header is read byte by byte, so as not to read past the stream from an
+// io.ByteReader.
+func (d *decompressReader) open() (io.ReadCloser, error) {
+	br, ok := d.in.(flate.Reader)
+	if !ok {
+		br = bufio.NewReader(d.in)
+	}
+	var head []byte
+	for len(head) < 5 {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			// too short for a container; flate reports the truncation
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		head = append(head, b)
+	}
+	in := &prefixReader{prefix: head, r: br}
+
+	switch detectContainer(head) {
+	case gzipContainer:
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		return zr, nil
+	case zlibContainer:
+		return zlib.NewReader(in)
+	default:
+		return flate.NewReader(in), nil
+	}
+}
+
+// prefixReader reads prefix before reading from r
+type prefixReader struct {
+	prefix []byte
+	r      flate.Reader
+}
+
+func (p *prefixReader) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.r.Read(b)
+}
+
+func (p *prefixReader) ReadByte() (byte, error) {
+	if len(p.prefix) > 0 {
+		b := p.prefix[0]
+		p.prefix = p.prefix[1:]
+		return b, nil
+	}
+	return p.r.ReadByte()
+}
@@ -0,0 +1,89 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestUnmarshalContainers(t *testing.T) {
+	t.Parallel()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	var want lua.LTable
+	if err := Unmarshal(raw, &want); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	src, err := Decompress(raw)
+	if err != nil {
+		t.Fatalf("Decompress() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		wrap func(w io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"zlib", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			// two wrapped streams back to back
+			var buf bytes.Buffer
+			for range 2 {
+				zw := test.wrap(&buf)
+				if _, err := zw.Write(src); err != nil {
+					t.Fatalf("Write() error: %v", err)
+				}
+				if err := zw.Close(); err != nil {
+					t.Fatalf("Close() error: %v", err)
+				}
+			}
+
+			r := bytes.NewReader(buf.Bytes())
+			for i := range 2 {
+				var got lua.LTable
+				if err := UnmarshalRead(r, &got); err != nil {
+					t.Fatalf("UnmarshalRead() %d error: %v", i, err)
+				}
+				if !Equal(&got, &want) {
+					t.Errorf("table %d differs from the raw stream's", i)
+				}
+			}
+			if r.Len() != 0 {
+				t.Errorf("%d bytes left unread", r.Len())
+			}
+		})
+	}
+}
+
+func TestUnmarshalStoredBlockNotZlib(t *testing.T) {
+	t.Parallel()
+
+	// a raw stored block whose first two bytes also form a valid zlib header
+	data := []byte{0x78, 0x01, 0x00, 0xfe, 0xff, 'r', 0x01, 0x08, 0x00, 0xf7, 0xff}
+	data = append(data, "eturn {}"...)
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, newTable()) {
+		t.Errorf("expected an empty table")
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Diff returns the changes that turn a into b, in sorted key order. Tables
+// present in both are compared recursively, so a change is reported only for
+// the deepest key whose value was added, removed or replaced. Paths are
+// dotted like those of SetPath, so only string keys without a dot and integer
+// keys can be told apart in them.
+func Diff(a, b *lua.LTable) []Change {
+	var changes []Change
+	diff(a, b, nil, &changes, make(map[[2]*lua.LTable]bool))
+	return changes
+}
+
+// diff appends the changes between a and b under path, comparing each pair of
+// tables at most once so that cycles terminate
+func diff(a, b *lua.LTable, path []string, changes *[]Change, seen map[[2]*lua.LTable]bool) {
+	if a == b || seen[[2]*lua.LTable{a, b}] {
+		return
+	}
+	seen[[2]*lua.LTable{a, b}] = true
+
+	var keys []lua.LValue
+	forEach(a, func(key, _ lua.LValue) {
+		keys = append(keys, key)
+	})
+	forEach(b, func(key, _ lua.LValue) {
+		if rawGet(a, key) == lua.LNil {
+			keys = append(keys, key)
+		}
+	})
+	slices.SortFunc(keys, compareKeys)
+
+	for _, key := range keys {
+		av, bv := rawGet(a, key), rawGet(b, key)
+		keyPath := append(slices.Clip(path), key.String())
+		ta, aTbl := av.(*lua.LTable)
+		tb, bTbl := bv.(*lua.LTable)
+		switch {
+		case aTbl && bTbl:
+			diff(ta, tb, keyPath, changes, seen)
+		case av != bv:
+			*changes = append(*changes, Change{Path: strings.Join(keyPath, "."), Old: av, New: bv})
+		}
+	}
+}
+
+// ApplyPatch applies changes, such as those returned by Diff, to tbl in order.
+// Before each change, the value at its path must equal its Old value, compared
+// like Equal, or ApplyPatch returns an error wrapping ErrPatchConflict. Tables
+// in New values are copied, so tbl never shares them with the patch.
+//
+// The patch is applied entirely or not at all: if any change conflicts or has
+// a path through a missing table, tbl is left unmodified.
+func ApplyPatch(tbl *lua.LTable, changes []Change) error {
+	if err := applyPatch(Clone(tbl), changes); err != nil {
+		return err
+	}
+	return applyPatch(tbl, changes)
+}
+
+func applyPatch(tbl *lua.LTable, changes []Change) error {
+	for _, ch := range changes {
+		current := lookupPath(tbl, ch.Path)
+		if !equalValue(current, ch.Old, make(map[[2]*lua.LTable]bool)) {
+			return fmt.Errorf("%w: %s is %s, want %s", ErrPatchConflict, ch.Path, current, ch.Old)
+		}
+		value := ch.New
+		if t, ok := value.(*lua.LTable); ok {
+			value = Clone(t)
+		}
+		if err := SetPath(tbl, ch.Path, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarshalPatch serializes changes, such as those returned by Diff, as a
+// compressed Lua table like any save, so that an edit can be shared without
+// the save it applies to. Each change becomes a table in the top-level list
+// with a path, an op of "set" or "delete", the old value if there was one and,
+// for "set", the new value. UnmarshalPatch reads it back.
+func MarshalPatch(changes []Change) ([]byte, error) {
+	patch := &lua.LTable{}
+	for _, ch := range changes {
+		entry := &lua.LTable{}
+		entry.RawSetString("path", lua.LString(ch.Path))
+		if ch.New == lua.LNil {
+			entry.RawSetString("op", lua.LString("delete"))
+		} else {
+			entry.RawSetString("op", lua.LString("set"))
+			entry.RawSetString("value", ch.New)
+		}
+		if ch.Old != lua.LNil {
+			entry.RawSetString("old", ch.Old)
+		}
+		patch.Append(entry)
+	}
+	return Marshal(patch)
+}
+
+// UnmarshalPatch reads a patch written by MarshalPatch back into the changes
+// it holds, in order, ready for ApplyPatch.
+func UnmarshalPatch(data []byte, opts ...Option) ([]Change, error) {
+	var patch lua.LTable
+	if err := Unmarshal(data, &patch, opts...); err != nil {
+		return nil, err
+	}
+
+	changes := make([]Change, 0, patch.Len())
+	for i := 1; i <= patch.Len(); i++ {
+		entry, ok := patch.RawGetInt(i).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("jkr: patch entry %d is not a table", i)
+		}
+		path, ok := entry.RawGetString("path").(lua.LString)
+		if !ok {
+			return nil, fmt.Errorf("jkr: patch entry %d has no path", i)
+		}
+		ch := Change{Path: string(path), Old: entry.RawGetString("old"), New: lua.LNil}
+		switch op := entry.RawGetString("op"); op {
+		case lua.LString("set"):
+			ch.New = entry.RawGetString("value")
+			if ch.New == lua.LNil {
+				return nil, fmt.Errorf("jkr: patch entry %d sets %s without a value", i, path)
+			}
+		case lua.LString("delete"):
+		default:
+			return nil, fmt.Errorf("jkr: patch entry %d has unknown op %s", i, op)
+		}
+		changes = append(changes, ch)
+	}
+	return changes, nil
+}
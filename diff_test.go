@@ -0,0 +1,178 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"errors"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+
+	a := compileTable(t, `return {["dollars"]=4,["jokers"]={"j_joker",},["deck"]={["name"]="Red Deck",["size"]=52,},["gone"]=true,}`)
+	b := compileTable(t, `return {["dollars"]=10,["jokers"]={"j_joker","j_greedy",},["deck"]={["name"]="Red Deck",["size"]=51,},["new"]={["x"]=1,},}`)
+
+	got := Diff(a, b)
+	want := []string{"deck.size", "dollars", "gone", "jokers.2", "new"}
+	if len(got) != len(want) {
+		t.Fatalf("got %d changes; want %d: %v", len(got), len(want), got)
+	}
+	for i, ch := range got {
+		if ch.Path != want[i] {
+			t.Errorf("change %d has path %q; want %q", i, ch.Path, want[i])
+		}
+	}
+	if got[2].New != lua.LNil || got[3].Old != lua.LNil {
+		t.Errorf("removed or added keys are not reported with nil")
+	}
+	if len(Diff(a, Clone(a))) != 0 {
+		t.Errorf("expected no changes between a table and its clone")
+	}
+}
+
+func TestDiffCyclicTables(t *testing.T) {
+	t.Parallel()
+
+	// cyclic returns a table holding itself and a nested table pointing back
+	cyclic := func(size int) *lua.LTable {
+		tbl := newTable()
+		tbl.RawSetString("self", tbl)
+		deck := newTable()
+		deck.RawSetString("size", lua.LNumber(size))
+		deck.RawSetString("parent", tbl)
+		tbl.RawSetString("deck", deck)
+		return tbl
+	}
+	a, b := cyclic(52), cyclic(51)
+
+	if changes := Diff(a, a); len(changes) != 0 {
+		t.Errorf("got %v for a cyclic table against itself", changes)
+	}
+	if changes := Diff(a, cyclic(52)); len(changes) != 0 {
+		t.Errorf("got %v for cyclic tables of the same shape", changes)
+	}
+	changes := Diff(a, b)
+	if len(changes) != 1 || changes[0].Path != "deck.size" {
+		t.Fatalf("got %v; want a single change to deck.size", changes)
+	}
+	if changes[0].Old != lua.LNumber(52) || changes[0].New != lua.LNumber(51) {
+		t.Errorf("got change from %v to %v; want 52 to 51", changes[0].Old, changes[0].New)
+	}
+
+	// a cycle replaced by a plain value is a single change
+	flat := cyclic(52)
+	flat.RawSetString("self", lua.LFalse)
+	if changes := Diff(a, flat); len(changes) != 1 || changes[0].Path != "self" {
+		t.Errorf("got %v; want a single change to self", changes)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	t.Parallel()
+
+	a := compileTable(t, `return {["dollars"]=4,["jokers"]={"j_joker",},["deck"]={["name"]="Red Deck",["size"]=52,},["gone"]=true,}`)
+	b := compileTable(t, `return {["dollars"]=10,["jokers"]={"j_joker","j_greedy",},["deck"]={["name"]="Red Deck",["size"]=51,},["new"]={["x"]=1,},}`)
+	patch := Diff(a, b)
+
+	target := Clone(a)
+	if err := ApplyPatch(target, patch); err != nil {
+		t.Fatalf("ApplyPatch() error: %v", err)
+	}
+	if !Equal(target, b) {
+		data, _ := Serialize(target)
+		t.Errorf("patched table differs from b: %s", data)
+	}
+	target.RawGetString("new").(*lua.LTable).RawSetString("x", lua.LNumber(2))
+	if b.RawGetString("new").(*lua.LTable).RawGetString("x") != lua.LNumber(1) {
+		t.Errorf("patched table shares a table with the patch")
+	}
+
+	tests := []struct {
+		name     string
+		src      string
+		patch    []Change
+		conflict bool
+	}{
+		{"diverged value", `return {["dollars"]=5,["jokers"]={"j_joker",},["deck"]={["name"]="Red Deck",["size"]=52,},["gone"]=true,}`, patch, true},
+		{"existing added key", `return {["dollars"]=4,["jokers"]={"j_joker","j_egg",},["deck"]={["name"]="Red Deck",["size"]=52,},["gone"]=true,}`, patch, true},
+		{"missing table", `return {["dollars"]=4,["deck"]={},}`,
+			[]Change{{Path: "dollars", Old: lua.LNumber(4), New: lua.LNumber(5)}, {Path: "jokers.1", Old: lua.LNil, New: lua.LString("j_joker")}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := compileTable(t, test.src)
+			before := Clone(tbl)
+			err := ApplyPatch(tbl, test.patch)
+			if err == nil {
+				t.Fatalf("expected error, got nil")
+			}
+			if got := errors.Is(err, ErrPatchConflict); got != test.conflict {
+				t.Errorf("got error %v; want conflict %v", err, test.conflict)
+			}
+			if !Equal(tbl, before) {
+				t.Errorf("failed ApplyPatch() modified the table")
+			}
+		})
+	}
+}
+
+func TestMarshalPatch(t *testing.T) {
+	t.Parallel()
+
+	a := compileTable(t, `return {["dollars"]=4,["jokers"]={"j_joker",},["deck"]={["name"]="Red Deck",["size"]=52,},["gone"]=true,}`)
+	b := compileTable(t, `return {["dollars"]=10,["jokers"]={"j_joker","j_greedy",},["deck"]={["name"]="Red Deck",["size"]=51,},["new"]={["x"]=1,},}`)
+	patch := Diff(a, b)
+
+	data, err := MarshalPatch(patch)
+	if err != nil {
+		t.Fatalf("MarshalPatch() error: %v", err)
+	}
+	got, err := UnmarshalPatch(data)
+	if err != nil {
+		t.Fatalf("UnmarshalPatch() error: %v", err)
+	}
+	if len(got) != len(patch) {
+		t.Fatalf("got %d changes; want %d", len(got), len(patch))
+	}
+	for i, ch := range got {
+		want := patch[i]
+		if ch.Path != want.Path || !equalValue(ch.Old, want.Old, make(map[[2]*lua.LTable]bool)) || !equalValue(ch.New, want.New, make(map[[2]*lua.LTable]bool)) {
+			t.Errorf("change %d is %v; want %v", i, ch, want)
+		}
+	}
+
+	target := Clone(a)
+	if err := ApplyPatch(target, got); err != nil {
+		t.Fatalf("ApplyPatch() error: %v", err)
+	}
+	if !Equal(target, b) {
+		t.Errorf("table patched from a reloaded patch differs from b")
+	}
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"entry not a table", `return {"dollars",}`},
+		{"missing path", `return {{["op"]="delete",},}`},
+		{"unknown op", `return {{["path"]="dollars",["op"]="add",},}`},
+		{"set without value", `return {{["path"]="dollars",["op"]="set",},}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := UnmarshalPatch(compressLua(t, test.src)); err == nil {
+				t.Errorf("expected error, got nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Equal reports whether a and b hold the same keys with deeply equal values.
+// Nested tables are compared by content, and all other values as Lua's ==
+// would compare them. Cyclic tables are equal when they have the same shape.
+func Equal(a, b *lua.LTable) bool {
+	return equal(a, b, make(map[[2]*lua.LTable]bool))
+}
+
+// equal compares a and b, assuming any pair already being compared further up
+// to be equal so that cycles terminate
+func equal(a, b *lua.LTable, seen map[[2]*lua.LTable]bool) bool {
+	if a == b || seen[[2]*lua.LTable{a, b}] {
+		return true
+	}
+	seen[[2]*lua.LTable{a, b}] = true
+
+	eq := true
+	forEach(a, func(key, value lua.LValue) {
+		if eq && !equalValue(value, rawGet(b, key), seen) {
+			eq = false
+		}
+	})
+	forEach(b, func(key, _ lua.LValue) {
+		if eq && rawGet(a, key) == lua.LNil {
+			eq = false
+		}
+	})
+	return eq
+}
+
+// SameContent reports whether two jkr files decode to equal tables, ignoring
+// differences in compression and key order.
+func SameContent(a, b []byte) (bool, error) {
+	var ta, tb lua.LTable
+	if err := Unmarshal(a, &ta); err != nil {
+		return false, err
+	}
+	if err := Unmarshal(b, &tb); err != nil {
+		return false, err
+	}
+	return Equal(&ta, &tb), nil
+}
+
+// equalValue compares two table values, recursing into tables
+func equalValue(a, b lua.LValue, seen map[[2]*lua.LTable]bool) bool {
+	ta, aTbl := a.(*lua.LTable)
+	tb, bTbl := b.(*lua.LTable)
+	if aTbl && bTbl {
+		return equal(ta, tb, seen)
+	}
+	return a == b
+}
+
+// rawGet looks up key in tbl, finding integer keys in either part of the table
+func rawGet(tbl *lua.LTable, key lua.LValue) lua.LValue {
+	if i, ok := arrayIndex(key); ok {
+		return rawGetIndex(tbl, i)
+	}
+	return tbl.RawGet(key)
+}
@@ -0,0 +1,84 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestEqual(t *testing.T) {
+	t.Parallel()
+
+	build := func(fields map[string]lua.LValue) *lua.LTable {
+		tbl := newTable()
+		for k, v := range fields {
+			tbl.RawSetString(k, v)
+		}
+		return tbl
+	}
+	nested := func(v lua.LValue) *lua.LTable {
+		tbl := newTable()
+		tbl.RawSetInt(1, v)
+		return tbl
+	}
+
+	tests := []struct {
+		name string
+		a, b *lua.LTable
+		want bool
+	}{
+		{"empty", newTable(), newTable(), true},
+		{"same fields", build(map[string]lua.LValue{"a": lua.LNumber(1), "b": lua.LString("x")}), build(map[string]lua.LValue{"b": lua.LString("x"), "a": lua.LNumber(1)}), true},
+		{"different value", build(map[string]lua.LValue{"a": lua.LNumber(1)}), build(map[string]lua.LValue{"a": lua.LNumber(2)}), false},
+		{"different type", build(map[string]lua.LValue{"a": lua.LNumber(1)}), build(map[string]lua.LValue{"a": lua.LString("1")}), false},
+		{"extra key", build(map[string]lua.LValue{"a": lua.LTrue}), build(map[string]lua.LValue{"a": lua.LTrue, "b": lua.LTrue}), false},
+		{"missing key", build(map[string]lua.LValue{"a": lua.LTrue, "b": lua.LTrue}), build(map[string]lua.LValue{"a": lua.LTrue}), false},
+		{"equal nested", build(map[string]lua.LValue{"t": nested(lua.LString("x"))}), build(map[string]lua.LValue{"t": nested(lua.LString("x"))}), true},
+		{"different nested", build(map[string]lua.LValue{"t": nested(lua.LString("x"))}), build(map[string]lua.LValue{"t": nested(lua.LString("y"))}), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := Equal(test.a, test.b); got != test.want {
+				t.Errorf("Equal() = %t; want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSameContent(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		a, b string
+		want bool
+	}{
+		{"reordered keys", `return {["a"]=1,["b"]={[1]="x",[2]="y",},}`, `return {b={"x","y"},a=1}`, true},
+		{"different value", `return {["a"]=1,}`, `return {["a"]=2,}`, false},
+		{"extra key", `return {["a"]=1,}`, `return {["a"]=1,["b"]=2,}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := SameContent(compressLua(t, test.a), compressLua(t, test.b))
+			if err != nil {
+				t.Fatalf("SameContent() error: %v", err)
+			}
+			if got != test.want {
+				t.Errorf("SameContent() = %t; want %t", got, test.want)
+			}
+		})
+	}
+
+	if _, err := SameContent([]byte("not flate"), compressLua(t, "return {}")); err == nil {
+		t.Errorf("SameContent() accepted invalid input")
+	}
+}
@@ -0,0 +1,70 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import "errors"
+
+// ErrNotATable is returned when the decompressed content does not evaluate to
+// a single Lua table, which means the file is not one of the jkr files this
+// package supports. It also matches ErrParse.
+var ErrNotATable error = parseError("jkr: top-level value is not a table")
+
+// ErrPrecisionLoss is returned when WithSafeNumbers is enabled and a number
+// cannot be written as text that reads back as exactly the same value.
+var ErrPrecisionLoss = errors.New("jkr: number cannot be represented exactly")
+
+// ErrMaxDepthExceeded is returned when tables are nested deeper than the limit
+// set with WithMaxDepth.
+var ErrMaxDepthExceeded = errors.New("jkr: maximum nesting depth exceeded")
+
+// ErrCompressedSizeExceeded is returned when compressed input is longer than
+// the limit set with WithMaxCompressedSize.
+var ErrCompressedSizeExceeded = errors.New("jkr: compressed input exceeds size limit")
+
+// ErrTimeout is returned when reading takes longer than the limit set with
+// WithTimeout, or than the deadline of the context passed to ReadContext.
+var ErrTimeout = errors.New("jkr: read timed out")
+
+// ErrPatchConflict is returned by ApplyPatch when the value at a change's path
+// is not the change's Old value, meaning the table has diverged from the one
+// the patch was computed against.
+var ErrPatchConflict = errors.New("jkr: patch conflicts with table")
+
+// ErrTooManyTables is returned when decoding would construct more tables than
+// the limit set with WithMaxTables.
+var ErrTooManyTables = errors.New("jkr: too many tables")
+
+// ErrUnsupportedValueType is returned when a table holds a value that has no
+// serialized form, such as a function, a channel or userdata. The error names
+// the Lua type of the value.
+var ErrUnsupportedValueType = errors.New("jkr: unsupported value type")
+
+// ErrInvalidUTF8 is returned by ToJSON when a key or string value is not
+// valid UTF-8, which JSON cannot represent, unless WithSanitizeUTF8 is
+// enabled. The error quotes the offending string.
+var ErrInvalidUTF8 = errors.New("jkr: string is not valid UTF-8")
+
+// ErrDecompress is returned when the compressed data of a file is invalid,
+// such as a file that is not a jkr file at all or one that is truncated. The
+// error wraps the decompressor's own error.
+var ErrDecompress = errors.New("jkr: invalid compressed data")
+
+// ErrParse matches every error reporting that decompressed data is not a
+// valid table, such as a *SyntaxError or ErrNotATable, so that it can be told
+// apart from ErrDecompress with errors.Is.
+var ErrParse = errors.New("jkr: invalid table data")
+
+// parseError is a sentinel error that also matches ErrParse
+type parseError string
+
+func (e parseError) Error() string {
+	return string(e)
+}
+
+func (e parseError) Is(target error) bool {
+	return target == ErrParse
+}
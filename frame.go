@@ -0,0 +1,65 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// WriteFramed marshals tbl and writes it to w prefixed with its compressed
+// length as a 4-byte big-endian integer, so that a reader on a stream such as
+// a net.Conn knows where each table ends without relying on EOF.
+func WriteFramed(w io.Writer, tbl *lua.LTable, opts ...Option) error {
+	data, err := Marshal(tbl, opts...)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) > math.MaxUint32 {
+		return fmt.Errorf("jkr: frame of %d bytes exceeds the 4-byte length prefix", len(data))
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(data)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadFramed reads a single table written by WriteFramed, consuming exactly
+// its length prefix and payload from r. It returns io.EOF if r is exhausted
+// before a new frame starts, and io.ErrUnexpectedEOF if a frame is truncated.
+func ReadFramed(r io.Reader, opts ...Option) (*lua.LTable, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	// copy rather than allocate the full length up front, so that a corrupt
+	// prefix cannot force a huge allocation
+	var payload bytes.Buffer
+	n := int64(binary.BigEndian.Uint32(header[:]))
+	if _, err := io.CopyN(&payload, r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	out := &lua.LTable{}
+	if err := Unmarshal(payload.Bytes(), out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
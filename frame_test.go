@@ -0,0 +1,75 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestFramedRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	first := newTable()
+	first.RawSetString("foo", lua.LString("bar"))
+	second := newTable()
+	second.RawSetInt(1, lua.LNumber(42))
+	tables := []*lua.LTable{first, second}
+
+	pr, pw := io.Pipe()
+	go func() {
+		for _, tbl := range tables {
+			if err := WriteFramed(pw, tbl); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	for i, want := range tables {
+		got, err := ReadFramed(pr)
+		if err != nil {
+			t.Fatalf("ReadFramed() frame %d error: %v", i, err)
+		}
+		if !Equal(got, want) {
+			t.Errorf("frame %d differs after round-trip", i)
+		}
+	}
+	if _, err := ReadFramed(pr); err != io.EOF {
+		t.Errorf("got %v after the last frame; want io.EOF", err)
+	}
+}
+
+func TestReadFramedTruncated(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	if err := WriteFramed(&buf, newTable()); err != nil {
+		t.Fatalf("WriteFramed() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", buf.Bytes()[:2]},
+		{"truncated payload", buf.Bytes()[:buf.Len()-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ReadFramed(bytes.NewReader(test.data))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("got %v; want io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
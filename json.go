@@ -0,0 +1,325 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ToJSON converts tbl into JSON.
+//
+// Array tables, whose keys are exactly 1..n, become JSON arrays in index
+// order. All other tables, including empty ones, become JSON objects whose
+// keys are sorted like the marshaler sorts them, with numeric keys written as
+// their decimal text. Object tables become the string "MANUAL_REPLACE", just
+// as they do when marshaling. NaN and infinite numbers have no JSON form and
+// are reported as errors, as are strings that are not valid UTF-8 unless
+// WithSanitizeUTF8 is enabled. So is a string key that would share its JSON
+// name with a number key, such as "1" and 1, since one would be lost.
+func ToJSON(tbl *lua.LTable, opts ...Option) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := ToJSONWrite(&buf, tbl, opts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ToJSONWrite is like ToJSON but streams the JSON to w as it is produced,
+// so memory use does not grow with the size of the output. If an error
+// occurs, part of the output may already have been written.
+func ToJSONWrite(w io.Writer, tbl *lua.LTable, opts ...Option) error {
+	e := &jsonEncoder{
+		opts: newOptions(opts),
+		buf:  bufio.NewWriter(w),
+	}
+	if err := e.encodeTable(tbl); err != nil {
+		return err
+	}
+	return e.buf.Flush()
+}
+
+// jsonEncoder holds the state of a single ToJSON call
+type jsonEncoder struct {
+	opts    options
+	buf     *bufio.Writer
+	visited tableStack
+	depth   int
+}
+
+func (e *jsonEncoder) encodeTable(tbl *lua.LTable) error {
+	e.depth++
+	defer func() { e.depth-- }()
+	if err := e.opts.checkDepth(e.depth); err != nil {
+		return err
+	}
+
+	if e.visited.contains(tbl) {
+		return fmt.Errorf("circular reference detected in table")
+	}
+	e.visited.push(tbl)
+	defer e.visited.pop()
+
+	seq, other, n := scanKeys(tbl)
+	if seq == 0 && other == 0 && e.opts.jsonEmptyTable == EmptyArray {
+		e.buf.WriteString("[]")
+		return nil
+	}
+	if other == 0 && seq > 0 && int64(seq) == n {
+		e.buf.WriteByte('[')
+		// iterate by index so elements keep their order
+		for i := int64(1); i <= n; i++ {
+			if i > 1 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.encodeValue(rawGetIndex(tbl, i)); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte(']')
+		return nil
+	}
+
+	e.buf.WriteByte('{')
+	first := true
+	// a number key and a string key can share a name, such as 1 and "1"
+	names := make(map[string]bool)
+	for _, en := range sortedEntries(tbl) {
+		if e.dropped(en.value) {
+			continue
+		}
+		if !first {
+			e.buf.WriteByte(',')
+		}
+		first = false
+		var name string
+		switch k := en.key.(type) {
+		case lua.LString:
+			name = string(k)
+		case lua.LNumber:
+			name = strconv.FormatFloat(float64(k), 'f', -1, 64)
+		default:
+			return fmt.Errorf("invalid key type: table keys must be strings or numbers")
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate key: string and number keys both become the JSON name %q", name)
+		}
+		names[name] = true
+		if err := e.writeString(name); err != nil {
+			return err
+		}
+		e.buf.WriteByte(':')
+		if err := e.encodeValue(en.value); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+func (e *jsonEncoder) encodeValue(value lua.LValue) error {
+	switch v := value.(type) {
+	case *lua.LTable:
+		if e.opts.isObject(v) {
+			return e.encodeObject(v)
+		}
+		return e.encodeTable(v)
+	case lua.LString:
+		return e.writeString(string(v))
+	case lua.LBool:
+		e.buf.WriteString(strconv.FormatBool(bool(v)))
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return fmt.Errorf("unsupported number %v: JSON has no NaN or infinity", f)
+		}
+		e.buf.WriteString(strconv.FormatFloat(f, 'f', -1, 64))
+	default:
+		return unsupportedValue(value)
+	}
+	return nil
+}
+
+// encodeObject writes the placeholder for an object table
+func (e *jsonEncoder) encodeObject(obj *lua.LTable) error {
+	if e.opts.objectPolicy == DropObjects {
+		// only reached for array elements
+		e.buf.WriteString("null")
+		return nil
+	}
+	if !e.opts.jsonTaggedObjects {
+		return e.writeString("MANUAL_REPLACE")
+	}
+	e.buf.WriteString(`{"__jkr_object__":true`)
+	if class, ok := objectClass(obj); ok {
+		e.buf.WriteString(`,"class":`)
+		if err := e.writeString(class); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+// dropped reports whether value is an object left out by DropObjects
+func (e *jsonEncoder) dropped(value lua.LValue) bool {
+	tbl, ok := value.(*lua.LTable)
+	return ok && e.opts.objectPolicy == DropObjects && e.opts.isObject(tbl)
+}
+
+// writeString writes s as a JSON string, failing or sanitizing it if it is
+// not valid UTF-8
+func (e *jsonEncoder) writeString(s string) error {
+	if !utf8.ValidString(s) {
+		if !e.opts.sanitizeUTF8 {
+			return fmt.Errorf("%w: %q", ErrInvalidUTF8, s)
+		}
+		s = strings.ToValidUTF8(s, string(utf8.RuneError))
+	}
+	b, _ := json.Marshal(s)
+	e.buf.Write(b)
+	return nil
+}
+
+// WithJSONTaggedObjects makes ToJSON write object tables as the tagged object
+// {"__jkr_object__":true,"class":"Joker"} instead of the string
+// "MANUAL_REPLACE", so that they cannot be mistaken for a real string. The
+// class is taken from the object's name, key or set field and left out if it
+// has none.
+func WithJSONTaggedObjects(enabled bool) Option {
+	return func(o *options) {
+		o.jsonTaggedObjects = enabled
+	}
+}
+
+// JSONEmptyTable selects how ToJSON writes empty tables, which Lua does not
+// distinguish as arrays or objects.
+type JSONEmptyTable int
+
+const (
+	// EmptyObject writes empty tables as {}.
+	EmptyObject JSONEmptyTable = iota
+	// EmptyArray writes empty tables as [].
+	EmptyArray
+)
+
+// WithJSONEmptyTable sets how ToJSON writes empty tables. The default is
+// EmptyObject. Either way an empty table is never written as null, and
+// FromJSON reads both {} and [] back as an empty table.
+func WithJSONEmptyTable(style JSONEmptyTable) Option {
+	return func(o *options) {
+		o.jsonEmptyTable = style
+	}
+}
+
+// FromJSON converts JSON into a table, the reverse of ToJSON. The top-level
+// value must be an object or an array, or ErrNotATable is returned.
+//
+// Arrays become tables indexed from 1 and objects become tables with string
+// keys, so numeric keys that ToJSON wrote as text come back as strings. Null
+// values are left out, since a Lua table cannot hold nil.
+func FromJSON(data []byte, opts ...Option) (*lua.LTable, error) {
+	d := &jsonDecoder{
+		opts: newOptions(opts),
+		dec:  json.NewDecoder(bytes.NewReader(data)),
+	}
+	d.dec.UseNumber()
+
+	tok, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil, fmt.Errorf("%w: got JSON %T", ErrNotATable, tok)
+	}
+	tbl, err := d.decodeTable(delim)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("jkr: unexpected data after top-level JSON value")
+	}
+	return tbl, nil
+}
+
+// jsonDecoder holds the state of a single FromJSON call
+type jsonDecoder struct {
+	opts   options
+	dec    *json.Decoder
+	depth  int
+	tables int
+}
+
+// decodeTable decodes the object or array whose opening delim was just read
+func (d *jsonDecoder) decodeTable(delim json.Delim) (*lua.LTable, error) {
+	d.depth++
+	defer func() { d.depth-- }()
+	if err := d.opts.checkDepth(d.depth); err != nil {
+		return nil, err
+	}
+	d.tables++
+	if err := d.opts.checkTables(d.tables); err != nil {
+		return nil, err
+	}
+
+	tbl := newTable()
+	for i := 1; d.dec.More(); i++ {
+		var key lua.LValue = lua.LNumber(i)
+		if delim == '{' {
+			tok, err := d.dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			key = lua.LString(tok.(string))
+		}
+		value, err := d.decodeValue()
+		if err != nil {
+			return nil, err
+		}
+		if value != lua.LNil {
+			tbl.RawSet(key, value)
+		}
+	}
+	// closing delimiter
+	if _, err := d.dec.Token(); err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+func (d *jsonDecoder) decodeValue() (lua.LValue, error) {
+	tok, err := d.dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch v := tok.(type) {
+	case json.Delim:
+		return d.decodeTable(v)
+	case string:
+		return lua.LString(v), nil
+	case json.Number:
+		f, err := strconv.ParseFloat(string(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(f), nil
+	case bool:
+		return lua.LBool(v), nil
+	default:
+		return lua.LNil, nil
+	}
+}
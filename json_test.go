@@ -0,0 +1,390 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestToJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		setup     func(*lua.LState) *lua.LTable
+		expected  string
+		expectErr bool
+	}{
+		{
+			"empty table",
+			func(L *lua.LState) *lua.LTable {
+				return L.NewTable()
+			}, `{}`, false},
+		{
+			"scalars",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("name", lua.LString("P1 \"quoted\""))
+				tbl.RawSetString("dollars", lua.LNumber(4.5))
+				tbl.RawSetString("won", lua.LTrue)
+				return tbl
+			}, `{"dollars":4.5,"name":"P1 \"quoted\"","won":true}`, false},
+		{
+			"numeric keys",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(2, lua.LString("b"))
+				tbl.RawSetInt(10, lua.LString("j"))
+				tbl.RawSetString("x", lua.LString("x"))
+				return tbl
+			}, `{"2":"b","10":"j","x":"x"}`, false},
+		{
+			"object table",
+			func(L *lua.LState) *lua.LTable {
+				obj := L.NewTable()
+				obj.RawSetString("is", L.NewFunction(func(L *lua.LState) int { return 0 }))
+				tbl := L.NewTable()
+				tbl.RawSetString("card", obj)
+				return tbl
+			}, `{"card":"MANUAL_REPLACE"}`, false},
+		{
+			"NaN",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("x", lua.LNumber(math.NaN()))
+				return tbl
+			}, "", true},
+		{
+			"string and number key collide",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("1", lua.LString("string"))
+				tbl.RawSetInt(1, lua.LString("number"))
+				tbl.RawSetString("x", lua.LString("x"))
+				return tbl
+			}, "", true},
+		{
+			"fractional key collides",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("0.5", lua.LTrue)
+				tbl.RawSetH(lua.LNumber(0.5), lua.LFalse)
+				return tbl
+			}, "", true},
+		{
+			"circular reference",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("self", tbl)
+				return tbl
+			}, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			got, err := ToJSON(test.setup(L))
+			if test.expectErr {
+				if err == nil {
+					t.Fatalf("expected error for test %q, got nil", test.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToJSON() error for test %q: %v", test.name, err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("got %s; want %s", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestToJSONArrayOrder(t *testing.T) {
+	t.Parallel()
+
+	// keys set out of order through the hash part, which iterates randomly
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	for _, i := range []int{5, 3, 1, 4, 2} {
+		tbl.RawSetH(lua.LNumber(i), lua.LNumber(i*10))
+	}
+
+	for range 20 {
+		got, err := ToJSON(tbl)
+		if err != nil {
+			t.Fatalf("ToJSON() error: %v", err)
+		}
+		if want := `[10,20,30,40,50]`; string(got) != want {
+			t.Fatalf("got %s; want %s", got, want)
+		}
+	}
+}
+
+func TestToJSONInvalidUTF8(t *testing.T) {
+	t.Parallel()
+
+	// the escapes decode to a lone continuation byte and a truncated rune,
+	// and the long string holds a raw invalid byte
+	src := compressLua(t, `return {["name"]="J\128ker",["bad\226\130"]=1,["ok"]="é",["long"]=[[`+"\xff"+`]],}`)
+
+	tests := []struct {
+		name      string
+		opts      []Option
+		expected  string
+		expectErr error
+	}{
+		{
+			name:      "strict",
+			expectErr: ErrInvalidUTF8,
+		},
+		{
+			name:     "sanitized",
+			opts:     []Option{WithSanitizeUTF8(true)},
+			expected: `{"bad` + "\uFFFD" + `":1,"long":"` + "\uFFFD" + `","name":"J` + "\uFFFD" + `ker","ok":"é"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			tbl := newTable()
+			if err := Unmarshal(src, tbl); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			got, err := ToJSON(tbl, test.opts...)
+			if test.expectErr != nil {
+				if !errors.Is(err, test.expectErr) {
+					t.Fatalf("ToJSON() error = %v, want %v", err, test.expectErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ToJSON() error: %v", err)
+			}
+			if !json.Valid(got) {
+				t.Errorf("ToJSON() output is not valid JSON: %s", got)
+			}
+			if string(got) != test.expected {
+				t.Errorf("got %s; want %s", got, test.expected)
+			}
+
+			// sanitizing while decoding leaves nothing for ToJSON to reject
+			tbl = newTable()
+			if err := Unmarshal(src, tbl, test.opts...); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if got := tbl.RawGetString("name"); got != lua.LString("J\uFFFDker") {
+				t.Errorf("decoded name = %q, want sanitized", got)
+			}
+			if got := tbl.RawGetString("long"); got != lua.LString("\uFFFD") {
+				t.Errorf("decoded long string = %q, want sanitized", got)
+			}
+			if _, err := ToJSON(tbl); err != nil {
+				t.Errorf("ToJSON() of sanitized table error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFromJSON(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		json      string
+		expected  string
+		expectErr bool
+	}{
+		{"empty object", `{}`, `return {}`, false},
+		{"array", `["a","b",3]`, `return {"a","b",3,}`, false},
+		{"object", `{"name":"P1","won":true,"dollars":4.5,"nested":{"x":[1]}}`,
+			`return {["dollars"]=4.5,["name"]="P1",["nested"]={["x"]={1,},},["won"]=true,}`, false},
+		{"numeric keys stay strings", `{"2":"b"}`, `return {["2"]="b",}`, false},
+		{"null dropped", `{"a":null,"b":1}`, `return {["b"]=1,}`, false},
+		{"top-level string", `"foo"`, "", true},
+		{"top-level number", `1`, "", true},
+		{"trailing data", `{} {}`, "", true},
+		{"malformed", `{"a":}`, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl, err := FromJSON([]byte(test.json))
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FromJSON() error: %v", err)
+			}
+			data, err := Serialize(tbl)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if got := string(data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestJSONEmptyTable(t *testing.T) {
+	t.Parallel()
+
+	tbl := compileTable(t, `return {["empty"]={},["nested"]={["inner"]={},},["n"]=1,}`)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default", nil, `{"empty":{},"n":1,"nested":{"inner":{}}}`},
+		{"object", []Option{WithJSONEmptyTable(EmptyObject)}, `{"empty":{},"n":1,"nested":{"inner":{}}}`},
+		{"array", []Option{WithJSONEmptyTable(EmptyArray)}, `{"empty":[],"n":1,"nested":{"inner":[]}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ToJSON(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("ToJSON() error: %v", err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("got %s; want %s", got, test.expected)
+			}
+
+			back, err := FromJSON(got)
+			if err != nil {
+				t.Fatalf("FromJSON() error: %v", err)
+			}
+			if !Equal(back, tbl) {
+				t.Errorf("tables not equal after JSON round-trip")
+			}
+			data, err := Serialize(back)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if want := `return {["empty"]={},["n"]=1,["nested"]={["inner"]={},},}`; string(data) != want {
+				t.Errorf("got %s; want %s", data, want)
+			}
+		})
+	}
+}
+
+func TestJSONMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	const depth = 10000
+	tbl := newTable()
+	for inner, i := tbl, 1; i < depth; i++ {
+		next := newTable()
+		inner.RawSetInt(1, next)
+		inner = next
+	}
+	deep := []byte(strings.Repeat("[", depth) + strings.Repeat("]", depth))
+
+	if _, err := ToJSON(tbl, WithMaxDepth(depth)); err != nil {
+		t.Errorf("ToJSON() at the limit error: %v", err)
+	}
+	if _, err := ToJSON(tbl, WithMaxDepth(100)); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("ToJSON() got %v; want ErrMaxDepthExceeded", err)
+	}
+	if _, err := FromJSON(deep, WithMaxDepth(depth)); err != nil {
+		t.Errorf("FromJSON() at the limit error: %v", err)
+	}
+	if _, err := FromJSON(deep, WithMaxDepth(100)); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("FromJSON() got %v; want ErrMaxDepthExceeded", err)
+	}
+}
+
+func TestToJSONWrite(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	want, err := ToJSON(tbl)
+	if err != nil {
+		t.Fatalf("ToJSON() error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := ToJSONWrite(&buf, tbl); err != nil {
+		t.Fatalf("ToJSONWrite() error: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("streamed output differs from ToJSON")
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("streamed output is not valid JSON")
+	}
+
+	if err := ToJSONWrite(failingWriter{}, tbl); err == nil {
+		t.Errorf("expected write error, got nil")
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestToJSONTaggedObjects(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		opts     []Option
+		expected string
+	}{
+		{"default", map[string]string{"set": "Joker"}, nil, `{"card":"MANUAL_REPLACE"}`},
+		{"with class", map[string]string{"set": "Joker"}, []Option{WithJSONTaggedObjects(true)}, `{"card":{"__jkr_object__":true,"class":"Joker"}}`},
+		{"without class", nil, []Option{WithJSONTaggedObjects(true)}, `{"card":{"__jkr_object__":true}}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			obj := L.NewTable()
+			obj.RawSetString("is", L.NewFunction(func(L *lua.LState) int { return 0 }))
+			for k, v := range test.fields {
+				obj.RawSetString(k, lua.LString(v))
+			}
+			tbl := L.NewTable()
+			tbl.RawSetString("card", obj)
+
+			got, err := ToJSON(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("ToJSON() error: %v", err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("got %s; want %s", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"math"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TableKind describes the key layout of a table.
+type TableKind int
+
+const (
+	// Array is a table whose keys are exactly the integers 1..n.
+	Array TableKind = iota
+	// Map is a table with no 1..n sequence, including the empty table.
+	Map
+	// Mixed is a table with a 1..n sequence plus other keys.
+	Mixed
+)
+
+func (k TableKind) String() string {
+	switch k {
+	case Array:
+		return "array"
+	case Map:
+		return "map"
+	case Mixed:
+		return "mixed"
+	default:
+		return "unknown"
+	}
+}
+
+// Kind reports whether tbl is an array, a map or a mix of both in a single
+// pass over its keys.
+func Kind(tbl *lua.LTable) TableKind {
+	seq, other, maxIndex := scanKeys(tbl)
+	switch {
+	case seq == 0 || int64(seq) != maxIndex:
+		return Map
+	case other == 0:
+		return Array
+	default:
+		return Mixed
+	}
+}
+
+// scanKeys counts the sequence and other keys of tbl and finds its highest
+// sequence index
+func scanKeys(tbl *lua.LTable) (seq, other int, maxIndex int64) {
+	forEach(tbl, func(key, _ lua.LValue) {
+		if i, ok := arrayIndex(key); ok {
+			seq++
+			maxIndex = max(maxIndex, i)
+		} else {
+			other++
+		}
+	})
+	return seq, other, maxIndex
+}
+
+// rawGetIndex returns the value at index i, which gopher-lua may hold in
+// either the array or the hash part of tbl
+func rawGetIndex(tbl *lua.LTable, i int64) lua.LValue {
+	if v := tbl.RawGetInt(int(i)); v != lua.LNil {
+		return v
+	}
+	return tbl.RawGetH(lua.LNumber(i))
+}
+
+// forEach calls cb for every key of tbl exactly once. gopher-lua can hold an
+// integer key in both the array and the hash part of a table, where the array
+// value shadows the other; ForEach visits the array part first and then both
+// copies, so shadowed hash entries are skipped.
+func forEach(tbl *lua.LTable, cb func(key, value lua.LValue)) {
+	inArray := true
+	var last int64
+	tbl.ForEach(func(key, value lua.LValue) {
+		if i, ok := arrayIndex(key); ok && i <= math.MaxInt32 && tbl.RawGetInt(int(i)) != lua.LNil {
+			if inArray && i > last {
+				last = i
+				cb(key, value)
+			}
+			return
+		}
+		inArray = false
+		cb(key, value)
+	})
+}
+
+// arrayIndex reports whether key is a positive integer usable as a sequence index
+func arrayIndex(key lua.LValue) (int64, bool) {
+	n, ok := key.(lua.LNumber)
+	if !ok {
+		return 0, false
+	}
+	f := float64(n)
+	if f < 1 || f > 1<<53 || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
@@ -0,0 +1,104 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestKind(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		setup    func(*lua.LState) *lua.LTable
+		expected TableKind
+	}{
+		{
+			"empty table",
+			func(L *lua.LState) *lua.LTable {
+				return L.NewTable()
+			}, Map},
+		{
+			"pure array",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.Append(lua.LString("a"))
+				tbl.Append(lua.LString("b"))
+				tbl.Append(lua.LString("c"))
+				return tbl
+			}, Array},
+		{
+			"pure map",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetString("foo", lua.LNumber(1))
+				tbl.RawSetString("bar", lua.LNumber(2))
+				return tbl
+			}, Map},
+		{
+			"array with a hole",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(1, lua.LString("a"))
+				tbl.RawSetInt(2, lua.LString("b"))
+				tbl.RawSetInt(4, lua.LString("d"))
+				return tbl
+			}, Map},
+		{
+			"array plus string key",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(1, lua.LString("a"))
+				tbl.RawSetInt(2, lua.LString("b"))
+				tbl.RawSetString("foo", lua.LBool(true))
+				return tbl
+			}, Mixed},
+		{
+			"zero index",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(0, lua.LString("z"))
+				tbl.RawSetInt(1, lua.LString("a"))
+				return tbl
+			}, Mixed},
+		{
+			"negative index",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(-1, lua.LString("n"))
+				tbl.RawSetInt(1, lua.LString("a"))
+				return tbl
+			}, Mixed},
+		{
+			"only non-positive indices",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSetInt(-1, lua.LString("n"))
+				tbl.RawSetInt(0, lua.LString("z"))
+				return tbl
+			}, Map},
+		{
+			"fractional key",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				tbl.RawSet(lua.LNumber(1.5), lua.LString("a"))
+				return tbl
+			}, Map},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			if got := Kind(test.setup(L)); got != test.expected {
+				t.Errorf("got %v; want %v", got, test.expected)
+			}
+		})
+	}
+}
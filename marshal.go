@@ -8,107 +8,1038 @@ package jkr
 
 import (
 	"bytes"
+	"cmp"
 	"compress/flate"
+	"crypto/md5"
 	"fmt"
 	"io"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode/utf8"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-func Marshal(in *lua.LTable) (out []byte, err error) {
+func Marshal(in *lua.LTable, opts ...Option) (out []byte, err error) {
 	buf := &bytes.Buffer{}
-	err = MarshalWrite(buf, in)
+	err = MarshalWrite(buf, in, opts...)
 	return buf.Bytes(), err
 }
 
-func MarshalWrite(out io.Writer, in *lua.LTable) (err error) {
-	zw, _ := flate.NewWriter(out, flate.BestSpeed)
-	defer zw.Close()
-
-	visited := make(map[*lua.LTable]bool)
-	data, err := stringPack(in, false, visited)
+func MarshalWrite(out io.Writer, in *lua.LTable, opts ...Option) (err error) {
+	data, err := Serialize(in, opts...)
 	if err != nil {
 		return err
 	}
+	return compress(out, data, newOptions(opts).compressionLevel)
+}
+
+// MarshalWriteHashed is like MarshalWrite but also returns the MD5 sum and
+// length of the compressed bytes, computed as they are written to out rather
+// than in a second pass over buffered output. If writing fails, sum and n
+// cover the bytes written before the failure.
+func MarshalWriteHashed(out io.Writer, in *lua.LTable, opts ...Option) (sum []byte, n int, err error) {
+	h := md5.New()
+	var count countingWriter
+	err = MarshalWrite(io.MultiWriter(out, h, &count), in, opts...)
+	return h.Sum(nil), int(count), err
+}
+
+// WriteStats reports the size of a marshaled table before and after
+// compression.
+type WriteStats struct {
+	Uncompressed int
+	Compressed   int
+	// Placeholders is the number of object tables written as placeholders,
+	// or left out under DropObjects. Their contents do not survive a
+	// round-trip, so a nonzero count means the output is lossy.
+	Placeholders int
+}
+
+// Ratio returns the compressed size as a fraction of the uncompressed size.
+func (s WriteStats) Ratio() float64 {
+	if s.Uncompressed == 0 {
+		return 0
+	}
+	return float64(s.Compressed) / float64(s.Uncompressed)
+}
+
+// MarshalStats is like Marshal but also reports the output sizes and how many
+// objects were written as placeholders.
+func MarshalStats(in *lua.LTable, opts ...Option) ([]byte, WriteStats, error) {
+	e := newEncoder(opts)
+	data, err := e.serialize(in)
+	if err != nil {
+		return nil, WriteStats{}, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := compress(buf, data, e.opts.compressionLevel); err != nil {
+		return nil, WriteStats{}, err
+	}
+	stats := WriteStats{
+		Uncompressed: len(data),
+		Compressed:   buf.Len(),
+		Placeholders: e.placeholders,
+	}
+	return buf.Bytes(), stats, nil
+}
+
+// MarshalCanonical marshals tbl in one opinionated format meant for clean,
+// stable diffs in tooling rather than for matching the game: keys sorted,
+// names written as bare identifiers, dense sequences written positionally,
+// one field per line indented with tabs, and numbers in their shortest exact
+// form. It fails with ErrPrecisionLoss rather than write a number that would
+// not read back unchanged. Unlike WithBalatroCompat, the output is not in the
+// format of the game's STR_PACK, although Balatro and Unmarshal still read it.
+func MarshalCanonical(tbl *lua.LTable) ([]byte, error) {
+	return Marshal(tbl,
+		WithDeterministic(true),
+		WithIdentifierKeys(true),
+		WithArrayThreshold(0),
+		WithIndent("\t"),
+		WithSafeNumbers(true),
+		WithIntegralFloatFormat(IntegralInt),
+	)
+}
+
+// Minify decodes the jkr file in and re-encodes it as small as this package
+// can write it: at flate.BestCompression, with names as bare keys, sequences
+// written positionally and no whitespace, comments or other leniencies of the
+// input. The result still loads in Balatro. opts apply to both the decode and
+// the encode, except that they cannot change these settings.
+func Minify(in []byte, opts ...Option) ([]byte, error) {
+	tbl := newTable()
+	if err := Unmarshal(in, tbl, opts...); err != nil {
+		return nil, err
+	}
+	return Marshal(tbl, append(slices.Clip(opts),
+		WithIdentifierKeys(true),
+		WithArrayThreshold(0),
+		WithIndent(""),
+		WithCompressionLevel(flate.BestCompression),
+	)...)
+}
+
+// MarshalSize returns the length of what Marshal would produce for in, running
+// the same pipeline but counting the compressed bytes instead of keeping them.
+func MarshalSize(in *lua.LTable, opts ...Option) (int, error) {
+	var w countingWriter
+	if err := MarshalWrite(&w, in, opts...); err != nil {
+		return 0, err
+	}
+	return int(w), nil
+}
+
+// countingWriter discards everything written to it, counting the bytes
+type countingWriter int
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// flateWriters pools compressors per level, from flate.HuffmanOnly at index 0
+// to flate.BestCompression, since each one allocates several hundred
+// kilobytes of state
+var flateWriters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
 
-	if _, err := zw.Write([]byte(data)); err != nil {
+// compress deflates data into out at level, which is flate.BestSpeed unless
+// WithCompressionLevel changes it
+func compress(out io.Writer, data []byte, level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		_, err := flate.NewWriter(out, level)
+		return fmt.Errorf("jkr: %w", err)
+	}
+	pool := &flateWriters[level-flate.HuffmanOnly]
+	zw, ok := pool.Get().(*flate.Writer)
+	if ok {
+		zw.Reset(out)
+	} else {
+		zw, _ = flate.NewWriter(out, level)
+	}
+	defer pool.Put(zw)
+
+	if _, err := zw.Write(data); err != nil {
+		return err
+	}
+	if err := zw.Flush(); err != nil {
 		return err
 	}
+	return zw.Close()
+}
+
+// Serialize returns the uncompressed Lua source for in, without the flate
+// layer that Marshal adds.
+//
+// Like every function that reads a table, Serialize must not run while
+// another goroutine mutates in, unless WithSnapshot is used.
+func Serialize(in *lua.LTable, opts ...Option) ([]byte, error) {
+	return newEncoder(opts).serialize(in)
+}
+
+// serialize implements Serialize
+func (e *encoder) serialize(in *lua.LTable) ([]byte, error) {
+	if l := e.opts.snapshotLock; l != nil {
+		l.Lock()
+		in = Clone(in)
+		l.Unlock()
+	}
+	data, err := e.stringPack(in, false)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(data), nil
+}
+
+// MarshalFields returns the fields of tbl serialized like Serialize writes
+// them, such as ["a"]=1,["b"]=2, but without the surrounding braces and
+// return, for splicing into a table constructor written by hand.
+func MarshalFields(tbl *lua.LTable, opts ...Option) (string, error) {
+	e := newEncoder(opts)
+	data, err := e.stringPack(tbl, true)
+	if err != nil {
+		return "", err
+	}
+	return data[1 : len(data)-1], nil
+}
+
+// MarshalWithState is like Marshal, but instead of writing the
+// "MANUAL_REPLACE" placeholder for an object table it calls the object's save
+// method in L, as Balatro does with obj:save(), and inlines the table that
+// returns. Objects without a save method are still written as the
+// placeholder. Errors raised by the Lua call are returned rather than
+// propagated as panics. With WithSnapshot, the save methods are called on the
+// copy after the lock is released.
+func MarshalWithState(L *lua.LState, tbl *lua.LTable, opts ...Option) ([]byte, error) {
+	e := newEncoder(opts)
+	e.state = L
+	data, err := e.serialize(tbl)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := &bytes.Buffer{}
+	if err := compress(buf, data, e.opts.compressionLevel); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// MarshalValidate walks all of tbl and returns every problem that would make
+// Marshal fail, such as invalid keys, unsupported values and circular
+// references, without producing any output. It returns nil if tbl can be
+// marshaled.
+func MarshalValidate(tbl *lua.LTable, opts ...Option) []error {
+	e := newEncoder(append(slices.Clip(opts), WithCycleCheck(true)))
+	var errs []error
+	e.validate(tbl, nil, &errs)
+	return errs
+}
+
+// validate appends every serialization problem below data to errs
+func (e *encoder) validate(data *lua.LTable, path []string, errs *[]error) {
+	if e.visited.contains(data) {
+		*errs = append(*errs, fmt.Errorf("%s: circular reference detected in table", formatPath(path)))
+		return
+	}
+	e.visited.push(data)
+	defer e.visited.pop()
+
+	e.forEach(data, func(key, value lua.LValue) {
+		keyPath := append(slices.Clip(path), key.String())
+		if _, err := e.packKey(key); err != nil {
+			*errs = append(*errs, fmt.Errorf("%s: %w", formatPath(keyPath), err))
+		}
+		switch value.Type() {
+		case lua.LTTable:
+			tbl := value.(*lua.LTable)
+			if !e.opts.isObject(tbl) {
+				e.validate(tbl, keyPath, errs)
+			}
+		case lua.LTNumber:
+			if err := e.checkNumber(value.(lua.LNumber)); err != nil {
+				*errs = append(*errs, fmt.Errorf("%s: %w", formatPath(keyPath), err))
+			}
+		case lua.LTString, lua.LTBool:
+		default:
+			*errs = append(*errs, fmt.Errorf("%s: %w", formatPath(keyPath), unsupportedValue(value)))
+		}
+	})
+}
+
+// formatPath joins path segments for error messages
+func formatPath(path []string) string {
+	if len(path) == 0 {
+		return "<root>"
+	}
+	return strings.Join(path, ".")
+}
+
+// encoder holds the state of a single marshal call
+type encoder struct {
+	opts    options
+	visited tableStack
+	state   *lua.LState
+	depth   int
+	// path holds the keys leading to the value being packed, and is only
+	// tracked when hex keys are configured
+	path []string
+	// packed holds the output of every table already serialized at a given
+	// depth, when WithSharedTableCache is enabled
+	packed map[packedKey]packedTable
+	// placeholders counts the objects replaced or dropped so far
+	placeholders int
+}
+
+// packedTable is the cached output of a table and the number of placeholders
+// in it
+type packedTable struct {
+	s            string
+	placeholders int
+}
+
+// tableStack holds the tables being encoded, outermost first. Encoding is
+// depth first, so a table closes a cycle exactly when it is already on the
+// stack, and scanning the few ancestors of a typical table is cheaper than a
+// map that grows and shrinks with every table. Past scanDepth ancestors the
+// deeper ones are also kept in a map, so pathologically deep input does not
+// make every check linear.
+type tableStack struct {
+	tables []*lua.LTable
+	deep   map[*lua.LTable]bool
+}
+
+// scanDepth is how many ancestors tableStack scans before using its map
+const scanDepth = 64
+
+func (s *tableStack) contains(tbl *lua.LTable) bool {
+	return slices.Contains(s.tables[:min(len(s.tables), scanDepth)], tbl) || s.deep[tbl]
+}
+
+func (s *tableStack) push(tbl *lua.LTable) {
+	if len(s.tables) >= scanDepth {
+		if s.deep == nil {
+			s.deep = make(map[*lua.LTable]bool)
+		}
+		s.deep[tbl] = true
+	}
+	s.tables = append(s.tables, tbl)
+}
 
-	return zw.Flush()
+func (s *tableStack) pop() {
+	n := len(s.tables) - 1
+	if n >= scanDepth {
+		delete(s.deep, s.tables[n])
+	}
+	s.tables = s.tables[:n]
+}
+
+// packedKey identifies a table serialized at a depth, which decides its
+// indentation
+type packedKey struct {
+	tbl   *lua.LTable
+	depth int
+}
+
+func newEncoder(opts []Option) *encoder {
+	e := &encoder{opts: newOptions(opts)}
+	// output that depends on the path cannot be reused at another path
+	if e.opts.sharedCache && !e.tracksPath() {
+		e.packed = make(map[packedKey]packedTable)
+	}
+	return e
 }
 
 // stringPack serializes a lua.LTable into a Lua table literal string with cycle detection
-func stringPack(data *lua.LTable, recursive bool, visited map[*lua.LTable]bool) (string, error) {
+func (e *encoder) stringPack(data *lua.LTable, recursive bool) (string, error) {
+	e.depth++
+	defer func() { e.depth-- }()
+	if err := e.opts.checkDepth(e.depth); err != nil {
+		return "", err
+	}
+
 	// Check for cycles
-	if visited[data] {
-		return "", fmt.Errorf("circular reference detected in table")
+	if e.opts.cycleCheck {
+		if e.visited.contains(data) {
+			return "", fmt.Errorf("circular reference detected in table")
+		}
+		e.visited.push(data)
+		defer e.visited.pop()
 	}
-	visited[data] = true
-	defer func() {
-		delete(visited, data)
-	}()
 
 	var b strings.Builder
 	if !recursive {
+		if e.opts.headerComment != "" {
+			for line := range strings.Lines(e.opts.headerComment) {
+				b.WriteString("-- ")
+				b.WriteString(strings.TrimRight(line, "\r\n"))
+				b.WriteString("\n")
+			}
+		}
 		b.WriteString("return ")
 	}
 	b.WriteString("{")
 
+	nils := e.nilKeys(data)
+	if n, ok := e.arrayLength(data); ok && len(nils) == 0 {
+		if e.inline(data, n) {
+			if err := e.packInline(&b, data, n); err != nil {
+				return "", err
+			}
+			b.WriteString("}")
+			return b.String(), nil
+		}
+		if err := e.packPositional(&b, data, n); err != nil {
+			return "", err
+		}
+		if n > 0 {
+			e.newline(&b, e.depth-1)
+		}
+		b.WriteString("}")
+		return b.String(), nil
+	}
+
+	// a mixed table leads with its sequence, as Lua's own constructors do
+	seq := e.sequenceLength(data)
+	if err := e.packPositional(&b, data, seq); err != nil {
+		return "", err
+	}
+
 	var gerr error
-	data.ForEach(func(key, value lua.LValue) {
-		// serialize key
-		var k string
-		switch key.Type() {
-		case lua.LTString:
-			k = fmt.Sprintf("[%q]", key.String())
-		case lua.LTNumber:
-			k = fmt.Sprintf("[%v]", key)
-		default:
-			gerr = fmt.Errorf("invalid key type: table keys must be strings or numbers")
+	empty := seq == 0
+	e.forEach(data, func(key, value lua.LValue) {
+		if gerr != nil {
 			return
 		}
-		// serialize value
-		var v string
-		var err error
-		switch value.Type() {
-		case lua.LTTable:
-			tbl := value.(*lua.LTable)
-			// detect Object tables by presence of an 'is' method without VM invocation
-			fn := tbl.RawGetString("is")
-			if fn.Type() == lua.LTFunction {
-				v = "\"MANUAL_REPLACE\""
+		if i, ok := arrayIndex(key); ok && i <= int64(seq) {
+			return
+		}
+		k, err := e.packKey(key)
+		if err != nil {
+			gerr = err
+			return
+		}
+		e.enter(key)
+		v, err := e.packValue(k, value)
+		e.leave()
+		if err != nil {
+			gerr = err
+			return
+		}
+		if v == "" {
+			return
+		}
+		e.packField(&b, k, v)
+		empty = false
+	})
+	if gerr != nil {
+		return "", gerr
+	}
+	for _, key := range nils {
+		k, err := e.packKey(key)
+		if err != nil {
+			return "", err
+		}
+		e.packField(&b, k, "nil")
+		empty = false
+	}
+	if !empty {
+		e.newline(&b, e.depth-1)
+	}
+	b.WriteString("}")
+	return b.String(), nil
+}
+
+// packField serializes a key-value pair of already serialized key k and
+// value v
+func (e *encoder) packField(b *strings.Builder, k, v string) {
+	e.newline(b, e.depth)
+	b.WriteString(k)
+	if e.opts.indent != "" {
+		b.WriteString(" = ")
+	} else {
+		b.WriteString("=")
+	}
+	b.WriteString(v)
+	b.WriteString(",")
+}
+
+// nilKeys returns the keys recorded as nil in data for WithExplicitNil that
+// data does not otherwise hold
+func (e *encoder) nilKeys(data *lua.LTable) []lua.LValue {
+	if !e.opts.explicitNil {
+		return nil
+	}
+	var keys []lua.LValue
+	for _, key := range e.opts.nilKeys[data] {
+		if rawGet(data, key) == lua.LNil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// packPositional serializes indices 1..n of data as positional values, with
+// nil filling any tolerated holes
+func (e *encoder) packPositional(b *strings.Builder, data *lua.LTable, n int) error {
+	for i := 1; i <= n; i++ {
+		v := "nil"
+		if value := rawGetIndex(data, int64(i)); value != lua.LNil {
+			var err error
+			e.enter(lua.LNumber(i))
+			v, err = e.packValue(fmt.Sprintf("[%d]", i), value)
+			e.leave()
+			if err != nil {
+				return err
+			}
+			if v == "" {
+				// keep the positions of the values after a dropped object
+				v = "nil"
+			}
+		}
+		e.newline(b, e.depth)
+		b.WriteString(v)
+		b.WriteString(",")
+	}
+	return nil
+}
+
+// inline reports whether the list of n values in data is short enough to stay
+// on one line when pretty-printing, as set by WithArrayWrapThreshold
+func (e *encoder) inline(data *lua.LTable, n int) bool {
+	if e.opts.indent == "" || n == 0 || n > e.opts.arrayWrap {
+		return false
+	}
+	for i := 1; i <= n; i++ {
+		if rawGetIndex(data, int64(i)).Type() == lua.LTTable {
+			return false
+		}
+	}
+	return true
+}
+
+// packInline serializes the n values in data on one line, separated by ", "
+func (e *encoder) packInline(b *strings.Builder, data *lua.LTable, n int) error {
+	for i := 1; i <= n; i++ {
+		v := "nil"
+		if value := rawGetIndex(data, int64(i)); value != lua.LNil {
+			var err error
+			e.enter(lua.LNumber(i))
+			v, err = e.packValue(fmt.Sprintf("[%d]", i), value)
+			e.leave()
+			if err != nil {
+				return err
+			}
+		}
+		if i > 1 {
+			b.WriteString(", ")
+		}
+		b.WriteString(v)
+	}
+	return nil
+}
+
+// packKey serializes a table key
+func (e *encoder) packKey(key lua.LValue) (string, error) {
+	switch key.Type() {
+	case lua.LTString:
+		if e.opts.identifierKeys && isIdentifier(key.String()) {
+			return key.String(), nil
+		}
+		return "[" + e.quote(key.String()) + "]", nil
+	case lua.LTNumber:
+		if math.IsNaN(float64(key.(lua.LNumber))) {
+			return "", fmt.Errorf("invalid key: NaN cannot be a table key")
+		}
+		if err := e.checkNumber(key.(lua.LNumber)); err != nil {
+			return "", err
+		}
+		n := key.(lua.LNumber)
+		if n == 0 {
+			// -0 and 0 are the same key
+			n = 0
+		}
+		return "[" + e.formatNumber(n) + "]", nil
+	default:
+		return "", fmt.Errorf("invalid key type: table keys must be strings or numbers")
+	}
+}
+
+// luaKeywords are the reserved words of Lua 5.1, which cannot be written as
+// bare keys
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true,
+	"end": true, "false": true, "for": true, "function": true, "if": true,
+	"in": true, "local": true, "nil": true, "not": true, "or": true,
+	"repeat": true, "return": true, "then": true, "true": true, "until": true,
+	"while": true,
+}
+
+// isIdentifier reports whether s can be written as a bare key like name=
+func isIdentifier(s string) bool {
+	if s == "" || !isNameStart(s[0]) || luaKeywords[s] {
+		return false
+	}
+	for i := 1; i < len(s); i++ {
+		if !isNameStart(s[i]) && !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// packValue serializes the value stored under the serialized key k. It
+// returns "" for an object dropped by DropObjects.
+func (e *encoder) packValue(k string, value lua.LValue) (string, error) {
+	switch value.Type() {
+	case lua.LTTable:
+		tbl := value.(*lua.LTable)
+		if e.opts.isObject(tbl) {
+			if e.state == nil {
+				return e.placeholder(tbl), nil
+			}
+			saved, err := e.callSave(tbl)
+			if err != nil {
+				return "", fmt.Errorf("error saving object for key %s: %w", k, err)
+			}
+			if saved == nil {
+				return e.placeholder(tbl), nil
+			}
+			tbl = saved
+		}
+		pk := packedKey{tbl, e.depth + 1}
+		if p, ok := e.packed[pk]; ok {
+			e.placeholders += p.placeholders
+			return p.s, nil
+		}
+		before := e.placeholders
+		v, err := e.stringPack(tbl, true)
+		if err != nil {
+			return "", fmt.Errorf("error packing table value for key %s: %w", k, err)
+		}
+		if e.packed != nil {
+			e.packed[pk] = packedTable{v, e.placeholders - before}
+		}
+		return v, nil
+	case lua.LTString:
+		return e.quote(value.String()), nil
+	case lua.LTBool:
+		return e.formatBool(lua.LVAsBool(value)), nil
+	case lua.LTNumber:
+		if err := e.checkNumber(value.(lua.LNumber)); err != nil {
+			return "", fmt.Errorf("%w for key %s", err, k)
+		}
+		if e.tracksPath() {
+			path := strings.Join(e.path, ".")
+			if format, ok := e.opts.numberFormats[path]; ok {
+				return formatCustom(value.(lua.LNumber), format, path)
+			}
+			if e.opts.hexKeys[path] {
+				if s, ok := formatHex(value.(lua.LNumber)); ok {
+					return s, nil
+				}
+			}
+		}
+		return e.formatNumber(value.(lua.LNumber)), nil
+	default:
+		return "", fmt.Errorf("%w for key %s", unsupportedValue(value), k)
+	}
+}
+
+// unsupportedValue reports that value has no serialized form, naming its Lua
+// type, such as channel or function
+func unsupportedValue(value lua.LValue) error {
+	return fmt.Errorf("%w %s", ErrUnsupportedValueType, value.Type())
+}
+
+// newline starts a new line indented to depth when pretty-printing
+func (e *encoder) newline(b *strings.Builder, depth int) {
+	if e.opts.indent == "" {
+		return
+	}
+	b.WriteString("\n")
+	for range depth {
+		b.WriteString(e.opts.indent)
+	}
+}
+
+// enter pushes key onto the path of the value being packed
+func (e *encoder) enter(key lua.LValue) {
+	if e.tracksPath() {
+		e.path = append(e.path, key.String())
+	}
+}
+
+// leave pops the last key pushed by enter
+func (e *encoder) leave() {
+	if e.tracksPath() {
+		e.path = e.path[:len(e.path)-1]
+	}
+}
+
+// tracksPath reports whether any option needs the path of packed values
+func (e *encoder) tracksPath() bool {
+	return e.opts.hexKeys != nil || e.opts.numberFormats != nil
+}
+
+// isObject detects Object tables by presence of an 'is' method without VM
+// invocation, also requiring a metatable or a set field under
+// WithStrictObjects
+func (o *options) isObject(tbl *lua.LTable) bool {
+	if tbl.RawGetString("is").Type() != lua.LTFunction {
+		return false
+	}
+	if !o.strictObjects {
+		return true
+	}
+	hasMeta := tbl.Metatable != nil && tbl.Metatable != lua.LNil
+	return hasMeta || tbl.RawGetString("set") != lua.LNil
+}
+
+// objectClassFields are the fields that name an object's class, in the order
+// they are tried
+var objectClassFields = []string{"name", "key", "set"}
+
+// objectClass returns the class an object table names through one of
+// objectClassFields
+func objectClass(tbl *lua.LTable) (string, bool) {
+	for _, field := range objectClassFields {
+		if s, ok := tbl.RawGetString(field).(lua.LString); ok && s != "" {
+			return string(s), true
+		}
+	}
+	return "", false
+}
+
+// placeholder returns the serialized string written in place of an object,
+// or "" if objects are dropped
+func (e *encoder) placeholder(obj *lua.LTable) string {
+	e.placeholders++
+	if e.opts.objectPolicy == DropObjects {
+		return ""
+	}
+	if e.opts.placeholderFormat != "" {
+		if class, ok := objectClass(obj); ok {
+			return e.quote(fmt.Sprintf(e.opts.placeholderFormat, class))
+		}
+	}
+	return "\"MANUAL_REPLACE\""
+}
+
+// callSave calls obj:save() in the encoder's state and returns the resulting
+// table, or nil if obj has no save method
+func (e *encoder) callSave(obj *lua.LTable) (saved *lua.LTable, err error) {
+	L := e.state
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic calling save: %v", r)
+		}
+	}()
+
+	fn := L.GetField(obj, "save")
+	if fn.Type() != lua.LTFunction {
+		return nil, nil
+	}
+	if err := L.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, obj); err != nil {
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	saved, ok := ret.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("save returned %s, want table", ret.Type())
+	}
+	return saved, nil
+}
+
+// arrayLength reports whether data should be written as a positional list
+// and, if so, the highest index it spans
+func (e *encoder) arrayLength(data *lua.LTable) (int, bool) {
+	if e.opts.arrayThreshold < 0 {
+		return 0, false
+	}
+	var count int
+	var maxIndex int64
+	ok := true
+	forEach(data, func(key, _ lua.LValue) {
+		i, isIndex := arrayIndex(key)
+		if !isIndex {
+			ok = false
+			return
+		}
+		count++
+		maxIndex = max(maxIndex, i)
+	})
+	if !ok || count == 0 || maxIndex-int64(count) > int64(e.opts.arrayThreshold) {
+		return 0, false
+	}
+	return int(maxIndex), true
+}
+
+// sequenceLength returns the length of the 1..n sequence of a mixed table, or
+// zero for any other table or when positional output is disabled
+func (e *encoder) sequenceLength(data *lua.LTable) int {
+	if e.opts.arrayThreshold < 0 {
+		return 0
+	}
+	seq, other, maxIndex := scanKeys(data)
+	if seq == 0 || other == 0 || int64(seq) != maxIndex {
+		return 0
+	}
+	return seq
+}
+
+// checkNumber rejects NaN, which has no text form Lua can read, and when safe
+// numbers are enabled also the other numbers that do not round-trip through
+// their text form
+func (e *encoder) checkNumber(n lua.LNumber) error {
+	f := float64(n)
+	if math.IsNaN(f) {
+		return fmt.Errorf("%w: %v", ErrPrecisionLoss, f)
+	}
+	if !e.opts.safeNumbers {
+		return nil
+	}
+	if math.IsInf(f, 0) || (math.Abs(f) > 1<<53 && f == math.Trunc(f)) {
+		return fmt.Errorf("%w: %v", ErrPrecisionLoss, f)
+	}
+	if e.opts.gameNumbers {
+		if g, _ := strconv.ParseFloat(strconv.FormatFloat(f, 'g', gameDigits, 64), 64); g != f {
+			return fmt.Errorf("%w: %v has more than %d significant digits", ErrPrecisionLoss, f, gameDigits)
+		}
+	}
+	return nil
+}
+
+// formatNumber writes n in the one canonical form used for all output:
+// integers as plain digits however large, such as 1000000000000000000000 for
+// 1e21, followed by .0 under IntegralFloat, and everything else as the
+// shortest text that reads back as the same float64, using a lowercase e with
+// an explicit sign for exponents, such as 1.5e-07. Infinities are written as 1e999 and -1e999, which
+// overflow to them when read. Under WithBalatroCompat, numbers keep only the
+// 14 significant digits of LuaJIT's tostring, which STR_PACK relies on.
+func (e *encoder) formatNumber(n lua.LNumber) string {
+	f := float64(n)
+	if math.IsInf(f, 0) {
+		if f < 0 {
+			return "-1e999"
+		}
+		return "1e999"
+	}
+	if f == math.Trunc(f) && (!e.opts.gameNumbers || math.Abs(f) < 1e14) {
+		// keeps the sign of -0, which the parser reads back
+		s := strconv.FormatFloat(f, 'f', -1, 64)
+		if e.opts.integralFloat == IntegralFloat {
+			s += ".0"
+		}
+		return s
+	}
+	if e.opts.gameNumbers {
+		return strconv.FormatFloat(f, 'g', gameDigits, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// gameDigits is the number of significant digits LuaJIT's tostring keeps,
+// formatting numbers with %.14g
+const gameDigits = 14
+
+// quote writes s as a Lua string literal, escaped as set by
+// WithStringEscapePolicy
+func (e *encoder) quote(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n' && e.opts.escapePolicy == DecimalEscape:
+			// %q continues the string on the next line
+			b.WriteString("\\\n")
+		case c == '\n':
+			b.WriteString(`\n`)
+		case e.opts.escapePolicy == MinimalEscape:
+			// a raw carriage return ends a Lua string like a newline does
+			if c == '\r' {
+				b.WriteString(`\r`)
 			} else {
-				v, err = stringPack(tbl, true, visited)
-				if err != nil {
-					gerr = fmt.Errorf("error packing table value for key %s: %w", k, err)
-					return
+				b.WriteByte(c)
+			}
+		case c < ' ' || c == 0x7f:
+			if e.opts.escapePolicy == DecimalEscape {
+				// LuaJIT pads the decimal escape when a digit follows it
+				b.WriteByte('\\')
+				if i+1 < len(s) && isDigit(s[i+1]) {
+					fmt.Fprintf(&b, "%03d", c)
+				} else {
+					b.WriteString(strconv.Itoa(int(c)))
 				}
+			} else if short, ok := shortEscapes[c]; ok {
+				b.WriteString(short)
+			} else {
+				fmt.Fprintf(&b, `\x%02x`, c)
 			}
-		case lua.LTString:
-			v = fmt.Sprintf("%q", value.String())
-		case lua.LTBool:
-			if lua.LVAsBool(value) {
-				v = "true"
+		case c >= utf8.RuneSelf && e.opts.escapePolicy == HexEscape:
+			// Lua has no escape for a rune, so only invalid bytes are escaped
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if r == utf8.RuneError && size == 1 {
+				fmt.Fprintf(&b, `\x%02x`, c)
 			} else {
-				v = "false"
+				b.WriteString(s[i : i+size])
 			}
-		case lua.LTNumber:
-			v = fmt.Sprintf("%v", value)
+			i += size
+			continue
 		default:
-			gerr = fmt.Errorf("unsupported value type %T for key %s", value, k)
-			return
+			b.WriteByte(c)
 		}
-		// serialize key-value pair
-		b.WriteString(k)
-		b.WriteString("=")
-		b.WriteString(v)
-		b.WriteString(",")
+		i++
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// shortEscapes are the single-letter escapes HexEscape writes for the control
+// bytes that have one
+var shortEscapes = map[byte]string{
+	'\a': `\a`, '\b': `\b`, '\f': `\f`, '\r': `\r`, '\t': `\t`, '\v': `\v`,
+}
+
+// formatHex writes an integer n in hexadecimal, reporting false if n is not
+// an integer that fits in an int64
+func formatHex(n lua.LNumber) (string, bool) {
+	f := float64(n)
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return "", false
+	}
+	i := int64(f)
+	if i < 0 {
+		return "-0x" + strconv.FormatUint(uint64(-i), 16), true
+	}
+	return "0x" + strconv.FormatInt(i, 16), true
+}
+
+// formatCustom writes n with a format set by WithNumberFormat, rejecting
+// output that would not read back as a number
+func formatCustom(n lua.LNumber, format, path string) (string, error) {
+	s := fmt.Sprintf(format, float64(n))
+	p := &parser{src: []byte(s)}
+	if v, err := p.parseValue(); err != nil || v.Type() != lua.LTNumber || p.pos != len(p.src) {
+		return "", fmt.Errorf("number format %q for %s produced %q, which is not a number", format, path, s)
+	}
+	return s, nil
+}
+
+// formatBool writes a boolean according to the configured BoolStyle
+func (e *encoder) formatBool(b bool) string {
+	switch {
+	case e.opts.boolStyle == NumericBool && b:
+		return "1"
+	case e.opts.boolStyle == NumericBool:
+		return "0"
+	case b:
+		return "true"
+	default:
+		return "false"
+	}
+}
+
+// forEach calls cb for every key of data, in sorted key order unless
+// deterministic output was turned off
+func (e *encoder) forEach(data *lua.LTable, cb func(key, value lua.LValue)) {
+	if e.depth == 1 && len(e.opts.keyOrder) > 0 {
+		e.forEachOrdered(data, cb)
+		return
+	}
+	if !e.opts.deterministic {
+		forEach(data, cb)
+		return
+	}
+
+	for _, en := range sortedEntries(data) {
+		cb(en.key, en.value)
+	}
+}
+
+// forEachOrdered calls cb for the keys set by WithKeyOrder first, and then
+// for the remaining keys in the usual order
+func (e *encoder) forEachOrdered(data *lua.LTable, cb func(key, value lua.LValue)) {
+	listed := make(map[lua.LValue]bool, len(e.opts.keyOrder))
+	for _, k := range e.opts.keyOrder {
+		key := lua.LString(k)
+		if listed[key] {
+			continue
+		}
+		listed[key] = true
+		if v := data.RawGetString(k); v != lua.LNil {
+			cb(key, v)
+		}
+	}
+
+	rest := func(key, value lua.LValue) {
+		if !listed[key] {
+			cb(key, value)
+		}
+	}
+	if !e.opts.deterministic {
+		forEach(data, rest)
+		return
+	}
+	for _, en := range sortedEntries(data) {
+		rest(en.key, en.value)
+	}
+}
+
+// b2i converts a boolean into 1 or 0 for comparison
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// entry is a single key-value pair of a table
+type entry struct {
+	key, value lua.LValue
+}
+
+// sortedEntries returns the entries of tbl sorted by key with compareKeys
+func sortedEntries(tbl *lua.LTable) []entry {
+	var entries []entry
+	forEach(tbl, func(key, value lua.LValue) {
+		entries = append(entries, entry{key, value})
 	})
-	if gerr != nil {
-		return "", gerr
+	slices.SortFunc(entries, func(a, b entry) int {
+		return compareKeys(a.key, b.key)
+	})
+	return entries
+}
+
+// compareKeys orders numbers before strings, numbers by value with NaN last
+// and strings bytewise. Distinct keys never compare equal, except NaN keys,
+// which Lua cannot hold and the marshaler rejects.
+func compareKeys(a, b lua.LValue) int {
+	an, aNum := a.(lua.LNumber)
+	bn, bNum := b.(lua.LNumber)
+	switch {
+	case aNum && bNum:
+		if aNaN, bNaN := math.IsNaN(float64(an)), math.IsNaN(float64(bn)); aNaN || bNaN {
+			return cmp.Compare(b2i(aNaN), b2i(bNaN))
+		}
+		return cmp.Compare(float64(an), float64(bn))
+	case aNum:
+		return -1
+	case bNum:
+		return 1
 	}
-	b.WriteString("}")
-	return b.String(), nil
+	if c := cmp.Compare(a.Type(), b.Type()); c != 0 {
+		return c
+	}
+	return strings.Compare(a.String(), b.String())
 }
@@ -6,7 +6,15 @@ package jkr
 import (
 	"bytes"
 	"compress/flate"
+	"crypto/md5"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"slices"
@@ -46,7 +54,7 @@ func TestMarshal(t *testing.T) {
 				tbl.RawSetInt(1, lua.LNumber(42))
 				return tbl
 			}, []string{
-				`return {[1]=42,}`,
+				`return {42,}`,
 			}, false},
 		{
 			"boolean value",
@@ -144,3 +152,2188 @@ func TestMarshal(t *testing.T) {
 		})
 	}
 }
+
+func TestMarshalBoolStyle(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{
+			"default",
+			nil,
+			[]string{
+				`return {["foo"]=true,["bar"]=false,}`,
+				`return {["bar"]=false,["foo"]=true,}`,
+			}},
+		{
+			"lua bool",
+			[]Option{WithBoolStyle(LuaBool)},
+			[]string{
+				`return {["foo"]=true,["bar"]=false,}`,
+				`return {["bar"]=false,["foo"]=true,}`,
+			}},
+		{
+			"numeric bool",
+			[]Option{WithBoolStyle(NumericBool)},
+			[]string{
+				`return {["foo"]=1,["bar"]=0,}`,
+				`return {["bar"]=0,["foo"]=1,}`,
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := &lua.LTable{Metatable: lua.LNil}
+			tbl.RawSetString("foo", lua.LBool(true))
+			tbl.RawSetString("bar", lua.LBool(false))
+
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			got := decompress(t, data)
+			if !slices.Contains(test.expected, got) {
+				t.Errorf("got %q; want one of %q", got, test.expected)
+			}
+		})
+	}
+}
+
+// decompress inflates marshaled data back into its Lua source
+func decompress(t *testing.T, data []byte) string {
+	t.Helper()
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll error: %v", err)
+	}
+	return string(raw)
+}
+
+func TestSerialize(t *testing.T) {
+	t.Parallel()
+
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	tbl.RawSetString("foo", lua.LString("bar"))
+
+	got, err := Serialize(tbl)
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+	if want := `return {["foo"]="bar",}`; string(got) != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		b.Fatalf("ReadFile() error: %v", err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := Marshal(tbl); err != nil {
+			b.Fatalf("Marshal() error: %v", err)
+		}
+	}
+}
+
+func BenchmarkSerialize(b *testing.B) {
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		b.Fatalf("ReadFile() error: %v", err)
+	}
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := Serialize(tbl); err != nil {
+			b.Fatalf("Serialize() error: %v", err)
+		}
+	}
+}
+
+// sharedSubtree returns a table whose n entries all reference one large table
+func sharedSubtree(n int) *lua.LTable {
+	shared := newTable()
+	for i := 1; i <= 500; i++ {
+		card := newTable()
+		card.RawSetString("name", lua.LString(fmt.Sprintf("card %d", i)))
+		card.RawSetString("value", lua.LNumber(i))
+		shared.RawSetInt(i, card)
+	}
+	tbl := newTable()
+	for i := 1; i <= n; i++ {
+		tbl.RawSetString(fmt.Sprintf("area%d", i), shared)
+	}
+	return tbl
+}
+
+func BenchmarkSharedTableCache(b *testing.B) {
+	tbl := sharedSubtree(50)
+	for _, enabled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("enabled=%v", enabled), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := Serialize(tbl, WithSharedTableCache(enabled)); err != nil {
+					b.Fatalf("Serialize() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalSharedTableCache(t *testing.T) {
+	t.Parallel()
+
+	tbl := sharedSubtree(3)
+	tbl.RawSetString("nested", sharedSubtree(2))
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"compact", nil},
+		{"indented", []Option{WithIndent("\t")}},
+		{"number format", []Option{WithNumberFormat("area1.1.value", "%.2f")}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			want, err := Serialize(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			got, err := Serialize(tbl, append(test.opts, WithSharedTableCache(true))...)
+			if err != nil {
+				t.Fatalf("Serialize() with cache error: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("output with cache differs from output without")
+			}
+		})
+	}
+
+	cyclic := newTable()
+	cyclic.RawSetString("self", cyclic)
+	if _, err := Serialize(cyclic, WithSharedTableCache(true)); err == nil {
+		t.Errorf("expected circular reference error, got nil")
+	}
+}
+
+func TestMarshalWithoutCycleCheck(t *testing.T) {
+	t.Parallel()
+
+	nested := &lua.LTable{Metatable: lua.LNil}
+	nested.RawSetInt(1, lua.LNumber(42))
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	tbl.RawSetString("nested", nested)
+
+	data, err := Marshal(tbl, WithCycleCheck(false))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	if got, want := decompress(t, data), `return {["nested"]={42,},}`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func BenchmarkMarshalCycleCheck(b *testing.B) {
+	tbl := wideTable(1000, 10)
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("enabled=%t", enabled), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := Marshal(tbl, WithCycleCheck(enabled)); err != nil {
+					b.Fatalf("Marshal() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCycleCheckStack compares tableStack with the map it replaced,
+// running only the cycle check of a depth-first walk over many tiny tables
+func BenchmarkCycleCheckStack(b *testing.B) {
+	tbl := wideTable(10000, 1)
+	var children []*lua.LTable
+	tbl.ForEach(func(_, v lua.LValue) {
+		children = append(children, v.(*lua.LTable))
+	})
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			visited := make(map[*lua.LTable]bool)
+			visited[tbl] = true
+			for _, child := range children {
+				if visited[child] {
+					b.Fatal("unexpected cycle")
+				}
+				visited[child] = true
+				delete(visited, child)
+			}
+			delete(visited, tbl)
+		}
+	})
+	b.Run("stack", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			var visited tableStack
+			visited.push(tbl)
+			for _, child := range children {
+				if visited.contains(child) {
+					b.Fatal("unexpected cycle")
+				}
+				visited.push(child)
+				visited.pop()
+			}
+			visited.pop()
+		}
+	})
+}
+
+// wideTable builds an acyclic table of n sub-tables holding m numbers each
+func wideTable(n, m int) *lua.LTable {
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	for i := range n {
+		sub := &lua.LTable{Metatable: lua.LNil}
+		for j := range m {
+			sub.RawSetString(fmt.Sprintf("k%d", j), lua.LNumber(j))
+		}
+		tbl.RawSetString(fmt.Sprintf("t%d", i), sub)
+	}
+	return tbl
+}
+
+func TestMarshalDeterministic(t *testing.T) {
+	t.Parallel()
+
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	for _, k := range []string{"b", "a", "B", "c", "aa"} {
+		tbl.RawSetString(k, lua.LString(k))
+	}
+	tbl.RawSet(lua.LNumber(2.5), lua.LTrue)
+	tbl.RawSetInt(2, lua.LNumber(2))
+	tbl.RawSetInt(1, lua.LNumber(1))
+	tbl.RawSetInt(-1, lua.LNumber(-1))
+
+	const want = `return {1,2,[-1]=-1,[2.5]=true,` +
+		`["B"]="B",["a"]="a",["aa"]="aa",["b"]="b",["c"]="c",}`
+	for range 20 {
+		data, err := Marshal(tbl)
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		if got := decompress(t, data); got != want {
+			t.Fatalf("got %q; want %q", got, want)
+		}
+	}
+}
+
+func TestMarshalArrayHashParts(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetInt(0, lua.LString("zero"))
+	tbl.RawSetInt(1, lua.LString("one"))
+	tbl.Append(lua.LString("two"))
+	tbl.RawSetInt(-1, lua.LString("minus one"))
+	tbl.RawSetInt(5, lua.LString("five"))
+	// a hash-part copy of index 2, shadowed by the array part
+	tbl.RawSetH(lua.LNumber(2), lua.LString("shadowed"))
+
+	data, err := Serialize(tbl)
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+	want := `return {[-1]="minus one",[0]="zero",[1]="one",[2]="two",[5]="five",}`
+	if got := string(data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	got, err := ReadPlain(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadPlain() error: %v", err)
+	}
+	if !Equal(got, tbl) || !Equal(Clone(tbl), tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+	if got := rawGetIndex(Clone(tbl), 2); got != lua.LString("two") {
+		t.Errorf("clone holds %v at index 2; want two", got)
+	}
+}
+
+func TestMarshalMixedArrayFirst(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetString("name", lua.LString("Red Deck"))
+	tbl.RawSetInt(2, lua.LString("b"))
+	tbl.RawSetString("count", lua.LNumber(2))
+	tbl.RawSetInt(1, lua.LString("a"))
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"compact", nil, `return {"a","b",["count"]=2,["name"]="Red Deck",}`},
+		{"indented", []Option{WithIndent("\t")}, "return {\n\t\"a\",\n\t\"b\",\n\t[\"count\"] = 2,\n\t[\"name\"] = \"Red Deck\",\n}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := Serialize(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if got := string(data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+			got, err := ReadPlain(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("ReadPlain() error: %v", err)
+			}
+			if !Equal(got, tbl) {
+				t.Errorf("table differs after round-trip")
+			}
+		})
+	}
+}
+
+func BenchmarkMarshalDeterministic(b *testing.B) {
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	for i := range 1_000_000 {
+		tbl.RawSetString(fmt.Sprintf("k%d", i), lua.LNumber(i))
+	}
+	for _, enabled := range []bool{true, false} {
+		b.Run(fmt.Sprintf("enabled=%t", enabled), func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, err := Serialize(tbl, WithDeterministic(enabled)); err != nil {
+					b.Fatalf("Serialize() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalStats(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+
+	data, stats, err := MarshalStats(tbl)
+	if err != nil {
+		t.Fatalf("MarshalStats() error: %v", err)
+	}
+	src, err := Serialize(tbl)
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+	if stats.Uncompressed != len(src) {
+		t.Errorf("got uncompressed size %d; want %d", stats.Uncompressed, len(src))
+	}
+	if stats.Compressed != len(data) {
+		t.Errorf("got compressed size %d; want %d", stats.Compressed, len(data))
+	}
+	if want := float64(len(data)) / float64(len(src)); stats.Ratio() != want {
+		t.Errorf("got ratio %v; want %v", stats.Ratio(), want)
+	}
+	if got := decompress(t, data); got != string(src) {
+		t.Errorf("MarshalStats() output does not decompress to the serialized source")
+	}
+	if stats.Placeholders != 0 {
+		t.Errorf("got %d placeholders for a decoded table; want 0", stats.Placeholders)
+	}
+}
+
+func TestMarshalStatsPlaceholders(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	is := L.NewFunction(func(*lua.LState) int { return 0 })
+	tbl := newTable()
+	for _, key := range []string{"joker", "consumable"} {
+		obj := L.NewTable()
+		obj.RawSetString("is", is)
+		tbl.RawSetString(key, obj)
+	}
+	tbl.RawSetString("name", lua.LString("P1"))
+
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"placeholder", nil},
+		{"drop", []Option{WithObjectPolicy(DropObjects)}},
+		{"shared cache", []Option{WithSharedTableCache(true)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, stats, err := MarshalStats(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("MarshalStats() error: %v", err)
+			}
+			if stats.Placeholders != 2 {
+				t.Errorf("got %d placeholders; want 2", stats.Placeholders)
+			}
+		})
+	}
+
+	// a shared table is counted every time it is written, cached or not
+	shared := newTable()
+	shared.RawSetString("card", tbl.RawGetString("joker"))
+	outer := newTable()
+	outer.RawSetString("a", shared)
+	outer.RawSetString("b", shared)
+	for _, enabled := range []bool{false, true} {
+		_, stats, err := MarshalStats(outer, WithSharedTableCache(enabled))
+		if err != nil {
+			t.Fatalf("MarshalStats() error: %v", err)
+		}
+		if stats.Placeholders != 2 {
+			t.Errorf("got %d placeholders with cache %v; want 2", stats.Placeholders, enabled)
+		}
+	}
+}
+
+func TestMarshalArrayThreshold(t *testing.T) {
+	t.Parallel()
+
+	dense := []int{1, 2, 3}
+	oneGap := []int{1, 2, 4}
+	sparse := []int{1, 2, 5, 40}
+
+	tests := []struct {
+		name     string
+		keys     []int
+		opts     []Option
+		expected string
+	}{
+		{"dense default", dense, nil, `return {1,2,3,}`},
+		{"one gap default", oneGap, nil, `return {[1]=1,[2]=2,[4]=4,}`},
+		{"very sparse default", sparse, nil, `return {[1]=1,[2]=2,[5]=5,[40]=40,}`},
+		{"dense disabled", dense, []Option{WithArrayThreshold(-1)}, `return {[1]=1,[2]=2,[3]=3,}`},
+		{"one gap threshold 1", oneGap, []Option{WithArrayThreshold(1)}, `return {1,2,nil,4,}`},
+		{"very sparse threshold 1", sparse, []Option{WithArrayThreshold(1)}, `return {[1]=1,[2]=2,[5]=5,[40]=40,}`},
+		{"very sparse threshold 36", sparse, []Option{WithArrayThreshold(36)},
+			`return {1,2,nil,nil,5,` + strings.Repeat("nil,", 34) + `40,}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			tbl := L.NewTable()
+			for _, k := range test.keys {
+				tbl.RawSetInt(k, lua.LNumber(k))
+			}
+
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !deepEquals(L, tbl, &out) {
+				t.Errorf("tables not equal after round-trip")
+			}
+		})
+	}
+}
+
+func TestMarshalNonPositiveIndices(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		keys     []int
+		opts     []Option
+		expected string
+	}{
+		{"zero and one", []int{0, 1}, nil, `return {1,[0]=0,}`},
+		{"minus one and one", []int{-1, 1}, nil, `return {1,[-1]=-1,}`},
+		{"zero with threshold", []int{0, 1, 2}, []Option{WithArrayThreshold(10)}, `return {1,2,[0]=0,}`},
+		{"zero with positional disabled", []int{0, 1}, []Option{WithArrayThreshold(-1)}, `return {[0]=0,[1]=1,}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			tbl := L.NewTable()
+			for _, k := range test.keys {
+				tbl.RawSetInt(k, lua.LNumber(k))
+			}
+
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			for _, k := range test.keys {
+				if got := out.RawGet(lua.LNumber(k)); got != lua.LNumber(k) {
+					t.Errorf("got %v for key %d after round-trip; want %d", got, k, k)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalValidate(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	fn := L.NewFunction(func(L *lua.LState) int { return 0 })
+	nested := L.NewTable()
+	nested.RawSetString("callback", fn)
+	nested.RawSet(lua.LTrue, lua.LString("bool key"))
+	tbl := L.NewTable()
+	tbl.RawSetString("nested", nested)
+	tbl.RawSetString("self", tbl)
+	tbl.RawSetString("fine", lua.LNumber(1))
+	tbl.RawSetString("channel", lua.LChannel(make(chan lua.LValue)))
+
+	if errs := MarshalValidate(L.NewTable()); errs != nil {
+		t.Errorf("got %v for a valid table; want nil", errs)
+	}
+
+	errs := MarshalValidate(tbl)
+	want := []string{
+		"channel: jkr: unsupported value type channel",
+		"nested.true: invalid key type: table keys must be strings or numbers",
+		"nested.callback: jkr: unsupported value type function",
+		"self: circular reference detected in table",
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got errors %q; want %q", got, want)
+	}
+
+	if _, err := Marshal(tbl); err == nil {
+		t.Errorf("Marshal() succeeded on a table MarshalValidate rejected")
+	}
+}
+
+func TestMarshalSafeNumbers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		value     lua.LNumber
+		expectErr bool
+		// NaN has no text form at all, so it fails even without safe numbers
+		defaultErr bool
+	}{
+		{"normal value", 1.5, false, false},
+		{"2^53", 1 << 53, false, false},
+		{"2^54", 1 << 54, true, false},
+		{"-2^54", -1 << 54, true, false},
+		{"NaN", lua.LNumber(math.NaN()), true, true},
+		{"infinity", lua.LNumber(math.Inf(1)), true, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("n", test.value)
+			_, err := Marshal(tbl, WithSafeNumbers(true))
+			if test.expectErr != errors.Is(err, ErrPrecisionLoss) {
+				t.Errorf("got error %v; want ErrPrecisionLoss %t", err, test.expectErr)
+			}
+			if _, err := Marshal(tbl); test.defaultErr != errors.Is(err, ErrPrecisionLoss) {
+				t.Errorf("Marshal() without safe numbers error = %v; want ErrPrecisionLoss %t", err, test.defaultErr)
+			}
+		})
+	}
+}
+
+func TestMarshalWithState(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		src       string
+		expected  string
+		expectErr bool
+	}{
+		{
+			"save inlined",
+			`local obj = {is = function() end, rank = 5}
+			function obj:save() return {rank = self.rank} end
+			return {card = obj}`,
+			`return {["card"]={["rank"]=5,},}`,
+			false,
+		},
+		{
+			"save through metatable",
+			`local Card = {}
+			Card.__index = Card
+			function Card:is() return true end
+			function Card:save() return {id = "j_joker"} end
+			local obj = setmetatable({is = Card.is}, Card)
+			return {card = obj}`,
+			`return {["card"]={["id"]="j_joker",},}`,
+			false,
+		},
+		{
+			"no save method",
+			`return {card = {is = function() end}}`,
+			`return {["card"]="MANUAL_REPLACE",}`,
+			false,
+		},
+		{
+			"save raises",
+			`return {card = {is = function() end, save = function() error("boom") end}}`,
+			"",
+			true,
+		},
+		{
+			"save returns non-table",
+			`return {card = {is = function() end, save = function() return 1 end}}`,
+			"",
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			if err := L.DoString(test.src); err != nil {
+				t.Fatalf("DoString() error: %v", err)
+			}
+			tbl := L.Get(-1).(*lua.LTable)
+			L.Pop(1)
+
+			data, err := MarshalWithState(L, tbl)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("MarshalWithState() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestMarshalNumericStringKeys(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetString("2", lua.LString("string key"))
+	tbl.RawSetInt(2, lua.LString("number key"))
+	tbl.RawSetString("1.5", lua.LString("string float"))
+	tbl.RawSet(lua.LNumber(1.5), lua.LString("number float"))
+
+	data, err := Marshal(tbl)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	want := `return {[1.5]="number float",[2]="number key",["1.5"]="string float",["2"]="string key",}`
+	if got := decompress(t, data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	for _, key := range []lua.LValue{lua.LString("2"), lua.LNumber(2), lua.LString("1.5"), lua.LNumber(1.5)} {
+		if got, want := out.RawGet(key), tbl.RawGet(key); got != want {
+			t.Errorf("got %v for %s key %v; want %v", got, key.Type(), key, want)
+		}
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+}
+
+func TestMarshalNumberFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		value    lua.LNumber
+		expected string
+	}{
+		{"integer", 42, "42"},
+		{"negative integer", -7, "-7"},
+		{"fraction", 0.1, "0.1"},
+		{"large integer", 1e18, "1000000000000000000"},
+		{"beyond int64", 1e21, "1000000000000000000000"},
+		{"small fraction", 1.5e-7, "1.5e-07"},
+		{"negative exponent", -2.5e-10, "-2.5e-10"},
+		{"infinity", lua.LNumber(math.Inf(1)), "1e999"},
+		{"negative infinity", lua.LNumber(math.Inf(-1)), "-1e999"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSet(test.value, test.value)
+			data, err := Marshal(tbl)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			got := decompress(t, data)
+			if want := "return {[" + test.expected + "]=" + test.expected + ",}"; got != want {
+				t.Errorf("got %q; want %q", got, want)
+			}
+			if strings.Contains(got, "E") {
+				t.Errorf("output %q contains an uppercase exponent", got)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if v := out.RawGet(test.value); v != test.value {
+				t.Errorf("got %v after round-trip; want %v", v, test.value)
+			}
+		})
+	}
+}
+
+func TestMarshalOverflowRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, src := range []string{"return {1e400}", "return {-1e400}", `return {["x"]=1e400,}`} {
+		for _, opts := range [][]Option{nil, {WithBalatroCompat()}} {
+			tbl := newTable()
+			if err := Unmarshal(compressLua(t, src), tbl); err != nil {
+				t.Fatalf("Unmarshal(%q) error: %v", src, err)
+			}
+			data, err := Marshal(tbl, opts...)
+			if err != nil {
+				t.Fatalf("Marshal() of %q error: %v", src, err)
+			}
+			out := newTable()
+			if err := Unmarshal(data, out); err != nil {
+				t.Fatalf("Unmarshal() of %q marshaled error: %v", decompress(t, data), err)
+			}
+			if !Equal(tbl, out) {
+				t.Errorf("%q differs after round trip: %q", src, decompress(t, data))
+			}
+		}
+	}
+}
+
+func TestMarshalMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	const depth = 1000
+	tbl := newTable()
+	for inner, i := tbl, 1; i < depth; i++ {
+		next := newTable()
+		inner.RawSetInt(1, next)
+		inner = next
+	}
+
+	data, err := Marshal(tbl, WithMaxDepth(depth))
+	if err != nil {
+		t.Fatalf("Marshal() at the limit error: %v", err)
+	}
+	if _, err := Marshal(tbl, WithMaxDepth(depth-1)); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("Marshal() got %v; want ErrMaxDepthExceeded", err)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out, WithMaxDepth(depth)); err != nil {
+		t.Errorf("Unmarshal() at the limit error: %v", err)
+	}
+	if err := Unmarshal(data, &out, WithMaxDepth(depth-1)); !errors.Is(err, ErrMaxDepthExceeded) {
+		t.Errorf("Unmarshal() got %v; want ErrMaxDepthExceeded", err)
+	}
+}
+
+func TestUnmarshalMaxTables(t *testing.T) {
+	t.Parallel()
+
+	// 1 top-level table holding 50 chains of 20 nested tables
+	const tables = 1 + 50*20
+	tbl := newTable()
+	for i := 1; i <= 50; i++ {
+		inner := newTable()
+		tbl.RawSetInt(i, inner)
+		for j := 1; j < 20; j++ {
+			next := newTable()
+			inner.RawSetInt(1, next)
+			inner = next
+		}
+	}
+
+	data, err := Marshal(tbl)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	var out lua.LTable
+	if err := Unmarshal(data, &out, WithMaxTables(tables)); err != nil {
+		t.Errorf("Unmarshal() at the limit error: %v", err)
+	}
+	if err := Unmarshal(data, &out, WithMaxTables(tables-1)); !errors.Is(err, ErrTooManyTables) {
+		t.Errorf("Unmarshal() got %v; want ErrTooManyTables", err)
+	}
+
+	js, err := ToJSON(tbl)
+	if err != nil {
+		t.Fatalf("ToJSON() error: %v", err)
+	}
+	if _, err := FromJSON(js, WithMaxTables(tables)); err != nil {
+		t.Errorf("FromJSON() at the limit error: %v", err)
+	}
+	if _, err := FromJSON(js, WithMaxTables(tables-1)); !errors.Is(err, ErrTooManyTables) {
+		t.Errorf("FromJSON() got %v; want ErrTooManyTables", err)
+	}
+
+	bin, err := ToBinary(tbl)
+	if err != nil {
+		t.Fatalf("ToBinary() error: %v", err)
+	}
+	if _, err := FromBinary(bin, WithMaxTables(tables)); err != nil {
+		t.Errorf("FromBinary() at the limit error: %v", err)
+	}
+	if _, err := FromBinary(bin, WithMaxTables(tables-1)); !errors.Is(err, ErrTooManyTables) {
+		t.Errorf("FromBinary() got %v; want ErrTooManyTables", err)
+	}
+}
+
+func TestMarshalHexKeys(t *testing.T) {
+	t.Parallel()
+
+	game := newTable()
+	game.RawSetString("flags", lua.LNumber(0x1f))
+	game.RawSetString("dollars", lua.LNumber(31))
+	game.RawSetString("mask", lua.LNumber(-255))
+	game.RawSetString("ratio", lua.LNumber(1.5))
+	tbl := newTable()
+	tbl.RawSetString("GAME", game)
+	tbl.RawSetString("flags", lua.LNumber(31))
+
+	data, err := Marshal(tbl, WithHexKeys([]string{"GAME.flags", "GAME.mask", "GAME.ratio"}))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	want := `return {["GAME"]={["dollars"]=31,["flags"]=0x1f,["mask"]=-0xff,["ratio"]=1.5,},["flags"]=31,}`
+	if got := decompress(t, data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+}
+
+func TestMarshalPathNumberFormat(t *testing.T) {
+	t.Parallel()
+
+	game := newTable()
+	game.RawSetString("interest", lua.LNumber(0.25))
+	game.RawSetString("mult", lua.LNumber(1.5))
+	tbl := newTable()
+	tbl.RawSetString("GAME", game)
+	tbl.RawSetString("mult", lua.LNumber(1.5))
+
+	data, err := Marshal(tbl, WithNumberFormat("GAME.mult", "%.2f"), WithNumberFormat("GAME.interest", "%.3f"))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	want := `return {["GAME"]={["interest"]=0.250,["mult"]=1.50,},["mult"]=1.5,}`
+	if got := decompress(t, data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+
+	for _, format := range []string{"%+.2f", "%v%%", "%x"} {
+		if _, err := Marshal(tbl, WithNumberFormat("GAME.mult", format)); err == nil {
+			t.Errorf("expected error for format %q, got nil", format)
+		}
+	}
+}
+
+func TestMarshalSize(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	for _, tbl := range []*lua.LTable{newTable(), tbl} {
+		data, err := Marshal(tbl)
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		size, err := MarshalSize(tbl)
+		if err != nil {
+			t.Fatalf("MarshalSize() error: %v", err)
+		}
+		if size != len(data) {
+			t.Errorf("got size %d; want %d", size, len(data))
+		}
+	}
+
+	cyclic := newTable()
+	cyclic.RawSetString("self", cyclic)
+	if _, err := MarshalSize(cyclic); err == nil {
+		t.Errorf("expected error for cyclic table, got nil")
+	}
+}
+
+func TestMarshalWriteHashed(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	for _, tbl := range []*lua.LTable{newTable(), tbl} {
+		data, err := Marshal(tbl)
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		var buf bytes.Buffer
+		sum, n, err := MarshalWriteHashed(&buf, tbl)
+		if err != nil {
+			t.Fatalf("MarshalWriteHashed() error: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("MarshalWriteHashed() output differs from Marshal")
+		}
+		if want := md5.Sum(data); !bytes.Equal(sum, want[:]) {
+			t.Errorf("got sum %x; want %x", sum, want)
+		}
+		if n != len(data) {
+			t.Errorf("got n %d; want %d", n, len(data))
+		}
+	}
+}
+
+func TestMarshalKeyOrderStable(t *testing.T) {
+	t.Parallel()
+
+	keys := []lua.LValue{
+		lua.LNumber(1), lua.LNumber(1.0), lua.LNumber(math.Copysign(0, -1)),
+		lua.LNumber(0.30000000000000004), lua.LNumber(0.3), lua.LNumber(1e-300), lua.LNumber(-1e300),
+		lua.LNumber(1 << 53), lua.LNumber(1<<53 + 2), lua.LNumber(-5),
+		lua.LString("1"), lua.LString("-1"), lua.LString(""), lua.LString("1.0"),
+	}
+	tbl := newTable()
+	for i, k := range keys {
+		tbl.RawSetH(k, lua.LNumber(i))
+	}
+
+	first, err := Serialize(tbl)
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+	// whole numbers are written out in full however large
+	minus1e300 := "-1" + strings.Repeat("0", 300)
+	want := `return {[` + minus1e300 + `]=6,[-5]=9,[0]=2,[1e-300]=5,[0.3]=4,[0.30000000000000004]=3,[1]=1,` +
+		`[9007199254740992]=7,[9007199254740994]=8,[""]=12,["-1"]=11,["1"]=10,["1.0"]=13,}`
+	if string(first) != want {
+		t.Errorf("got %q; want %q", first, want)
+	}
+	for range 100 {
+		data, err := Serialize(tbl)
+		if err != nil {
+			t.Fatalf("Serialize() error: %v", err)
+		}
+		if !bytes.Equal(data, first) {
+			t.Fatalf("output changed between runs: %q != %q", data, first)
+		}
+	}
+
+	nan := newTable()
+	nan.RawSetH(lua.LNumber(math.NaN()), lua.LTrue)
+	nan.RawSetH(lua.LNumber(1), lua.LTrue)
+	if _, err := Serialize(nan); err == nil {
+		t.Errorf("expected error for NaN key, got nil")
+	}
+	if got := compareKeys(lua.LNumber(math.NaN()), lua.LNumber(math.Inf(1))); got != 1 {
+		t.Errorf("NaN sorted before +Inf")
+	}
+}
+
+func TestMarshalHeaderComment(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		comment  string
+		expected string
+	}{
+		{"none", "", `return {["a"]=1,}`},
+		{"single line", "jkr exported by mytool v1.2", "-- jkr exported by mytool v1.2\nreturn {[\"a\"]=1,}"},
+		{"multiple lines", "first\r\nsecond\n", "-- first\n-- second\nreturn {[\"a\"]=1,}"},
+		{"comment markers", "--[[ not a block", "-- --[[ not a block\nreturn {[\"a\"]=1,}"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			tbl := newTable()
+			tbl.RawSetString("a", lua.LNumber(1))
+			data, err := Marshal(tbl, WithHeaderComment(test.comment))
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			got := decompress(t, data)
+			if got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !Equal(&out, tbl) {
+				t.Errorf("tables not equal after round-trip")
+			}
+			if err := L.DoString(got); err != nil {
+				t.Errorf("Lua rejected output: %v", err)
+			}
+		})
+	}
+}
+
+func TestMarshalIndent(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	list := newTable()
+	list.Append(lua.LString("a"))
+	list.Append(lua.LString("b"))
+	nested := newTable()
+	nested.RawSetString("list", list)
+	nested.RawSetString("empty", newTable())
+	tbl := newTable()
+	tbl.RawSetString("nested", nested)
+	tbl.RawSetString("n", lua.LNumber(1))
+
+	data, err := Marshal(tbl, WithIndent("\t"))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	want := "return {\n" +
+		"\t[\"n\"] = 1,\n" +
+		"\t[\"nested\"] = {\n" +
+		"\t\t[\"empty\"] = {},\n" +
+		"\t\t[\"list\"] = {\n" +
+		"\t\t\t\"a\",\n" +
+		"\t\t\t\"b\",\n" +
+		"\t\t},\n" +
+		"\t},\n" +
+		"}"
+	got := decompress(t, data)
+	if got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+	if err := L.DoString(got); err != nil {
+		t.Errorf("Lua rejected output: %v", err)
+	}
+}
+
+func TestMarshalIndentLF(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	tbl.RawSetString("notes\r\n", lua.LString("line one\r\nline two"))
+
+	data, err := Marshal(tbl, WithIndent("\t"), WithHeaderComment("exported\r\nby test\r\n"))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	got := decompress(t, data)
+	if i := strings.IndexByte(got, '\r'); i >= 0 {
+		t.Errorf("got a carriage return at offset %d", i)
+	}
+	if !strings.HasPrefix(got, "-- exported\n-- by test\nreturn {\n") {
+		t.Errorf("unexpected start of output: %q", got[:min(len(got), 40)])
+	}
+}
+
+func TestMarshalPlaceholderFormat(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		fields   map[string]string
+		opts     []Option
+		expected string
+	}{
+		{"default", map[string]string{"set": "Joker"}, nil, `return {["obj"]="MANUAL_REPLACE",}`},
+		{"set", map[string]string{"set": "Joker"}, []Option{WithPlaceholderFormat("MANUAL_REPLACE:%s")}, `return {["obj"]="MANUAL_REPLACE:Joker",}`},
+		{"name first", map[string]string{"name": "Card", "key": "j_joker", "set": "Joker"}, []Option{WithPlaceholderFormat("MANUAL_REPLACE:%s")}, `return {["obj"]="MANUAL_REPLACE:Card",}`},
+		{"key before set", map[string]string{"key": "j_joker", "set": "Joker"}, []Option{WithPlaceholderFormat("<%s>")}, `return {["obj"]="<j_joker>",}`},
+		{"no class", nil, []Option{WithPlaceholderFormat("MANUAL_REPLACE:%s")}, `return {["obj"]="MANUAL_REPLACE",}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			obj := L.NewTable()
+			obj.RawSetString("is", L.NewFunction(func(L *lua.LState) int { return 0 }))
+			for k, v := range test.fields {
+				obj.RawSetString(k, lua.LString(v))
+			}
+			tbl := L.NewTable()
+			tbl.RawSetString("obj", obj)
+
+			data, err := Serialize(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if got := string(data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestMarshalSnapshot(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	for i := range 100 {
+		tbl.RawSetInt(i+1, lua.LNumber(i))
+	}
+
+	var mu sync.Mutex
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			mu.Lock()
+			tbl.RawSetString(fmt.Sprintf("k%d", i%50), lua.LNumber(i))
+			tbl.RawSetInt(i%100+1, lua.LNumber(i))
+			mu.Unlock()
+		}
+	}()
+
+	for range 50 {
+		data, err := Marshal(tbl, WithSnapshot(&mu))
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		var out lua.LTable
+		if err := Unmarshal(data, &out); err != nil {
+			t.Fatalf("Unmarshal() error: %v", err)
+		}
+	}
+	close(done)
+	<-stopped
+}
+
+// countingLocker is a sync.Locker that counts how often it is locked
+type countingLocker struct {
+	sync.Mutex
+	locks int
+}
+
+func (l *countingLocker) Lock() {
+	l.Mutex.Lock()
+	l.locks++
+}
+
+func TestMarshalWithStateSnapshot(t *testing.T) {
+	t.Parallel()
+
+	L := lua.NewState()
+	defer L.Close()
+	if err := L.DoString(`local obj = {is = function() end, rank = 5}
+		function obj:save() return {rank = self.rank} end
+		return {card = obj}`); err != nil {
+		t.Fatalf("DoString() error: %v", err)
+	}
+	tbl := L.Get(-1).(*lua.LTable)
+	L.Pop(1)
+
+	var mu countingLocker
+	data, err := MarshalWithState(L, tbl, WithSnapshot(&mu))
+	if err != nil {
+		t.Fatalf("MarshalWithState() error: %v", err)
+	}
+	if mu.locks != 1 {
+		t.Errorf("lock taken %d times; want 1", mu.locks)
+	}
+	if got, want := decompress(t, data), `return {["card"]={["rank"]=5,},}`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestMarshalIntegralFloatFormat(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetString("dollars", lua.LNumber(4))
+	tbl.RawSetString("ratio", lua.LNumber(1.5))
+	tbl.RawSet(lua.LNumber(10), lua.LNumber(-3))
+	list := newTable()
+	list.Append(lua.LNumber(7))
+	tbl.RawSetString("list", list)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default", nil, `return {[10]=-3,["dollars"]=4,["list"]={7,},["ratio"]=1.5,}`},
+		{"int", []Option{WithIntegralFloatFormat(IntegralInt)}, `return {[10]=-3,["dollars"]=4,["list"]={7,},["ratio"]=1.5,}`},
+		{"float", []Option{WithIntegralFloatFormat(IntegralFloat)}, `return {[10.0]=-3.0,["dollars"]=4.0,["list"]={7.0,},["ratio"]=1.5,}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !Equal(&out, tbl) {
+				t.Errorf("tables not equal after round-trip")
+			}
+		})
+	}
+}
+
+// TestMarshalDefaultIntegralFloatFormat changes a package-level default, so
+// it must not run in parallel with other tests
+func TestMarshalDefaultIntegralFloatFormat(t *testing.T) {
+	defer func(old IntegralFloatFormat) { DefaultIntegralFloatFormat = old }(DefaultIntegralFloatFormat)
+	DefaultIntegralFloatFormat = IntegralFloat
+
+	tbl := newTable()
+	tbl.RawSetString("dollars", lua.LNumber(4))
+
+	tests := []struct {
+		opts     []Option
+		expected string
+	}{
+		{nil, `return {["dollars"]=4.0,}`},
+		{[]Option{WithIntegralFloatFormat(IntegralInt)}, `return {["dollars"]=4,}`},
+	}
+	for _, test := range tests {
+		data, err := Serialize(tbl, test.opts...)
+		if err != nil {
+			t.Fatalf("Serialize() error: %v", err)
+		}
+		if string(data) != test.expected {
+			t.Errorf("got %q; want %q", data, test.expected)
+		}
+	}
+}
+
+func TestMarshalFields(t *testing.T) {
+	t.Parallel()
+
+	nested := newTable()
+	nested.RawSetString("c", lua.LTrue)
+	mixed := newTable()
+	mixed.RawSetString("a", lua.LNumber(1))
+	mixed.RawSetString("b", nested)
+	list := newTable()
+	list.Append(lua.LString("x"))
+	list.Append(lua.LString("y"))
+
+	tests := []struct {
+		name     string
+		tbl      *lua.LTable
+		expected string
+	}{
+		{"fields", mixed, `["a"]=1,["b"]={["c"]=true,},`},
+		{"list", list, `"x","y",`},
+		{"empty", newTable(), ``},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := MarshalFields(test.tbl)
+			if err != nil {
+				t.Fatalf("MarshalFields() error: %v", err)
+			}
+			if got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			wrapped, err := ReadPlain(strings.NewReader("return {" + got + "}"))
+			if err != nil {
+				t.Fatalf("wrapped fields do not parse: %v", err)
+			}
+			if !Equal(wrapped, test.tbl) {
+				t.Errorf("wrapped fields differ from the original table")
+			}
+		})
+	}
+}
+
+func TestMarshalBalatroCompat(t *testing.T) {
+	t.Parallel()
+
+	for _, name := range []string{"settings.jkr", "profile.jkr", "meta.jkr", "save.jkr"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			raw, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatalf("ReadFile() error: %v", err)
+			}
+			fixture := decompress(t, raw)
+			var tbl lua.LTable
+			if err := Unmarshal(raw, &tbl); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+
+			data, err := Serialize(&tbl, WithBalatroCompat())
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			// the fixtures are in STR_PACK's format but not its pairs key
+			// order, so compare field for field
+			if got, want := sortFields(string(data)), sortFields(fixture); got != want {
+				t.Errorf("output differs from the fixture:\ngot  %s\nwant %s", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalBalatroCompatValues(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetString("text", lua.LString("say \"hi\"\\\nnext\r\x01\x012é"))
+	tbl.RawSetString("x", lua.LNumber(8.076195022332094))
+	tbl.RawSetString("list", compileTable(t, `return {true,false,}`))
+
+	data, err := Serialize(tbl, WithBalatroCompat())
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+	want := `return {["list"]={[1]=true,[2]=false,},` +
+		"[\"text\"]=\"say \\\"hi\\\"\\\\\\\nnext\\13\\1\\0012é\",[\"x\"]=8.0761950223321,}"
+	if got := string(data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	got, err := ReadPlain(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadPlain() error: %v", err)
+	}
+	// like tostring in LuaJIT, the number keeps only 14 significant digits
+	tbl.RawSetString("x", lua.LNumber(8.0761950223321))
+	if !Equal(got, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+
+	tbl.RawSetString("x", lua.LNumber(8.076195022332094))
+	if _, err := Serialize(tbl, WithBalatroCompat(), WithSafeNumbers(true)); !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("Serialize() with safe numbers error = %v; want ErrPrecisionLoss", err)
+	}
+}
+
+// sortFields rewrites serialized table source with the fields of every table
+// sorted by their text, so that sources differing only in key order are equal
+func sortFields(src string) string {
+	i := strings.IndexByte(src, '{')
+	out, _ := sortTable(src, i)
+	return src[:i] + out
+}
+
+// sortTable sorts the fields of the table opening at src[i], returning it and
+// the offset just past it
+func sortTable(src string, i int) (string, int) {
+	i++ // '{'
+	var fields []string
+	var field strings.Builder
+	for {
+		switch c := src[i]; c {
+		case '{':
+			inner, next := sortTable(src, i)
+			field.WriteString(inner)
+			i = next
+			continue
+		case '"':
+			j := i + 1
+			for src[j] != '"' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			field.WriteString(src[i : j+1])
+			i = j + 1
+			continue
+		case ',':
+			fields = append(fields, field.String())
+			field.Reset()
+		case '}':
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+			}
+			slices.Sort(fields)
+			var b strings.Builder
+			b.WriteByte('{')
+			for _, f := range fields {
+				b.WriteString(f)
+				b.WriteByte(',')
+			}
+			b.WriteByte('}')
+			return b.String(), i + 1
+		default:
+			field.WriteByte(c)
+		}
+		i++
+	}
+}
+
+func TestOutputOrderIndependent(t *testing.T) {
+	t.Parallel()
+
+	save, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	invalid := compileTable(t, `return {["a"]=1,["b"]=2,["c"]=3,["d"]=4,}`)
+	for _, k := range []string{"a", "b", "c", "d"} {
+		invalid.RawSetString(k, lua.LChannel(nil))
+	}
+	bad := compressLua(t, `return {["a"]="x",["b"]="y",["c"]="z",["d"]=1,}`)
+	goMap := map[string]any{"b": 2, "a": 1, "c": []int{3}, "d": map[int]string{2: "x", 1: "y"}}
+	badMap := map[string]any{"a": func() {}, "b": func() {}, "c": func() {}}
+
+	tests := []struct {
+		name string
+		run  func() (string, error)
+	}{
+		{"Serialize", func() (string, error) {
+			data, err := Serialize(save)
+			return string(data), err
+		}},
+		{"Serialize indented", func() (string, error) {
+			data, err := Serialize(save, WithIndent("\t"))
+			return string(data), err
+		}},
+		{"MarshalFields", func() (string, error) {
+			return MarshalFields(save)
+		}},
+		{"ToJSON", func() (string, error) {
+			data, err := ToJSON(save)
+			return string(data), err
+		}},
+		{"MarshalValue", func() (string, error) {
+			data, err := MarshalValue(goMap)
+			return string(data), err
+		}},
+		{"MarshalValue error", func() (string, error) {
+			_, err := MarshalValue(badMap)
+			return fmt.Sprint(err), nil
+		}},
+		{"MarshalValidate", func() (string, error) {
+			return fmt.Sprint(MarshalValidate(invalid)), nil
+		}},
+		{"UnmarshalValue error", func() (string, error) {
+			var out map[string]int
+			return fmt.Sprint(UnmarshalValue(bad, &out)), nil
+		}},
+		{"Diff", func() (string, error) {
+			return fmt.Sprint(Diff(invalid, save)), nil
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			first, err := test.run()
+			if err != nil {
+				t.Fatalf("error: %v", err)
+			}
+			for range 50 {
+				got, err := test.run()
+				if err != nil {
+					t.Fatalf("error: %v", err)
+				}
+				if got != first {
+					t.Fatalf("output changed between runs:\n%s\n%s", first, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalCompressionLevel(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	src, err := Serialize(tbl)
+	if err != nil {
+		t.Fatalf("Serialize() error: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		level int
+	}{
+		{"stored", flate.NoCompression},
+		{"best speed", flate.BestSpeed},
+		{"best compression", flate.BestCompression},
+		{"huffman only", flate.HuffmanOnly},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := Marshal(tbl, WithCompressionLevel(test.level))
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if test.level == flate.NoCompression && len(data) <= len(src) {
+				t.Errorf("stored output of %d bytes is not larger than the %d byte source", len(data), len(src))
+			}
+			// the raw deflate reader Balatro decompresses with
+			if got := decompress(t, data); got != string(src) {
+				t.Errorf("decompressed output differs from the source")
+			}
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !Equal(&out, tbl) {
+				t.Errorf("tables not equal after round-trip")
+			}
+		})
+	}
+
+	if _, err := Marshal(tbl, WithCompressionLevel(42)); err == nil {
+		t.Errorf("expected error for invalid level, got nil")
+	}
+	if err := NewWriter(io.Discard, WithCompressionLevel(42)).Write(tbl); err == nil {
+		t.Errorf("expected Writer error for invalid level, got nil")
+	}
+}
+
+func TestMarshalNumericKeysPlain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		key      lua.LNumber
+		expected string
+	}{
+		{1000000, "[1000000]"},
+		{-1000000, "[-1000000]"},
+		{1e15, "[1000000000000000]"},
+		{1 << 53, "[9007199254740992]"},
+		{1e18, "[1000000000000000000]"},
+		{1e21, "[1000000000000000000000]"},
+		{-1e21, "[-1000000000000000000000]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expected, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetH(test.key, lua.LTrue)
+			data, err := Serialize(tbl)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if want := "return {" + test.expected + "=true,}"; string(data) != want {
+				t.Errorf("got %q; want %q", data, want)
+			}
+
+			got, err := ReadPlain(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("ReadPlain() error: %v", err)
+			}
+			if got.RawGet(test.key) != lua.LTrue {
+				t.Errorf("key %v not found after round-trip", test.key)
+			}
+		})
+	}
+}
+
+func TestMarshalObjectPolicy(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	obj := L.NewTable()
+	obj.RawSetString("is", L.NewFunction(func(*lua.LState) int { return 0 }))
+	tbl := newTable()
+	tbl.RawSetString("card", obj)
+	tbl.RawSetString("name", lua.LString("P1"))
+	tbl.RawSetString("list", compileTable(t, `return {"a","b","c",}`))
+	tbl.RawGetString("list").(*lua.LTable).RawSetInt(2, obj)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+		json     string
+	}{
+		{"default", nil,
+			`return {["card"]="MANUAL_REPLACE",["list"]={"a","MANUAL_REPLACE","c",},["name"]="P1",}`,
+			`{"card":"MANUAL_REPLACE","list":["a","MANUAL_REPLACE","c"],"name":"P1"}`},
+		{"placeholder", []Option{WithObjectPolicy(PlaceholderObjects)},
+			`return {["card"]="MANUAL_REPLACE",["list"]={"a","MANUAL_REPLACE","c",},["name"]="P1",}`,
+			`{"card":"MANUAL_REPLACE","list":["a","MANUAL_REPLACE","c"],"name":"P1"}`},
+		{"drop", []Option{WithObjectPolicy(DropObjects)},
+			`return {["list"]={"a",nil,"c",},["name"]="P1",}`,
+			`{"list":["a",null,"c"],"name":"P1"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := Serialize(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if string(data) != test.expected {
+				t.Errorf("got %q; want %q", data, test.expected)
+			}
+			js, err := ToJSON(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("ToJSON() error: %v", err)
+			}
+			if string(js) != test.json {
+				t.Errorf("got JSON %s; want %s", js, test.json)
+			}
+		})
+	}
+}
+
+func TestMarshalNegativeZero(t *testing.T) {
+	t.Parallel()
+
+	negZero := lua.LNumber(math.Copysign(0, -1))
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default", nil, `return {[0]=-0,["pos"]=0,["zero"]=-0,}`},
+		{"integral float", []Option{WithIntegralFloatFormat(IntegralFloat)}, `return {[0.0]=-0.0,["pos"]=0.0,["zero"]=-0.0,}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("zero", negZero)
+			tbl.RawSetString("pos", lua.LNumber(0))
+			tbl.RawSetH(negZero, negZero)
+
+			data, err := Serialize(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if string(data) != test.expected {
+				t.Errorf("got %q; want %q", data, test.expected)
+			}
+
+			got, err := ReadPlain(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("ReadPlain() error: %v", err)
+			}
+			if f := float64(got.RawGetString("zero").(lua.LNumber)); f != 0 || !math.Signbit(f) {
+				t.Errorf("got %v after round-trip; want -0", f)
+			}
+			if f := float64(got.RawGetString("pos").(lua.LNumber)); math.Signbit(f) {
+				t.Errorf("got %v after round-trip; want 0", f)
+			}
+			if f := float64(got.RawGet(lua.LNumber(0)).(lua.LNumber)); !math.Signbit(f) {
+				t.Errorf("got %v under key 0 after round-trip; want -0", f)
+			}
+		})
+	}
+}
+
+func TestMarshalIdentifierKeys(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	for _, key := range []string{"dollars", "_x1", "end", "a b", "1st", "", "ünï"} {
+		tbl.RawSetString(key, lua.LNumber(1))
+	}
+
+	data, err := Marshal(tbl, WithIdentifierKeys(true))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	want := `return {[""]=1,["1st"]=1,_x1=1,["a b"]=1,dollars=1,["end"]=1,["ünï"]=1,}`
+	if got := decompress(t, data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+}
+
+func TestMarshalCanonical(t *testing.T) {
+	t.Parallel()
+
+	tbl := compileTable(t, `return {["GAME"]={["dollars"]=4,["ratio"]=0.1,["won"]=false,["round_resets"]={["ante"]=2,},},["jokers"]={"j_joker","j_egg",},["tags"]={},["end"]="x",[2]=true,}`)
+
+	data, err := MarshalCanonical(tbl)
+	if err != nil {
+		t.Fatalf("MarshalCanonical() error: %v", err)
+	}
+	want := "return {\n" +
+		"\t[2] = true,\n" +
+		"\tGAME = {\n" +
+		"\t\tdollars = 4,\n" +
+		"\t\tratio = 0.1,\n" +
+		"\t\tround_resets = {\n" +
+		"\t\t\tante = 2,\n" +
+		"\t\t},\n" +
+		"\t\twon = false,\n" +
+		"\t},\n" +
+		"\t[\"end\"] = \"x\",\n" +
+		"\tjokers = {\n" +
+		"\t\t\"j_joker\",\n" +
+		"\t\t\"j_egg\",\n" +
+		"\t},\n" +
+		"\ttags = {},\n" +
+		"}"
+	if got := decompress(t, data); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !Equal(&out, tbl) {
+		t.Errorf("tables not equal after round-trip")
+	}
+
+	tbl.RawSetString("big", lua.LNumber(1<<60+1))
+	if _, err := MarshalCanonical(tbl); !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("got %v; want ErrPrecisionLoss", err)
+	}
+}
+
+func TestMarshalStrictObjects(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	is := L.NewFunction(func(*lua.LState) int { return 0 })
+	instance := L.NewTable()
+	instance.RawSetString("is", is)
+	L.SetMetatable(instance, L.NewTable())
+	card := L.NewTable()
+	card.RawSetString("is", is)
+	card.RawSetString("set", lua.LString("Joker"))
+	data := L.NewTable()
+	data.RawSetString("is", is)
+
+	tests := []struct {
+		name   string
+		tbl    *lua.LTable
+		strict bool
+	}{
+		{"metatable", instance, true},
+		{"set field", card, true},
+		{"plain is function", data, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("v", test.tbl)
+
+			got, err := Serialize(tbl)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if want := `return {["v"]="MANUAL_REPLACE",}`; string(got) != want {
+				t.Errorf("got %q by default; want %q", got, want)
+			}
+
+			got, err = Serialize(tbl, WithStrictObjects(true))
+			if !test.strict {
+				if err == nil {
+					t.Errorf("expected the is function to fail as data, got %q", got)
+				}
+				if len(ObjectPaths(tbl, WithStrictObjects(true))) != 0 {
+					t.Errorf("ObjectPaths() reports a table that is not an object")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Serialize() strict error: %v", err)
+			}
+			if want := `return {["v"]="MANUAL_REPLACE",}`; string(got) != want {
+				t.Errorf("got %q; want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMarshalStringEscapePolicy(t *testing.T) {
+	t.Parallel()
+
+	const s = "a\x00b\x01\t\r\n\"\\\x7f\x1b9é\u200b\xff"
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default", nil, `"a\x00b\x01\t\r\n\"\\\x7f\x1b9é` + "\u200b" + `\xff"`},
+		{"hex", []Option{WithStringEscapePolicy(HexEscape)}, `"a\x00b\x01\t\r\n\"\\\x7f\x1b9é` + "\u200b" + `\xff"`},
+		{"decimal", []Option{WithStringEscapePolicy(DecimalEscape)}, `"a\0b\1\9\13\` + "\n" + `\"\\\127\0279é` + "\u200b\xff" + `"`},
+		{"minimal", []Option{WithStringEscapePolicy(MinimalEscape)}, `"a` + "\x00b\x01\t" + `\r\n\"\\` + "\x7f\x1b9é\u200b\xff" + `"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("s", lua.LString(s))
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if got, want := decompress(t, data), `return {["s"]=`+test.expected+`,}`; got != want {
+				t.Errorf("got %q; want %q", got, want)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if got := out.RawGetString("s"); got != lua.LString(s) {
+				t.Errorf("got %q after round-trip; want %q", got, s)
+			}
+		})
+	}
+}
+
+func TestMarshalDeepCycle(t *testing.T) {
+	t.Parallel()
+
+	// cycles closing above, at and below scanDepth, so that both halves of
+	// tableStack are checked
+	for _, depth := range []int{2, scanDepth, scanDepth + 1, 3 * scanDepth} {
+		tbl := newTable()
+		inner := tbl
+		for range depth - 1 {
+			next := newTable()
+			inner.RawSetString("next", next)
+			inner = next
+		}
+
+		if _, err := Serialize(tbl); err != nil {
+			t.Fatalf("Serialize() of an acyclic table %d deep error: %v", depth, err)
+		}
+		for _, target := range []*lua.LTable{tbl, lookupPath(tbl, "next").(*lua.LTable)} {
+			inner.RawSetString("back", target)
+			if _, err := Serialize(tbl); err == nil {
+				t.Errorf("expected circular reference error %d deep, got nil", depth)
+			}
+			if _, err := ToJSON(tbl); err == nil {
+				t.Errorf("expected ToJSON() circular reference error %d deep, got nil", depth)
+			}
+			if errs := MarshalValidate(tbl); len(errs) != 1 {
+				t.Errorf("got %d MarshalValidate() errors %d deep; want 1", len(errs), depth)
+			}
+		}
+	}
+}
+
+func TestMarshalKeyOrder(t *testing.T) {
+	t.Parallel()
+
+	tbl := compileTable(t, `return {["GAME"]={["b"]=2,["VERSION"]=0,["a"]=1,},["STATE"]=5,["VERSION"]="1.0.1o-FULL",["BACK"]={},["ACTION"]=1,}`)
+
+	tests := []struct {
+		name     string
+		keys     []string
+		expected string
+	}{
+		{"none", nil,
+			`return {["ACTION"]=1,["BACK"]={},["GAME"]={["VERSION"]=0,["a"]=1,["b"]=2,},["STATE"]=5,["VERSION"]="1.0.1o-FULL",}`},
+		{"two pinned", []string{"VERSION", "STATE"},
+			`return {["VERSION"]="1.0.1o-FULL",["STATE"]=5,["ACTION"]=1,["BACK"]={},["GAME"]={["VERSION"]=0,["a"]=1,["b"]=2,},}`},
+		{"missing and repeated", []string{"missing", "STATE", "VERSION", "STATE"},
+			`return {["STATE"]=5,["VERSION"]="1.0.1o-FULL",["ACTION"]=1,["BACK"]={},["GAME"]={["VERSION"]=0,["a"]=1,["b"]=2,},}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := Serialize(tbl, WithKeyOrder(test.keys))
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if string(got) != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestMarshalUnsupportedValue(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	tests := []struct {
+		name  string
+		value lua.LValue
+	}{
+		{"channel", lua.LChannel(make(chan lua.LValue))},
+		{"function", L.NewFunction(func(*lua.LState) int { return 0 })},
+		{"userdata", L.NewUserData()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("v", test.value)
+			_, marshalErr := Marshal(tbl)
+			_, jsonErr := ToJSON(tbl)
+			_, binaryErr := ToBinary(tbl)
+			for _, err := range []error{marshalErr, jsonErr, binaryErr} {
+				if !errors.Is(err, ErrUnsupportedValueType) {
+					t.Errorf("got %v; want ErrUnsupportedValueType", err)
+				} else if !strings.Contains(err.Error(), test.name) {
+					t.Errorf("error %q does not name %s", err, test.name)
+				}
+			}
+		})
+	}
+}
+
+func TestMarshalArrayWrapThreshold(t *testing.T) {
+	t.Parallel()
+
+	tbl := compileTable(t, `return {["short"]={1,2,3,},["long"]={"a","b","c","d","e",},["nested"]={{},},}`)
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{"default wraps", []Option{WithIndent("  ")},
+			"return {\n  [\"long\"] = {\n    \"a\",\n    \"b\",\n    \"c\",\n    \"d\",\n    \"e\",\n  },\n" +
+				"  [\"nested\"] = {\n    {},\n  },\n  [\"short\"] = {\n    1,\n    2,\n    3,\n  },\n}"},
+		{"threshold", []Option{WithIndent("  "), WithArrayWrapThreshold(3)},
+			"return {\n  [\"long\"] = {\n    \"a\",\n    \"b\",\n    \"c\",\n    \"d\",\n    \"e\",\n  },\n" +
+				"  [\"nested\"] = {\n    {},\n  },\n  [\"short\"] = {1, 2, 3},\n}"},
+		{"compact ignores threshold", []Option{WithArrayWrapThreshold(3)},
+			`return {["long"]={"a","b","c","d","e",},["nested"]={{},},["short"]={1,2,3,},}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := Marshal(tbl, test.opts...)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !Equal(&out, tbl) {
+				t.Errorf("tables not equal after round-trip")
+			}
+		})
+	}
+}
+
+func TestMinify(t *testing.T) {
+	t.Parallel()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var want lua.LTable
+	if err := Unmarshal(raw, &want); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	pretty, err := Marshal(&want, WithIndent("\t"), WithCompressionLevel(flate.NoCompression))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	canonical, err := Minify(raw)
+	if err != nil {
+		t.Fatalf("Minify() error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"fixture", raw},
+		{"pretty", pretty},
+	}
+
+	for _, test := range tests {
+		out, err := Minify(test.in)
+		if err != nil {
+			t.Fatalf("Minify() of %s error: %v", test.name, err)
+		}
+		if len(out) > len(pretty) {
+			t.Errorf("minified %s is %d bytes; want at most %d", test.name, len(out), len(pretty))
+		}
+		if !bytes.Equal(out, canonical) {
+			t.Errorf("minified %s differs from the minified fixture", test.name)
+		}
+		var got lua.LTable
+		if err := Unmarshal(out, &got); err != nil {
+			t.Fatalf("Unmarshal() of minified %s error: %v", test.name, err)
+		}
+		if !Equal(&got, &want) {
+			t.Errorf("minified %s decodes to a different table", test.name)
+		}
+	}
+
+	// leniencies the decoder accepts are never passed through
+	lenient := compressLua(t, "\xef\xbb\xbf-- comment\r\nreturn ({[\"a\"]=0x10;[\"b\"]={1,2};})")
+	out, err := Minify(lenient)
+	if err != nil {
+		t.Fatalf("Minify() of lenient input error: %v", err)
+	}
+	if got, want := decompress(t, out), `return {a=16,b={1,2,},}`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	// options reach the encode too
+	tbl := newTable()
+	tbl.RawSetString("x", lua.LNumber(1<<60))
+	data, err := Marshal(tbl)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	if _, err := Minify(data, WithSafeNumbers(true)); !errors.Is(err, ErrPrecisionLoss) {
+		t.Errorf("Minify() with safe numbers error = %v; want ErrPrecisionLoss", err)
+	}
+
+	if _, err := Minify([]byte("not flate")); err == nil {
+		t.Errorf("expected error, got nil")
+	}
+}
@@ -0,0 +1,524 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"compress/flate"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Option configures a single marshal or unmarshal call.
+type Option func(*options)
+
+type options struct {
+	boolStyle      BoolStyle
+	cycleCheck     bool
+	sharedCache    bool
+	deterministic  bool
+	arrayThreshold int
+	identifierKeys bool
+	keyOrder       []string
+	nilKeys        NilKeys
+	explicitNil    bool
+	sanitizeUTF8   bool
+	safeNumbers    bool
+	maxDepth       int
+	maxTables      int
+	hexKeys        map[string]bool
+	numberFormats  map[string]string
+	headerComment  string
+	maxCompressed  int64
+	indent         string
+	arrayWrap      int
+
+	placeholderFormat string
+	snapshotLock      sync.Locker
+	jsonTaggedObjects bool
+	jsonEmptyTable    JSONEmptyTable
+	escapePolicy      StringEscapePolicy
+	compressionLevel  int
+	bufferedWrites    bool
+	objectPolicy      ObjectPolicy
+	strictObjects     bool
+	integralFloat     IntegralFloatFormat
+	gameNumbers       bool
+	disallowUnknown   bool
+	timeout           time.Duration
+
+	prunePolicy PrunePolicy
+	timeFormat  TimeFormat
+	encodeHooks map[reflect.Type]func(any) (lua.LValue, error)
+	decodeHooks map[reflect.Type]func(lua.LValue) (any, error)
+}
+
+// newOptions applies opts on top of the defaults
+func newOptions(opts []Option) options {
+	o := options{
+		boolStyle:     LuaBool,
+		cycleCheck:    true,
+		deterministic: true,
+		integralFloat: DefaultIntegralFloatFormat,
+		maxDepth:      DefaultMaxDepth,
+
+		compressionLevel: flate.BestSpeed,
+
+		prunePolicy: PruneAll,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// BoolStyle selects how boolean values are written.
+type BoolStyle int
+
+const (
+	// LuaBool writes booleans as true and false. This is what Balatro writes.
+	LuaBool BoolStyle = iota
+	// NumericBool writes booleans as 1 and 0. The values are read back as
+	// numbers, not booleans, so output written with this style does not
+	// round-trip.
+	NumericBool
+)
+
+// WithBoolStyle sets how boolean values are written. The default is LuaBool.
+func WithBoolStyle(style BoolStyle) Option {
+	return func(o *options) {
+		o.boolStyle = style
+	}
+}
+
+// IntegralFloatFormat selects how numbers with no fractional part are written,
+// both as keys and as values. Negative zero keeps its sign as a value, written
+// as -0 or -0.0, and reads back as negative zero. As a key it is the same key
+// as zero and is written as 0.
+type IntegralFloatFormat int
+
+const (
+	// IntegralInt writes whole numbers without a fractional part, such as 4.
+	// This is what Balatro writes.
+	IntegralInt IntegralFloatFormat = iota
+	// IntegralFloat writes whole numbers with a trailing .0, such as 4.0, to
+	// make it visible that Lua numbers are floats.
+	IntegralFloat
+)
+
+// DefaultIntegralFloatFormat is the IntegralFloatFormat used when a call does
+// not pass WithIntegralFloatFormat. It is IntegralInt, matching Balatro. Set
+// it once during initialization, before any marshaling, to standardize a
+// program on another format.
+var DefaultIntegralFloatFormat = IntegralInt
+
+// WithIntegralFloatFormat sets how whole numbers are written for a single
+// call, overriding DefaultIntegralFloatFormat.
+func WithIntegralFloatFormat(format IntegralFloatFormat) Option {
+	return func(o *options) {
+		o.integralFloat = format
+	}
+}
+
+// WithCycleCheck enables or disables circular reference detection while
+// marshaling. It is enabled by default. Disabling it saves a scan over the
+// enclosing tables for every table on trusted, known-acyclic data, but a
+// cyclic table will then recurse until it reaches the depth limit set with
+// WithMaxDepth.
+func WithCycleCheck(enabled bool) Option {
+	return func(o *options) {
+		o.cycleCheck = enabled
+	}
+}
+
+// WithSharedTableCache makes marshaling serialize each table only once per
+// call and reuse its output wherever the same table appears again, which
+// speeds up tables that share large sub-trees, such as one card definition
+// referenced from many places. It is disabled by default, since it keeps the
+// output of every nested table in memory for the whole call. The cache is
+// not used with WithHexKeys or WithNumberFormat, whose output depends on the
+// path of a value.
+func WithSharedTableCache(enabled bool) Option {
+	return func(o *options) {
+		o.sharedCache = enabled
+	}
+}
+
+// WithDeterministic controls whether table keys are written in sorted order,
+// numbers first and then strings, so that equal tables always marshal to the
+// same bytes. It is enabled by default. Disabling it writes keys in a single
+// pass in gopher-lua's iteration order, which saves buffering and sorting the
+// keys of every table at the cost of reproducible output. This is the only
+// place where output depends on iteration order: with it enabled, every
+// serializer, including ToJSON and MarshalValue, and every error message is
+// reproducible.
+func WithDeterministic(enabled bool) Option {
+	return func(o *options) {
+		o.deterministic = enabled
+	}
+}
+
+// WithKeyOrder writes the listed keys of the top-level table first, in the
+// given order, such as []string{"VERSION", "GAME"}, followed by the remaining
+// keys in the order WithDeterministic selects. Listed keys the table does not
+// have are skipped, and nested tables are not affected. In a mixed table the
+// positional values still come first.
+func WithKeyOrder(keys []string) Option {
+	return func(o *options) {
+		o.keyOrder = keys
+	}
+}
+
+// WithArrayThreshold sets how many missing indices a table whose keys are all
+// positive integers may have and still be written as a positional list, such
+// as {"a","b",nil,"d",}, with nil filling the holes. The default of 0 only
+// writes dense 1..n tables positionally. A negative threshold always writes
+// explicit keys, such as {[1]="a",[2]="b",}, like Balatro itself does.
+func WithArrayThreshold(n int) Option {
+	return func(o *options) {
+		o.arrayThreshold = n
+	}
+}
+
+// WithIdentifierKeys writes string keys that are valid Lua names as bare
+// identifiers, such as dollars=4, instead of ["dollars"]=4. Keys that are
+// reserved words, such as "end", or that are not names, such as "a b", stay
+// bracketed. Lua and Unmarshal read both forms as the same key. It is
+// disabled by default, since Balatro brackets every key.
+func WithIdentifierKeys(enabled bool) Option {
+	return func(o *options) {
+		o.identifierKeys = enabled
+	}
+}
+
+// NilKeys records, per table, the keys that were explicitly written as nil
+// in the source. Lua drops such keys, so this is the only way to tell them
+// apart from keys that were never present.
+type NilKeys map[*lua.LTable][]lua.LValue
+
+// Has reports whether key was explicitly written as nil in tbl.
+func (n NilKeys) Has(tbl *lua.LTable, key lua.LValue) bool {
+	for _, k := range n[tbl] {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// WithNilKeys records keys explicitly written as nil into keys while
+// unmarshaling.
+func WithNilKeys(keys NilKeys) Option {
+	return func(o *options) {
+		o.nilKeys = keys
+	}
+}
+
+// WithExplicitNil makes MarshalValue write struct fields and map entries
+// whose Go value encodes as nil, such as a nil pointer, map, slice or
+// interface, as ["k"]=nil instead of dropping them, for modded loaders that
+// tell such keys apart from missing ones. Lua itself still drops them. Marshal
+// likewise writes the keys recorded with WithNilKeys, so that they survive a
+// round trip. The nil keys follow the other keys of their table. It is
+// disabled by default.
+func WithExplicitNil(enabled bool) Option {
+	return func(o *options) {
+		o.explicitNil = enabled
+	}
+}
+
+// WithSanitizeUTF8 replaces every invalid UTF-8 sequence in keys and string
+// values with U+FFFD, both in the tables Unmarshal and Reader decode and in
+// the output of ToJSON, instead of ToJSON failing with ErrInvalidUTF8. Lua
+// strings are bytes, so decoding keeps them unchanged by default.
+func WithSanitizeUTF8(enabled bool) Option {
+	return func(o *options) {
+		o.sanitizeUTF8 = enabled
+	}
+}
+
+// WithSafeNumbers makes marshaling fail with ErrPrecisionLoss instead of
+// silently writing a number that does not read back as the same value. This
+// covers NaN, infinities and integers beyond 2^53, above which float64 can no
+// longer tell neighbouring integers apart, as well as Go integers that do not
+// convert to float64 exactly in MarshalValue. It is disabled by default.
+func WithSafeNumbers(enabled bool) Option {
+	return func(o *options) {
+		o.safeNumbers = enabled
+	}
+}
+
+// DefaultMaxDepth is the nesting limit used unless WithMaxDepth sets another.
+// Balatro's own files nest less than a dozen tables deep.
+const DefaultMaxDepth = 512
+
+// WithMaxDepth limits how deeply tables may be nested, counting the top-level
+// table as depth 1. Marshal, Unmarshal, ToJSON, FromJSON and the functions
+// that skip over tables without building them fail with ErrMaxDepthExceeded
+// instead of recursing past the limit, which guards against exhausting the
+// stack on hostile input. The default is DefaultMaxDepth, and 0 means no
+// limit, which is only safe for trusted input.
+func WithMaxDepth(n int) Option {
+	return func(o *options) {
+		o.maxDepth = n
+	}
+}
+
+// WithMaxTables limits how many tables a single Unmarshal, FromJSON or
+// FromBinary call may construct, counting the top-level table. Decoding fails
+// with ErrTooManyTables once the limit is passed, which bounds the work and
+// memory a hostile file of many tiny tables can cost. The default of 0 means
+// no limit.
+func WithMaxTables(n int) Option {
+	return func(o *options) {
+		o.maxTables = n
+	}
+}
+
+// WithHexKeys writes the integer values at the given dotted paths, such as
+// "GAME.flags", in hexadecimal like 0x1f, which keeps bitmask fields readable
+// in diffs. The parser reads hex numbers natively, so they round-trip
+// unchanged. Values at those paths that are not integers are written in
+// decimal as usual.
+func WithHexKeys(paths []string) Option {
+	return func(o *options) {
+		o.hexKeys = make(map[string]bool, len(paths))
+		for _, path := range paths {
+			o.hexKeys[path] = true
+		}
+	}
+}
+
+// WithNumberFormat writes the number at the dotted path, such as
+// "GAME.interest_cap", with format, a fmt verb for a float64 like "%.2f" for
+// two decimal places. The parser reads the output back as a plain number.
+// Numbers at other paths keep the default format, and WithNumberFormat can be
+// given once per path. It takes precedence over WithHexKeys for the same path.
+func WithNumberFormat(path string, format string) Option {
+	return func(o *options) {
+		if o.numberFormats == nil {
+			o.numberFormats = make(map[string]string)
+		}
+		o.numberFormats[path] = format
+	}
+}
+
+// WithHeaderComment writes comment as Lua line comments before the leading
+// return, such as "-- exported by mytool v1.2". Each line of comment gets its
+// own "-- " prefix and ends in "\n", even if comment uses "\r\n". Lua,
+// Balatro and Unmarshal all skip leading comments, so the output stays
+// loadable. The default is no header.
+func WithHeaderComment(comment string) Option {
+	return func(o *options) {
+		o.headerComment = comment
+	}
+}
+
+// WithMaxCompressedSize makes reads fail with ErrCompressedSizeExceeded as
+// soon as more than n bytes of compressed input have been consumed, before
+// the rest is read or decompressed. This bounds the work done on untrusted
+// uploads by their size on the wire. The default of 0 means no limit.
+func WithMaxCompressedSize(n int64) Option {
+	return func(o *options) {
+		o.maxCompressed = n
+	}
+}
+
+// WithIndent pretty-prints the output, writing every field on its own line
+// indented by one copy of indent per level of nesting, such as "\t". The
+// default of "" writes everything on one line, like Balatro does. Lines end
+// in "\n" on every platform, so the output is byte-for-byte stable.
+func WithIndent(indent string) Option {
+	return func(o *options) {
+		o.indent = indent
+	}
+}
+
+// WithArrayWrapThreshold keeps lists of up to n values on a single line when
+// pretty-printing with WithIndent, such as {1, 2, 3}, while longer lists get
+// one value per line. Lists holding a table always wrap. The default of 0
+// wraps every list. Output without WithIndent is not affected.
+func WithArrayWrapThreshold(n int) Option {
+	return func(o *options) {
+		o.arrayWrap = n
+	}
+}
+
+// WithBufferedWrites makes a Writer buffer what it writes to the underlying
+// writer, so that each table reaches it in a single write rather than as the
+// many small writes made by the compressor. This saves a system call per
+// write when the underlying writer is an unbuffered *os.File. It is disabled
+// by default.
+func WithBufferedWrites(enabled bool) Option {
+	return func(o *options) {
+		o.bufferedWrites = enabled
+	}
+}
+
+// WithBalatroCompat writes text in the format of the STR_PACK function in
+// Balatro's Lua source: every key bracketed, including sequence indices,
+// strings quoted like Lua's string.format("%q"), which leaves non-ASCII bytes
+// unescaped, and numbers with the 14 significant digits of LuaJIT's tostring,
+// so that 0.1+0.2 is written as 0.3 and does not read back exactly. It also
+// resets WithIndent, WithIdentifierKeys, WithBoolStyle and
+// WithIntegralFloatFormat to their defaults, and options given after it
+// override it.
+//
+// The format follows STR_PACK's code; the output has not been compared with
+// files written by the game. Balatro also writes keys in the order of Lua's
+// pairs, which cannot be reproduced, so keys come out in another order.
+func WithBalatroCompat() Option {
+	return func(o *options) {
+		o.escapePolicy = DecimalEscape
+		o.arrayThreshold = -1
+		o.identifierKeys = false
+		o.indent = ""
+		o.boolStyle = LuaBool
+		o.integralFloat = IntegralInt
+		o.gameNumbers = true
+	}
+}
+
+// StringEscapePolicy selects how control bytes and other special characters
+// in strings are escaped. Quotes, backslashes and newlines are escaped under
+// every policy.
+type StringEscapePolicy int
+
+const (
+	// HexEscape writes control bytes with their short escape, such as \t,
+	// or else as \xHH, as are bytes that are not valid UTF-8. Other text,
+	// including all valid UTF-8, is written as it is. LuaJIT, which Balatro
+	// runs on, and Lua 5.2 and later read it, but Lua 5.1 does not.
+	HexEscape StringEscapePolicy = iota
+	// DecimalEscape writes control bytes as Lua's decimal \ddd escapes and
+	// newlines as a backslash before a line break, like string.format("%q")
+	// does, and every other byte as it is. Every Lua version reads it.
+	DecimalEscape
+	// MinimalEscape only escapes quotes, backslashes and line breaks,
+	// including carriage returns, which would end the string too. Every
+	// other byte, including NUL, is written as it is.
+	MinimalEscape
+)
+
+// WithStringEscapePolicy sets how strings are escaped. The default is
+// HexEscape.
+func WithStringEscapePolicy(policy StringEscapePolicy) Option {
+	return func(o *options) {
+		o.escapePolicy = policy
+	}
+}
+
+// WithCompressionLevel sets the flate level output is compressed at, from
+// flate.HuffmanOnly and flate.NoCompression to flate.BestCompression. The
+// default is flate.BestSpeed, which is what Balatro writes. An invalid level
+// makes marshaling fail.
+//
+// The whole table is a single flate stream, so the level applies to all of
+// it. flate.NoCompression writes stored blocks, which costs almost no CPU and
+// suits tables dominated by already-compressed data, such as embedded blobs,
+// that deflate would not shrink anyway; for ordinary saves it makes the file
+// several times larger. Any level decompresses with the same raw deflate
+// reader, so Balatro loads all of them.
+func WithCompressionLevel(level int) Option {
+	return func(o *options) {
+		o.compressionLevel = level
+	}
+}
+
+// ObjectPolicy selects what is written for object tables, the tables with an
+// is method that Balatro cannot save as plain data.
+type ObjectPolicy int
+
+const (
+	// PlaceholderObjects writes objects as the string "MANUAL_REPLACE", or as
+	// set by WithPlaceholderFormat. This is what Balatro writes.
+	PlaceholderObjects ObjectPolicy = iota
+	// DropObjects leaves the keys holding objects out entirely, for a clean
+	// export. Objects in a positional list are written as nil, so the values
+	// after them keep their indices.
+	DropObjects
+)
+
+// WithObjectPolicy sets what is written for object tables. The default is
+// PlaceholderObjects. With MarshalWithState, the policy applies only to
+// objects without a save method. ToJSON follows the policy too, leaving
+// dropped objects out of JSON objects and writing them as null in arrays.
+func WithObjectPolicy(policy ObjectPolicy) Option {
+	return func(o *options) {
+		o.objectPolicy = policy
+	}
+}
+
+// WithStrictObjects makes only tables that have an is function and also
+// either a metatable or a set field count as objects. By default any table
+// with an is function is an object, so plain data that holds a function named
+// is, as some modded tables do, is silently written as a placeholder. With
+// this option such a table is marshaled as data instead, and its is function
+// fails like any other function value, surfacing the problem rather than
+// losing the data. Balatro's objects are class instances with a metatable, so
+// they are still recognized. It is disabled by default.
+func WithStrictObjects(enabled bool) Option {
+	return func(o *options) {
+		o.strictObjects = enabled
+	}
+}
+
+// WithPlaceholderFormat tags the placeholder written for an object table with
+// the object's class, taken from its name, key or set field, in that order.
+// format receives the class through a single %s, so "MANUAL_REPLACE:%s"
+// writes "MANUAL_REPLACE:Joker". Objects without such a field, and all
+// objects by default, are written as the plain "MANUAL_REPLACE".
+func WithPlaceholderFormat(format string) Option {
+	return func(o *options) {
+		o.placeholderFormat = format
+	}
+}
+
+// WithSnapshot makes marshaling copy the table with Clone while holding l, and
+// then serialize the copy with l released. Tables are not safe for concurrent
+// use, so a table that other goroutines mutate must only be marshaled this
+// way, with those goroutines holding l for every mutation. They are then
+// blocked only for the copy rather than for the whole serialization, and the
+// output is a consistent view of the table at the time of the copy. It takes
+// the lock the writers use rather than a bool, since a copy taken without
+// that lock could itself race with them.
+func WithSnapshot(l sync.Locker) Option {
+	return func(o *options) {
+		o.snapshotLock = l
+	}
+}
+
+// WithTimeout bounds how long a read may take, failing with ErrTimeout once d
+// has passed. Decoding never evaluates the file, so input cannot loop
+// forever, but this still bounds the time spent on very large untrusted
+// input. The default of 0 means no limit.
+func WithTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.timeout = d
+	}
+}
+
+// checkDepth reports ErrMaxDepthExceeded if depth is beyond the configured
+// limit
+func (o *options) checkDepth(depth int) error {
+	if o.maxDepth > 0 && depth > o.maxDepth {
+		return fmt.Errorf("%w: limit is %d", ErrMaxDepthExceeded, o.maxDepth)
+	}
+	return nil
+}
+
+// checkTables reports ErrTooManyTables if constructing the nth table passes
+// the configured limit
+func (o *options) checkTables(n int) error {
+	if o.maxTables > 0 && n > o.maxTables {
+		return fmt.Errorf("%w: limit is %d", ErrTooManyTables, o.maxTables)
+	}
+	return nil
+}
@@ -0,0 +1,657 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// SyntaxError describes malformed Lua source and the byte offset at which it
+// was detected.
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("jkr: syntax error at offset %d: %s", e.Offset, e.Msg)
+}
+
+// Is makes every SyntaxError match ErrParse.
+func (e *SyntaxError) Is(target error) bool {
+	return target == ErrParse
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// parser decodes the subset of Lua that jkr files are made of: an optional
+// return followed by a table constructor holding nil, boolean, number, string
+// and table values. Nothing is ever evaluated.
+type parser struct {
+	src     []byte
+	pos     int
+	nilKeys NilKeys
+	opts    options
+	depth   int
+	tables  int
+	ctx     context.Context
+	steps   int
+}
+
+// decode parses src into out, leaving out untouched on error
+func decode(src []byte, out *lua.LTable, o options) error {
+	return decodeContext(context.Background(), src, out, o)
+}
+
+// decodeContext is like decode but gives up with ctx's error once ctx is done
+func decodeContext(ctx context.Context, src []byte, out *lua.LTable, o options) error {
+	p := &parser{src: src, nilKeys: o.nilKeys, opts: o, ctx: ctx}
+	return p.parseChunk(out)
+}
+
+func (p *parser) parseChunk(out *lua.LTable) error {
+	if err := p.parseNextChunk(out); err != nil {
+		return err
+	}
+	return p.checkEnd()
+}
+
+// parseNextChunk parses the chunk at the cursor into out, stopping at the end
+// of it so that another chunk may follow
+func (p *parser) parseNextChunk(out *lua.LTable) error {
+	parens, err := p.openTopLevel()
+	if err != nil {
+		return err
+	}
+	tbl, err := p.parseTable()
+	if err != nil {
+		return err
+	}
+	if err := p.closeChunk(parens); err != nil {
+		return err
+	}
+
+	*out = *tbl
+	if keys, ok := p.nilKeys[tbl]; ok {
+		delete(p.nilKeys, tbl)
+		p.nilKeys[out] = keys
+	}
+	return nil
+}
+
+func (p *parser) parseValue() (lua.LValue, error) {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return nil, p.errorf("unexpected end of input")
+	}
+
+	switch c := p.src[p.pos]; {
+	case c == '{':
+		return p.parseTable()
+	case c == '"' || c == '\'':
+		s, err := p.parseString()
+		return lua.LString(s), err
+	case c == '[' && p.longBracketLevel() >= 0:
+		s, err := p.parseLongString()
+		return lua.LString(s), err
+	case c == '(':
+		// parentheses nest like tables, so they count towards the depth
+		p.depth++
+		defer func() { p.depth-- }()
+		if err := p.opts.checkDepth(p.depth); err != nil {
+			return nil, fmt.Errorf("%w at offset %d", err, p.pos)
+		}
+		p.pos++
+		v, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(')'); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case c == '-':
+		p.pos++
+		p.skipSpace()
+		n, err := p.parseNumber()
+		return -n, err
+	case isDigit(c) || c == '.':
+		return p.parseNumber()
+	case isNameStart(c):
+		start := p.pos
+		switch name := p.readName(); name {
+		case "nil":
+			return lua.LNil, nil
+		case "true":
+			return lua.LTrue, nil
+		case "false":
+			return lua.LFalse, nil
+		default:
+			p.pos = start
+			return nil, p.errorf("unexpected name %q", name)
+		}
+	default:
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *parser) parseTable() (*lua.LTable, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if err := p.opts.checkDepth(p.depth); err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, p.pos)
+	}
+	p.tables++
+	if err := p.opts.checkTables(p.tables); err != nil {
+		return nil, fmt.Errorf("%w at offset %d", err, p.pos)
+	}
+
+	tbl := newTable()
+	err := p.parseFields(func(key lua.LValue) error {
+		value, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		p.set(tbl, key, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tbl, nil
+}
+
+// parseFields parses the table constructor at the cursor, calling field with
+// the cursor on each value so that it can consume it
+func (p *parser) parseFields(field func(key lua.LValue) error) error {
+	p.pos++ // '{'
+	n := 0
+	for {
+		if err := p.checkContext(); err != nil {
+			return err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.src) {
+			return p.errorf("unexpected end of input in table")
+		}
+		if p.src[p.pos] == '}' {
+			p.pos++
+			return nil
+		}
+
+		var key lua.LValue
+		switch c := p.src[p.pos]; {
+		case c == '[' && p.longBracketLevel() < 0:
+			// [key]=value
+			p.pos++
+			start := p.pos
+			var err error
+			if key, err = p.parseValue(); err != nil {
+				return err
+			}
+			if err := p.checkKey(key, start); err != nil {
+				return err
+			}
+			if err := p.expect(']'); err != nil {
+				return err
+			}
+			if err := p.expect('='); err != nil {
+				return err
+			}
+		case isNameStart(c) && p.isNameField():
+			// name=value
+			key = lua.LString(p.readName())
+			if err := p.expect('='); err != nil {
+				return err
+			}
+		default:
+			// positional value
+			n++
+			key = lua.LNumber(n)
+		}
+		if err := field(key); err != nil {
+			return err
+		}
+
+		p.skipSpace()
+		if p.pos < len(p.src) && (p.src[p.pos] == ',' || p.src[p.pos] == ';') {
+			p.pos++
+		} else if p.pos < len(p.src) && p.src[p.pos] != '}' {
+			return p.errorf("expected ',' or '}' but found %q", p.src[p.pos])
+		}
+	}
+}
+
+// checkContext reports the context's error, checking only every so many
+// fields to keep the cost negligible
+func (p *parser) checkContext() error {
+	p.steps++
+	if p.ctx == nil || p.steps%1024 != 0 {
+		return nil
+	}
+	return p.ctx.Err()
+}
+
+// skipValue advances past the value at the cursor without building it and
+// returns its type
+func (p *parser) skipValue() (lua.LValueType, error) {
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '{' {
+		p.depth++
+		defer func() { p.depth-- }()
+		if err := p.opts.checkDepth(p.depth); err != nil {
+			return lua.LTNil, fmt.Errorf("%w at offset %d", err, p.pos)
+		}
+		err := p.parseFields(func(lua.LValue) error {
+			_, err := p.skipValue()
+			return err
+		})
+		return lua.LTTable, err
+	}
+	v, err := p.parseValue()
+	if err != nil {
+		return lua.LTNil, err
+	}
+	return v.Type(), nil
+}
+
+// openTopLevel advances past everything before the top-level table, leaving
+// the cursor on its '{' and returning the number of parentheses around it
+func (p *parser) openTopLevel() (int, error) {
+	if bytes.HasPrefix(p.src, utf8BOM) {
+		p.pos += len(utf8BOM)
+	}
+	p.skipSpace()
+	if p.peekName() == "return" {
+		p.pos += len("return")
+	}
+
+	parens := 0
+	for p.skipSpace(); p.pos < len(p.src) && p.src[p.pos] == '('; p.skipSpace() {
+		p.pos++
+		parens++
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		start := p.pos
+		v, err := p.parseValue()
+		if err != nil {
+			return 0, err
+		}
+		p.pos = start
+		return 0, fmt.Errorf("%w: got %s", ErrNotATable, v.Type())
+	}
+	return parens, nil
+}
+
+// closeTopLevel consumes what follows the top-level table up to the end of
+// the input
+func (p *parser) closeTopLevel(parens int) error {
+	if err := p.closeChunk(parens); err != nil {
+		return err
+	}
+	return p.checkEnd()
+}
+
+// checkEnd reports anything left after the top-level value
+func (p *parser) checkEnd() error {
+	if p.pos < len(p.src) {
+		return p.errorf("unexpected %q after top-level value", p.src[p.pos])
+	}
+	return nil
+}
+
+// closeChunk consumes the parentheses, optional semicolon and whitespace
+// that end the chunk at the cursor
+func (p *parser) closeChunk(parens int) error {
+	for range parens {
+		if err := p.expect(')'); err != nil {
+			return err
+		}
+	}
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == ';' {
+		p.pos++
+		p.skipSpace()
+	}
+	return nil
+}
+
+// set stores value under key, recording explicit nils when asked to
+func (p *parser) set(tbl *lua.LTable, key, value lua.LValue) {
+	tbl.RawSet(key, value)
+	if value == lua.LNil && p.nilKeys != nil {
+		p.nilKeys[tbl] = append(p.nilKeys[tbl], key)
+	}
+}
+
+// checkKey rejects the keys Lua itself refuses to index by
+func (p *parser) checkKey(key lua.LValue, start int) error {
+	if key == lua.LNil {
+		return &SyntaxError{Offset: int64(start), Msg: "table index is nil"}
+	}
+	if n, ok := key.(lua.LNumber); ok && math.IsNaN(float64(n)) {
+		return &SyntaxError{Offset: int64(start), Msg: "table index is NaN"}
+	}
+	return nil
+}
+
+// isNameField reports whether the name at the cursor is followed by '='
+func (p *parser) isNameField() bool {
+	start := p.pos
+	defer func() { p.pos = start }()
+	switch p.readName() {
+	case "nil", "true", "false":
+		return false
+	}
+	p.skipSpace()
+	return p.pos < len(p.src) && p.src[p.pos] == '=' &&
+		(p.pos+1 >= len(p.src) || p.src[p.pos+1] != '=')
+}
+
+func (p *parser) parseNumber() (lua.LNumber, error) {
+	start := p.pos
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case isDigit(c) || isNameStart(c) || c == '.':
+			p.pos++
+		case (c == '+' || c == '-') && p.pos > start && (p.src[p.pos-1] == 'e' || p.src[p.pos-1] == 'E') &&
+			!isHexPrefix(p.src[start:p.pos]):
+			p.pos++
+		default:
+			goto done
+		}
+	}
+done:
+	text := string(p.src[start:p.pos])
+	if text == "" {
+		return 0, p.errorf("expected number")
+	}
+	if isHexPrefix(p.src[start:p.pos]) {
+		u, err := strconv.ParseUint(text[2:], 16, 64)
+		if err != nil {
+			return 0, &SyntaxError{Offset: int64(start), Msg: fmt.Sprintf("malformed number %q", text)}
+		}
+		return lua.LNumber(u), nil
+	}
+	if !isDecimal(p.src[start:p.pos]) {
+		// strconv also accepts Go-only forms such as inf, nan and 1_000
+		return 0, &SyntaxError{Offset: int64(start), Msg: fmt.Sprintf("malformed number %q", text)}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil && !isRangeError(err) {
+		return 0, &SyntaxError{Offset: int64(start), Msg: fmt.Sprintf("malformed number %q", text)}
+	}
+	return lua.LNumber(f), nil
+}
+
+func (p *parser) parseString() (string, error) {
+	quote := p.src[p.pos]
+	p.pos++
+	start := p.pos
+
+	// fast path for strings without escapes
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; c {
+		case quote:
+			p.pos++
+			return p.sanitize(string(p.src[start : p.pos-1])), nil
+		case '\n', '\r':
+			return "", p.errorf("unfinished string")
+		}
+		if p.src[p.pos] == '\\' {
+			break
+		}
+		p.pos++
+	}
+
+	var b strings.Builder
+	b.Write(p.src[start:p.pos])
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch c {
+		case quote:
+			p.pos++
+			return p.sanitize(b.String()), nil
+		case '\n', '\r':
+			return "", p.errorf("unfinished string")
+		case '\\':
+			if err := p.parseEscape(&b); err != nil {
+				return "", err
+			}
+		default:
+			b.WriteByte(c)
+			p.pos++
+		}
+	}
+	return "", p.errorf("unfinished string")
+}
+
+// sanitize replaces invalid UTF-8 in s if WithSanitizeUTF8 is enabled
+func (p *parser) sanitize(s string) string {
+	if !p.opts.sanitizeUTF8 || utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, string(utf8.RuneError))
+}
+
+// parseEscape decodes the escape sequence at the cursor into b
+func (p *parser) parseEscape(b *strings.Builder) error {
+	p.pos++ // '\\'
+	if p.pos >= len(p.src) {
+		return p.errorf("unfinished string")
+	}
+	c := p.src[p.pos]
+	p.pos++
+	switch c {
+	case 'a':
+		b.WriteByte('\a')
+	case 'b':
+		b.WriteByte('\b')
+	case 'f':
+		b.WriteByte('\f')
+	case 'n':
+		b.WriteByte('\n')
+	case 'r':
+		b.WriteByte('\r')
+	case 't':
+		b.WriteByte('\t')
+	case 'v':
+		b.WriteByte('\v')
+	case '\n', '\r':
+		// an escaped line break is a newline, with \r\n and \n\r counting once
+		b.WriteByte('\n')
+		if p.pos < len(p.src) && (p.src[p.pos] == '\n' || p.src[p.pos] == '\r') && p.src[p.pos] != c {
+			p.pos++
+		}
+	case 'x':
+		// Lua 5.2 hex escapes, which the marshaler may write for control bytes
+		if p.pos+2 > len(p.src) || !isHexDigit(p.src[p.pos]) || !isHexDigit(p.src[p.pos+1]) {
+			return p.errorf("hexadecimal digit expected")
+		}
+		u, _ := strconv.ParseUint(string(p.src[p.pos:p.pos+2]), 16, 8)
+		b.WriteByte(byte(u))
+		p.pos += 2
+	default:
+		if !isDigit(c) {
+			// Lua 5.1 keeps unknown escapes as the escaped character
+			b.WriteByte(c)
+			return nil
+		}
+		n := int(c - '0')
+		for i := 0; i < 2 && p.pos < len(p.src) && isDigit(p.src[p.pos]); i++ {
+			n = n*10 + int(p.src[p.pos]-'0')
+			p.pos++
+		}
+		if n > math.MaxUint8 {
+			return p.errorf("escape sequence too large")
+		}
+		b.WriteByte(byte(n))
+	}
+	return nil
+}
+
+// longBracketLevel returns the level of the long bracket opening at the
+// cursor, or -1 if there is none
+func (p *parser) longBracketLevel() int {
+	i := p.pos + 1
+	for i < len(p.src) && p.src[i] == '=' {
+		i++
+	}
+	if i < len(p.src) && p.src[i] == '[' {
+		return i - p.pos - 1
+	}
+	return -1
+}
+
+func (p *parser) parseLongString() (string, error) {
+	level := p.longBracketLevel()
+	p.pos += level + 2
+	// a line break directly after the opening bracket is skipped
+	if p.pos < len(p.src) && p.src[p.pos] == '\r' {
+		p.pos++
+	}
+	if p.pos < len(p.src) && p.src[p.pos] == '\n' {
+		p.pos++
+	}
+
+	closing := "]" + strings.Repeat("=", level) + "]"
+	end := bytes.Index(p.src[p.pos:], []byte(closing))
+	if end < 0 {
+		p.pos = len(p.src)
+		return "", p.errorf("unfinished long string")
+	}
+	s := string(p.src[p.pos : p.pos+end])
+	p.pos += end + len(closing)
+	return p.sanitize(s), nil
+}
+
+// skipSpace advances past whitespace and comments
+func (p *parser) skipSpace() {
+	for p.pos < len(p.src) {
+		switch c := p.src[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f':
+			p.pos++
+		case c == '-' && p.pos+1 < len(p.src) && p.src[p.pos+1] == '-':
+			p.pos += 2
+			if p.pos < len(p.src) && p.src[p.pos] == '[' && p.longBracketLevel() >= 0 {
+				if _, err := p.parseLongString(); err != nil {
+					return
+				}
+				continue
+			}
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// expect skips whitespace and consumes c
+func (p *parser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.src) {
+		return p.errorf("expected %q but reached end of input", c)
+	}
+	if p.src[p.pos] != c {
+		return p.errorf("expected %q but found %q", c, p.src[p.pos])
+	}
+	p.pos++
+	return nil
+}
+
+// peekName returns the name at the cursor without consuming it
+func (p *parser) peekName() string {
+	start := p.pos
+	name := p.readName()
+	p.pos = start
+	return name
+}
+
+func (p *parser) readName() string {
+	start := p.pos
+	if p.pos < len(p.src) && isNameStart(p.src[p.pos]) {
+		p.pos++
+		for p.pos < len(p.src) && (isNameStart(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *parser) errorf(format string, args ...any) error {
+	return &SyntaxError{Offset: int64(p.pos), Msg: fmt.Sprintf(format, args...)}
+}
+
+// newTable returns an empty table equivalent to one created by a lua.LState
+func newTable() *lua.LTable {
+	return &lua.LTable{Metatable: lua.LNil}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func isNameStart(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func isHexPrefix(b []byte) bool {
+	return len(b) >= 2 && b[0] == '0' && (b[1] == 'x' || b[1] == 'X')
+}
+
+// isDecimal reports whether b is a decimal number in Lua's grammar: digits
+// with an optional fraction, at least one digit in all, and an optional
+// exponent
+func isDecimal(b []byte) bool {
+	i, digits := 0, 0
+	for ; i < len(b) && isDigit(b[i]); i++ {
+		digits++
+	}
+	if i < len(b) && b[i] == '.' {
+		for i++; i < len(b) && isDigit(b[i]); i++ {
+			digits++
+		}
+	}
+	if digits == 0 {
+		return false
+	}
+	if i < len(b) && (b[i] == 'e' || b[i] == 'E') {
+		i++
+		if i < len(b) && (b[i] == '+' || b[i] == '-') {
+			i++
+		}
+		if i == len(b) || !isDigit(b[i]) {
+			return false
+		}
+		for i < len(b) && isDigit(b[i]) {
+			i++
+		}
+	}
+	return i == len(b)
+}
+
+// isRangeError reports whether err only means the number overflowed, in which
+// case strconv still returns the correctly rounded infinity or zero
+func isRangeError(err error) bool {
+	ne, ok := err.(*strconv.NumError)
+	return ok && ne.Err == strconv.ErrRange
+}
@@ -0,0 +1,278 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// TestDecodeMatchesLua checks that the parser agrees with the Lua VM
+func TestDecodeMatchesLua(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		lua  string
+	}{
+		{"empty table", `return {}`},
+		{"bracketed keys", `return {["foo"]="bar",[1]=42,[2.5]=true,}`},
+		{"name keys", `return {foo = "bar", _x1 = 1}`},
+		{"positional values", `return {"a", "b", [10]="c", "d"}`},
+		{"negative numbers", `return {[-1]=-2.5,["x"]= - 3}`},
+		{"number forms", `return {1e3, 1E-2, 0x1F, .5, 3., 1e+02}`},
+		{"exponent case", `return {[1E10]=1e10, [2e-5]=2E-5, ["x"]=1E+21}`},
+		{"escapes", `return {"a\"b", 'c\'d', "\n\t\\", "\65\066\0677", "line\
+break", "\q"}`},
+		{"long strings", "return {[[raw \\n]], [==[a]]b]==], [[\nskipped newline]]}"},
+		{"comments", "-- header\nreturn --[[ inline ]] {1, -- trailing\n 2}"},
+		{"nested", `return {["a"]={["b"]={["c"]={}}}}`},
+		{"whitespace", "return\r\n{\r\n\t[\"a\"] = 1 ,\r\n}\r\n"},
+		{"semicolons", `return {1; 2; ["x"]=3}`},
+		{"mixed separators", `return {1, 2; y = {3; 4,}; "z";}`},
+		{"parenthesized", `return ({["a"]={1, 2}})`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			if err := L.DoString("zw_data = (function() " + test.lua + " end)()"); err != nil {
+				t.Fatalf("Lua rejected %q: %v", test.name, err)
+			}
+			want := L.GetGlobal("zw_data").(*lua.LTable)
+
+			var got lua.LTable
+			if err := decode([]byte(test.lua), &got, newOptions(nil)); err != nil {
+				t.Fatalf("decode() error for %q: %v", test.name, err)
+			}
+			if !deepEquals(L, want, &got) {
+				t.Errorf("decode() of %q does not match Lua", test.name)
+			}
+		})
+	}
+}
+
+func TestDecodeMatchesLuaFixture(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	f, err := os.Open(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer f.Close()
+	r := DecompressReader(f)
+	defer r.Close()
+	src, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to decompress fixture: %v", err)
+	}
+
+	if err := L.DoString("zw_data = (function() " + string(src) + " end)()"); err != nil {
+		t.Fatalf("Lua rejected fixture: %v", err)
+	}
+	want := L.GetGlobal("zw_data").(*lua.LTable)
+
+	var got lua.LTable
+	if err := decode(src, &got, newOptions(nil)); err != nil {
+		t.Fatalf("decode() error: %v", err)
+	}
+	if !deepEquals(L, want, &got) {
+		t.Errorf("decode() of fixture does not match Lua")
+	}
+}
+
+func TestDecodeSyntaxError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		lua    string
+		offset int64
+	}{
+		{"unexpected character", `return {@}`, 8},
+		{"missing closing brace", `return {1,2`, 11},
+		{"missing separator", `return {1 2}`, 10},
+		{"unfinished string", `return {"abc}`, 13},
+		{"nil index", `return {[nil]=1}`, 9},
+		{"malformed number", `return {12abc}`, 8},
+		{"trailing garbage", `return {} x`, 10},
+		{"function call", `return {print("x")}`, 8},
+		{"double semicolon", `return {1;;2}`, 10},
+		{"negative nan", `return {-nan}`, 9},
+		{"negative inf", `return {-inf}`, 9},
+		{"negative infinity", `return {-Infinity}`, 9},
+		{"nan key", `return {[-nan]=1}`, 10},
+		{"digit separator", `return {1_000}`, 8},
+		{"lone dot", `return {-.}`, 9},
+		{"empty exponent", `return {1e}`, 8},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out lua.LTable
+			err := decode([]byte(test.lua), &out, newOptions(nil))
+			var serr *SyntaxError
+			if !errors.As(err, &serr) {
+				t.Fatalf("got error %v; want *SyntaxError", err)
+			}
+			if serr.Offset != test.offset {
+				t.Errorf("got offset %d; want %d (%v)", serr.Offset, test.offset, serr)
+			}
+		})
+	}
+}
+
+func TestDecodeDefaultMaxDepth(t *testing.T) {
+	t.Parallel()
+
+	// far deeper than any save, but small enough to compress to a few bytes
+	src := compressLua(t, "return "+strings.Repeat("{", 1_000_000))
+	parens := compressLua(t, "return {"+strings.Repeat("(", 1_000_000))
+
+	tests := []struct {
+		name string
+		read func() error
+	}{
+		{"Unmarshal", func() error {
+			return Unmarshal(src, newTable())
+		}},
+		{"Unmarshal parentheses", func() error {
+			return Unmarshal(parens, newTable())
+		}},
+		{"ValidateStream", func() error {
+			return ValidateStream(bytes.NewReader(src))
+		}},
+		{"TopLevelKeys", func() error {
+			_, err := TopLevelKeys(bytes.NewReader(src))
+			return err
+		}},
+		{"ReadPath", func() error {
+			_, err := ReadPath(bytes.NewReader(src), "1.1")
+			return err
+		}},
+		{"Reader.All", func() error {
+			r := NewReader(bytes.NewReader(src))
+			for range r.All() {
+			}
+			return r.Err()
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			if err := test.read(); !errors.Is(err, ErrMaxDepthExceeded) {
+				t.Errorf("got %v; want ErrMaxDepthExceeded", err)
+			}
+		})
+	}
+}
+
+func TestDecodeHexEscape(t *testing.T) {
+	t.Parallel()
+
+	var out lua.LTable
+	if err := decode([]byte(`return {"\x41\x7a\x00"}`), &out, newOptions(nil)); err != nil {
+		t.Fatalf("decode() error: %v", err)
+	}
+	if got, want := out.RawGetInt(1), lua.LString("Az\x00"); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestDecodeLiterals(t *testing.T) {
+	t.Parallel()
+
+	var out lua.LTable
+	src := `return {["x"]=nil,["t"]=true,["f"]=false,["y"]=1,["y"]=nil,[1]=nil,[2]=true,}`
+	if err := decode([]byte(src), &out, newOptions(nil)); err != nil {
+		t.Fatalf("decode() error: %v", err)
+	}
+
+	tests := []struct {
+		key  lua.LValue
+		want lua.LValue
+	}{
+		{lua.LString("x"), lua.LNil},
+		{lua.LString("t"), lua.LTrue},
+		{lua.LString("f"), lua.LFalse},
+		{lua.LString("y"), lua.LNil},
+		{lua.LNumber(1), lua.LNil},
+		{lua.LNumber(2), lua.LTrue},
+	}
+	for _, test := range tests {
+		if got := out.RawGet(test.key); got != test.want {
+			t.Errorf("got %v for key %v; want %v", got, test.key, test.want)
+		}
+	}
+
+	var keys []string
+	out.ForEach(func(key, _ lua.LValue) {
+		keys = append(keys, key.String())
+	})
+	slices.Sort(keys)
+	if want := []string{"2", "f", "t"}; !slices.Equal(keys, want) {
+		t.Errorf("got keys %q; want %q", keys, want)
+	}
+}
+
+// TestDecodeHistoricalNumbers checks the number forms older Balatro versions
+// wrote, both as values and as keys
+func TestDecodeHistoricalNumbers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		literal string
+		want    float64
+	}{
+		{"4.0", 4},
+		{"100.0", 100},
+		{".5", 0.5},
+		{"-.25", -0.25},
+		{"3.", 3},
+		{"1e+02", 100},
+		{"1E2", 100},
+		{"2.5e-3", 0.0025},
+		{"0.50000000000000", 0.5},
+		{"0.1000000000000000055511151231257827", 0.1},
+		{"1.0e-3", 0.001},
+		{"007", 7},
+		{"12345678901234", 12345678901234},
+		{"1e+308", 1e308},
+		{"0x10", 16},
+	}
+
+	for _, test := range tests {
+		t.Run(test.literal, func(t *testing.T) {
+			t.Parallel()
+
+			var out lua.LTable
+			src := "return {[\"v\"]=" + test.literal + ",[" + test.literal + "]=true,}"
+			if err := decode([]byte(src), &out, newOptions(nil)); err != nil {
+				t.Fatalf("decode() error: %v", err)
+			}
+			if got := out.RawGetString("v"); got != lua.LNumber(test.want) {
+				t.Errorf("got value %v; want %v", got, test.want)
+			}
+			if got := out.RawGet(lua.LNumber(test.want)); got != lua.LTrue {
+				t.Errorf("key %v not found", test.want)
+			}
+		})
+	}
+}
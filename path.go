@@ -0,0 +1,124 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// splitPath splits a dotted path such as "GAME.dollars" into its segments
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, ".")
+}
+
+// getField returns the value of segment in tbl, trying it as a string key
+// first and as an integer key second
+func getField(tbl *lua.LTable, segment string) lua.LValue {
+	if v := tbl.RawGetString(segment); v != lua.LNil {
+		return v
+	}
+	if i, err := strconv.Atoi(segment); err == nil {
+		return rawGet(tbl, lua.LNumber(i))
+	}
+	return lua.LNil
+}
+
+// lookupPath returns the value at path in tbl, or lua.LNil if any segment is
+// missing or traverses a non-table value
+func lookupPath(tbl *lua.LTable, path string) lua.LValue {
+	var v lua.LValue = tbl
+	for _, segment := range splitPath(path) {
+		t, ok := v.(*lua.LTable)
+		if !ok {
+			return lua.LNil
+		}
+		v = getField(t, segment)
+	}
+	return v
+}
+
+// SetPath sets the value at the dotted path in tbl, deleting the key if value
+// is lua.LNil. Every segment but the last must name an existing table. The
+// last segment names an existing string key if there is one, and otherwise an
+// integer key if it is an integer, such as "cards.3", or a string key if not.
+func SetPath(tbl *lua.LTable, path string, value lua.LValue) error {
+	_, err := setPath(tbl, path, value)
+	return err
+}
+
+// setPath implements SetPath, also returning the value it replaced
+func setPath(tbl *lua.LTable, path string, value lua.LValue) (lua.LValue, error) {
+	segments := splitPath(path)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("jkr: empty path")
+	}
+	parent := tbl
+	for i, segment := range segments[:len(segments)-1] {
+		t, ok := getField(parent, segment).(*lua.LTable)
+		if !ok {
+			return nil, fmt.Errorf("jkr: %s is not a table", strings.Join(segments[:i+1], "."))
+		}
+		parent = t
+	}
+
+	key := fieldKey(parent, segments[len(segments)-1])
+	old := rawGet(parent, key)
+	parent.RawSet(key, value)
+	return old, nil
+}
+
+// fieldKey returns the key that segment names in tbl, following the same
+// string-first rule as getField
+func fieldKey(tbl *lua.LTable, segment string) lua.LValue {
+	if tbl.RawGetString(segment) != lua.LNil {
+		return lua.LString(segment)
+	}
+	if i, err := strconv.Atoi(segment); err == nil {
+		return lua.LNumber(i)
+	}
+	return lua.LString(segment)
+}
+
+// ObjectPaths returns the path of every object table in tbl, in sorted key
+// order. These are the tables the marshaler writes as "MANUAL_REPLACE", so
+// their contents do not survive a round-trip. Objects nested inside other
+// objects are not reported, since the outer placeholder already replaces them.
+// WithStrictObjects changes which tables count as objects, as it does for the
+// marshaler.
+func ObjectPaths(tbl *lua.LTable, opts ...Option) [][]string {
+	o := newOptions(opts)
+	var paths [][]string
+	visited := map[*lua.LTable]bool{tbl: true}
+	var walk func(t *lua.LTable, path []string)
+	walk = func(t *lua.LTable, path []string) {
+		entries := sortedEntries(t)
+		for _, en := range entries {
+			child, ok := en.value.(*lua.LTable)
+			if !ok || visited[child] {
+				continue
+			}
+			childPath := append(slices.Clip(path), en.key.String())
+			if o.isObject(child) {
+				paths = append(paths, childPath)
+				continue
+			}
+			visited[child] = true
+			walk(child, childPath)
+			delete(visited, child)
+		}
+	}
+	walk(tbl, nil)
+	return paths
+}
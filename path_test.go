@@ -0,0 +1,129 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestObjectPaths(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	src := `local function obj() return {is = function() end} end
+	local t = {
+		GAME = {selected_back = obj(), round = 3},
+		cardAreas = {jokers = {cards = {obj(), obj()}}},
+		BLIND = obj(),
+		plain = {nested = {}},
+	}
+	t.self = t
+	return t`
+	if err := L.DoString(src); err != nil {
+		t.Fatalf("DoString() error: %v", err)
+	}
+	tbl := L.Get(-1).(*lua.LTable)
+
+	want := [][]string{
+		{"BLIND"},
+		{"GAME", "selected_back"},
+		{"cardAreas", "jokers", "cards", "1"},
+		{"cardAreas", "jokers", "cards", "2"},
+	}
+	if got := ObjectPaths(tbl); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	if got := ObjectPaths(newTable()); got != nil {
+		t.Errorf("got %q for an empty table; want nil", got)
+	}
+}
+
+func TestSetPath(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		path      string
+		value     lua.LValue
+		expected  string
+		expectErr bool
+	}{
+		{"replace", "a", lua.LNumber(2), `return {["a"]=2,["cards"]={"x","y",},["n"]={["2"]="s",},}`, false},
+		{"add string key", "b", lua.LTrue, `return {["a"]=1,["b"]=true,["cards"]={"x","y",},["n"]={["2"]="s",},}`, false},
+		{"integer key", "cards.3", lua.LString("z"), `return {["a"]=1,["cards"]={"x","y","z",},["n"]={["2"]="s",},}`, false},
+		{"existing numeric string key", "n.2", lua.LString("t"), `return {["a"]=1,["cards"]={"x","y",},["n"]={["2"]="t",},}`, false},
+		{"delete", "cards.2", lua.LNil, `return {["a"]=1,["cards"]={"x",},["n"]={["2"]="s",},}`, false},
+		{"missing parent", "missing.x", lua.LTrue, "", true},
+		{"non-table parent", "a.x", lua.LTrue, "", true},
+		{"empty path", "", lua.LTrue, "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cards := newTable()
+			cards.Append(lua.LString("x"))
+			cards.Append(lua.LString("y"))
+			n := newTable()
+			n.RawSetString("2", lua.LString("s"))
+			tbl := newTable()
+			tbl.RawSetString("a", lua.LNumber(1))
+			tbl.RawSetString("cards", cards)
+			tbl.RawSetString("n", n)
+
+			err := SetPath(tbl, test.path, test.value)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SetPath() error: %v", err)
+			}
+			data, err := Serialize(tbl)
+			if err != nil {
+				t.Fatalf("Serialize() error: %v", err)
+			}
+			if got := string(data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestLookupPathHashIntegerKeys(t *testing.T) {
+	t.Parallel()
+
+	cards := newTable()
+	cards.RawSetH(lua.LNumber(1), lua.LString("j_joker"))
+	tbl := newTable()
+	tbl.RawSetString("cards", cards)
+	tbl.RawSetH(lua.LNumber(2), lua.LString("two"))
+
+	tests := []struct {
+		path     string
+		expected lua.LValue
+	}{
+		{"cards.1", lua.LString("j_joker")},
+		{"2", lua.LString("two")},
+		{"cards.2", lua.LNil},
+	}
+
+	s := &Save{Table: tbl}
+	for _, test := range tests {
+		if got := lookupPath(tbl, test.path); got != test.expected {
+			t.Errorf("lookupPath(%q) = %v; want %v", test.path, got, test.expected)
+		}
+		if got := s.Get(test.path); got != test.expected {
+			t.Errorf("Get(%q) = %v; want %v", test.path, got, test.expected)
+		}
+	}
+}
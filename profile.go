@@ -0,0 +1,79 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Profile holds the decoded files of a single numbered profile directory.
+type Profile struct {
+	// Profile is profile.jkr, the profile's statistics and progress.
+	Profile *lua.LTable
+	// Meta is meta.jkr, the profile's unlocks and discoveries, or nil if
+	// the profile has none yet.
+	Meta *lua.LTable
+	// Save is save.jkr, the run in progress, or nil if there is none.
+	Save *lua.LTable
+}
+
+// ReadProfile reads the files of a numbered profile directory such as
+// "<save directory>/1". It expects profile.jkr to exist, and reads meta.jkr
+// and save.jkr when present.
+func ReadProfile(dir string, opts ...Option) (*Profile, error) {
+	profile, err := ReadFile(filepath.Join(dir, "profile.jkr"), opts...)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := readOptional(filepath.Join(dir, "meta.jkr"), opts)
+	if err != nil {
+		return nil, err
+	}
+	save, err := readOptional(filepath.Join(dir, "save.jkr"), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Profile{Profile: profile, Meta: meta, Save: save}, nil
+}
+
+// readOptional reads the named file, returning nil if it does not exist
+func readOptional(name string, opts []Option) (*lua.LTable, error) {
+	tbl, err := ReadFile(name, opts...)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return tbl, err
+}
+
+// runIdentityPaths are the dotted paths of the save.jkr fields SameRun
+// compares by default
+var runIdentityPaths = []string{"GAME.pseudorandom.seed", "GAME.stake", "BACK.key"}
+
+// SameRun reports whether two decoded saves are snapshots of the same run,
+// comparing only the fields at the given dotted paths rather than the whole
+// table. Without paths, it compares the seed, the stake and the deck,
+// GAME.pseudorandom.seed, GAME.stake and BACK.key, which are fixed when a run
+// starts and never change during it. Balatro does not save the profile or the
+// start time of a run, so those cannot be compared. Each field must be
+// present in both saves and equal, compared like Equal, so saves missing any
+// of them never match.
+func SameRun(a, b *lua.LTable, paths ...string) bool {
+	if len(paths) == 0 {
+		paths = runIdentityPaths
+	}
+	for _, path := range paths {
+		av, bv := lookupPath(a, path), lookupPath(b, path)
+		if av == lua.LNil || !equalValue(av, bv, make(map[[2]*lua.LTable]bool)) {
+			return false
+		}
+	}
+	return true
+}
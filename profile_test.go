@@ -0,0 +1,126 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestReadProfile(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		files     []string
+		expectErr bool
+	}{
+		{"all files", []string{"profile.jkr", "meta.jkr", "save.jkr"}, false},
+		{"no run in progress", []string{"profile.jkr", "meta.jkr"}, false},
+		{"missing profile", []string{"meta.jkr", "save.jkr"}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			for _, name := range test.files {
+				data, err := os.ReadFile(filepath.Join("testdata", name))
+				if err != nil {
+					t.Fatalf("failed to read fixture: %v", err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+					t.Fatalf("failed to write fixture: %v", err)
+				}
+			}
+
+			p, err := ReadProfile(dir)
+			if test.expectErr {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("got %v; want fs.ErrNotExist", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadProfile() error: %v", err)
+			}
+
+			for name, got := range map[string]*lua.LTable{
+				"profile.jkr": p.Profile,
+				"meta.jkr":    p.Meta,
+				"save.jkr":    p.Save,
+			} {
+				if !slices.Contains(test.files, name) {
+					if got != nil {
+						t.Errorf("got a table for missing %s; want nil", name)
+					}
+					continue
+				}
+				want, err := ReadFile(filepath.Join("testdata", name))
+				if err != nil {
+					t.Fatalf("ReadFile() error: %v", err)
+				}
+				if got == nil || !Equal(got, want) {
+					t.Errorf("%s differs from ReadFile()", name)
+				}
+			}
+		})
+	}
+}
+
+func TestSameRun(t *testing.T) {
+	t.Parallel()
+
+	run := `return {["GAME"]={["pseudorandom"]={["seed"]="ABCD1234",},["stake"]=1,["round"]=3,["dollars"]=4,},["BACK"]={["key"]="b_red",},}`
+	tests := []struct {
+		name string
+		src  string
+		same bool
+	}{
+		{"same snapshot", run, true},
+		{"later in the same run", `return {["GAME"]={["pseudorandom"]={["seed"]="ABCD1234",},["stake"]=1,["round"]=7,["dollars"]=31,},["BACK"]={["key"]="b_red",},}`, true},
+		{"different seed", `return {["GAME"]={["pseudorandom"]={["seed"]="ZZZZ9999",},["stake"]=1,["round"]=3,["dollars"]=4,},["BACK"]={["key"]="b_red",},}`, false},
+		{"different deck", `return {["GAME"]={["pseudorandom"]={["seed"]="ABCD1234",},["stake"]=1,["round"]=3,["dollars"]=4,},["BACK"]={["key"]="b_blue",},}`, false},
+		{"missing seed", `return {["GAME"]={["stake"]=1,},["BACK"]={["key"]="b_red",},}`, false},
+	}
+
+	a := compileTable(t, run)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			b := compileTable(t, test.src)
+			if got := SameRun(a, b); got != test.same {
+				t.Errorf("got %v; want %v", got, test.same)
+			}
+			if got := SameRun(b, a); got != test.same {
+				t.Errorf("got %v with the saves swapped; want %v", got, test.same)
+			}
+		})
+	}
+
+	save, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if !SameRun(save, Clone(save)) {
+		t.Errorf("fixture is not the same run as its clone")
+	}
+
+	// other paths replace the default ones
+	later := compileTable(t, tests[1].src)
+	if !SameRun(a, later, "BACK.key") {
+		t.Errorf("saves with the same deck do not match on BACK.key")
+	}
+	if SameRun(a, later, "BACK.key", "GAME.round") {
+		t.Errorf("saves in different rounds match on GAME.round")
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import lua "github.com/yuin/gopher-lua"
+
+// PrunePolicy selects which values Prune removes. Policies can be combined
+// with the | operator.
+type PrunePolicy int
+
+const (
+	// PruneEmptyTables removes tables that are empty after pruning.
+	PruneEmptyTables PrunePolicy = 1 << iota
+	// PruneZeroNumbers removes numbers equal to 0.
+	PruneZeroNumbers
+	// PruneEmptyStrings removes empty strings.
+	PruneEmptyStrings
+	// PruneFalse removes false booleans.
+	PruneFalse
+
+	// PruneAll removes every kind of default value. It is the default policy.
+	PruneAll = PruneEmptyTables | PruneZeroNumbers | PruneEmptyStrings | PruneFalse
+)
+
+// WithPrunePolicy sets which values Prune removes. The default is PruneAll.
+func WithPrunePolicy(policy PrunePolicy) Option {
+	return func(o *options) {
+		o.prunePolicy = policy
+	}
+}
+
+// Prune returns a copy of tbl without the default and empty values selected
+// by the prune policy. tbl is not modified. A table that refers back to one
+// of its ancestors cannot be marshaled, so such references are dropped.
+func Prune(tbl *lua.LTable, opts ...Option) *lua.LTable {
+	o := newOptions(opts)
+	return prune(tbl, o.prunePolicy, make(map[*lua.LTable]bool))
+}
+
+func prune(tbl *lua.LTable, policy PrunePolicy, visited map[*lua.LTable]bool) *lua.LTable {
+	visited[tbl] = true
+	defer delete(visited, tbl)
+
+	out := newTable()
+	out.Metatable = tbl.Metatable
+	forEach(tbl, func(key, value lua.LValue) {
+		switch v := value.(type) {
+		case *lua.LTable:
+			if visited[v] {
+				return
+			}
+			sub := prune(v, policy, visited)
+			if policy&PruneEmptyTables != 0 && isEmpty(sub) {
+				return
+			}
+			value = sub
+		case lua.LNumber:
+			if policy&PruneZeroNumbers != 0 && v == 0 {
+				return
+			}
+		case lua.LString:
+			if policy&PruneEmptyStrings != 0 && v == "" {
+				return
+			}
+		case lua.LBool:
+			if policy&PruneFalse != 0 && !bool(v) {
+				return
+			}
+		}
+		out.RawSet(key, value)
+	})
+	return out
+}
+
+// isEmpty reports whether tbl holds no keys
+func isEmpty(tbl *lua.LTable) bool {
+	key, _ := tbl.Next(lua.LNil)
+	return key == lua.LNil
+}
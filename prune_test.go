@@ -0,0 +1,78 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"slices"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestPrune(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{
+			"default policy",
+			nil,
+			[]string{"dollars", "name", "nested", "won"},
+		},
+		{
+			"only empty tables",
+			[]Option{WithPrunePolicy(PruneEmptyTables)},
+			[]string{"dollars", "emptied", "empty_string", "lost", "name", "nested", "won", "zero"},
+		},
+		{
+			"nothing",
+			[]Option{WithPrunePolicy(0)},
+			[]string{"dollars", "emptied", "empty", "empty_string", "lost", "name", "nested", "won", "zero"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			tbl := L.NewTable()
+			tbl.RawSetString("dollars", lua.LNumber(4))
+			tbl.RawSetString("zero", lua.LNumber(0))
+			tbl.RawSetString("name", lua.LString("P1"))
+			tbl.RawSetString("empty_string", lua.LString(""))
+			tbl.RawSetString("won", lua.LTrue)
+			tbl.RawSetString("lost", lua.LFalse)
+			tbl.RawSetString("empty", L.NewTable())
+			emptied := L.NewTable()
+			emptied.RawSetString("zero", lua.LNumber(0))
+			tbl.RawSetString("emptied", emptied)
+			nested := L.NewTable()
+			nested.RawSetString("chips", lua.LNumber(10))
+			tbl.RawSetString("nested", nested)
+			tbl.RawSetString("self", tbl)
+
+			pruned := Prune(tbl, test.opts...)
+			var got []string
+			pruned.ForEach(func(key, _ lua.LValue) {
+				got = append(got, key.String())
+			})
+			slices.Sort(got)
+			if !slices.Equal(got, test.expected) {
+				t.Errorf("got keys %q; want %q", got, test.expected)
+			}
+
+			if tbl.RawGetString("zero") == lua.LNil || emptied.RawGetString("zero") == lua.LNil {
+				t.Errorf("Prune() modified its input")
+			}
+			if _, err := Marshal(pruned); err != nil {
+				t.Errorf("Marshal() of pruned table error: %v", err)
+			}
+		})
+	}
+}
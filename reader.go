@@ -0,0 +1,194 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bufio"
+	"compress/flate"
+	"io"
+	"iter"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Reader reads consecutive jkr streams from an underlying io.Reader, such as
+// those written by a Writer, stopping each read exactly at the end of its
+// flate stream.
+type Reader struct {
+	cr   *countingReader
+	zr   io.ReadCloser
+	opts options
+	err  error
+	// pending holds the decompressed chunks left in the current stream,
+	// when a Writer appended several tables to it
+	pending []byte
+}
+
+// NewReader returns a Reader that reads from r, decoding every table with
+// opts. If r implements io.ByteReader, the Reader consumes from r only the
+// bytes of the streams it reads, so r can be used for whatever follows them.
+// Otherwise r is buffered and may be read ahead.
+func NewReader(r io.Reader, opts ...Option) *Reader {
+	br, ok := r.(flate.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{
+		cr:   &countingReader{r: br},
+		opts: newOptions(opts),
+	}
+}
+
+// Read decodes the next table. It returns io.EOF if the underlying reader is
+// exhausted before a new stream starts. A stream holding several tables, as
+// written by Writer.Append, yields them one per call.
+func (r *Reader) Read() (*lua.LTable, error) {
+	content, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &lua.LTable{}
+	p := &parser{src: content, nilKeys: r.opts.nilKeys, opts: r.opts}
+	if err := p.parseNextChunk(out); err != nil {
+		return nil, err
+	}
+	r.pending = content[p.pos:]
+	return out, nil
+}
+
+// next returns the source of the next table, decompressing the next stream
+// once the current one is used up
+func (r *Reader) next() ([]byte, error) {
+	if len(r.pending) > 0 {
+		content := r.pending
+		r.pending = nil
+		return content, nil
+	}
+	if _, err := r.cr.peek(); err != nil {
+		return nil, err
+	}
+
+	if r.zr == nil {
+		r.zr = flate.NewReader(r.cr)
+	} else if err := r.zr.(flate.Resetter).Reset(r.cr, nil); err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(r.zr)
+	return content, decompressError(err)
+}
+
+// All returns an iterator over the top-level keys and values of the next
+// table, yielded in source order as each value is parsed, so the top-level
+// table itself is never built. Number keys are yielded in their string form,
+// such as "1", a key written more than once is yielded every time, and keys
+// written as nil are skipped. The stream is still decompressed in full before
+// the first pair.
+//
+// Iteration stops at the first error, which Err then reports. Like Read, All
+// consumes the next table even if iteration stops early, and yields nothing
+// without an error if there are no more tables.
+func (r *Reader) All() iter.Seq2[string, lua.LValue] {
+	return func(yield func(string, lua.LValue) bool) {
+		r.err = nil
+		content, err := r.next()
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			return
+		}
+
+		p := &parser{src: content, opts: r.opts}
+		parens, err := p.openTopLevel()
+		if err == nil {
+			// the top-level table counts towards the limits even though it
+			// is not built
+			p.depth, p.tables = 1, 1
+			stopped := false
+			err = p.parseFields(func(key lua.LValue) error {
+				if stopped {
+					// skip the rest of the table to reach the next one
+					_, err := p.skipValue()
+					return err
+				}
+				value, err := p.parseValue()
+				if err != nil || value == lua.LNil {
+					return err
+				}
+				stopped = !yield(key.String(), value)
+				return nil
+			})
+		}
+		if err == nil {
+			err = p.closeChunk(parens)
+		}
+		if err != nil {
+			r.err = err
+			return
+		}
+		r.pending = content[p.pos:]
+	}
+}
+
+// Err returns the error that stopped the last iteration by All, or nil if it
+// ran to the end of the table or was stopped by its consumer.
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// InputOffset returns the number of compressed bytes consumed so far, which
+// is the offset just past the last stream read in the underlying reader.
+func (r *Reader) InputOffset() int64 {
+	return r.cr.n
+}
+
+// countingReader counts the bytes read through it, and can peek at the next
+// byte without consuming it
+type countingReader struct {
+	r      flate.Reader
+	n      int64
+	peeked bool
+	next   byte
+}
+
+// peek returns the next byte without consuming it
+func (c *countingReader) peek() (byte, error) {
+	if !c.peeked {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		c.peeked, c.next = true, b
+	}
+	return c.next, nil
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.peek()
+	if err != nil {
+		return 0, err
+	}
+	c.peeked = false
+	c.n++
+	return b, nil
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if c.peeked {
+		p[0] = c.next
+		c.peeked = false
+		c.n++
+		return 1, nil
+	}
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,136 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+	"testing/iotest"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestReaderInputOffset(t *testing.T) {
+	t.Parallel()
+
+	first := newTable()
+	first.RawSetString("foo", lua.LString("bar"))
+	second := wideTable(10, 10)
+	a, err := Marshal(first)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	b, err := Marshal(second)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	trailer := []byte("trailing container data")
+
+	container := bytes.NewReader(append(append(append([]byte{}, a...), b...), trailer...))
+	r := NewReader(container)
+	for i, want := range []*lua.LTable{first, second} {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("Read() %d error: %v", i, err)
+		}
+		if !Equal(got, want) {
+			t.Errorf("table %d differs after reading", i)
+		}
+	}
+	if got, want := r.InputOffset(), int64(len(a)+len(b)); got != want {
+		t.Errorf("got offset %d; want %d", got, want)
+	}
+
+	rest, err := io.ReadAll(container)
+	if err != nil {
+		t.Fatalf("failed to read the rest of the container: %v", err)
+	}
+	if !bytes.Equal(rest, trailer) {
+		t.Errorf("got %q after the streams; want %q", rest, trailer)
+	}
+}
+
+func TestReaderEOF(t *testing.T) {
+	t.Parallel()
+
+	data, err := Marshal(newTable())
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	// a reader without io.ByteReader is buffered
+	r := NewReader(iotest.OneByteReader(bytes.NewReader(data)))
+	if _, err := r.Read(); err != nil {
+		t.Fatalf("Read() error: %v", err)
+	}
+	if got := r.InputOffset(); got != int64(len(data)) {
+		t.Errorf("got offset %d; want %d", got, len(data))
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("got %v after the last stream; want io.EOF", err)
+	}
+}
+
+func TestReaderAll(t *testing.T) {
+	t.Parallel()
+
+	var data []byte
+	for _, src := range []string{
+		`return {["dollars"]=4,["GAME"]={["round"]=3,},[1]="first",["gone"]=nil,}`,
+		`return {["a"]=1,["b"]=2,["c"]=3,}`,
+		`return {["a"]=1,["b"]={,}`,
+	} {
+		data = append(data, compressLua(t, src)...)
+	}
+	r := NewReader(bytes.NewReader(data))
+
+	var keys []string
+	for k, v := range r.All() {
+		keys = append(keys, k)
+		if k == "GAME" {
+			if got := v.(*lua.LTable).RawGetString("round"); got != lua.LNumber(3) {
+				t.Errorf("got GAME.round %v; want 3", got)
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err() after the first table: %v", err)
+	}
+	if want := []string{"dollars", "GAME", "1"}; !slices.Equal(keys, want) {
+		t.Errorf("got keys %q; want %q", keys, want)
+	}
+
+	// stopping early is not an error, and the rest of the stream is skipped
+	for k := range r.All() {
+		if k != "a" {
+			t.Errorf("got first key %q; want \"a\"", k)
+		}
+		break
+	}
+	if err := r.Err(); err != nil {
+		t.Errorf("Err() after stopping early: %v", err)
+	}
+
+	keys = keys[:0]
+	for k := range r.All() {
+		keys = append(keys, k)
+	}
+	var syntaxErr *SyntaxError
+	if err := r.Err(); !errors.As(err, &syntaxErr) {
+		t.Errorf("got Err() %v; want a *SyntaxError", err)
+	}
+	if want := []string{"a"}; !slices.Equal(keys, want) {
+		t.Errorf("got keys %q before the error; want %q", keys, want)
+	}
+
+	for range r.All() {
+		t.Errorf("got a pair after the last stream")
+	}
+	if err := r.Err(); err != nil {
+		t.Errorf("Err() after the last stream: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Change is a single edit to the value at a dotted path. Old is lua.LNil if
+// the key did not exist before, and New is lua.LNil if the edit deleted it.
+type Change struct {
+	Path string
+	Old  lua.LValue
+	New  lua.LValue
+}
+
+// ChangeLog is an append-only record of the edits made through a
+// RecordedTable, in the order they were made.
+type ChangeLog struct {
+	changes []Change
+}
+
+// Changes returns the recorded changes, oldest first.
+func (c *ChangeLog) Changes() []Change {
+	return c.changes
+}
+
+// Replay applies every recorded change to tbl in order, redoing the edits on a
+// table in the state the recording started from.
+func (c *ChangeLog) Replay(tbl *lua.LTable) error {
+	for _, ch := range c.changes {
+		if err := SetPath(tbl, ch.Path, ch.New); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reverse restores the old value of every recorded change, newest first,
+// undoing the edits on a table in the state the recording ended in.
+func (c *ChangeLog) Reverse(tbl *lua.LTable) error {
+	for i := len(c.changes) - 1; i >= 0; i-- {
+		ch := c.changes[i]
+		if err := SetPath(tbl, ch.Path, ch.Old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordedTable wraps a table so that edits made through it are appended to a
+// ChangeLog. Edits made to the table directly are not recorded.
+type RecordedTable struct {
+	tbl *lua.LTable
+	log *ChangeLog
+}
+
+// Record returns a wrapper around tbl that records its edits, and the log they
+// are recorded into.
+func Record(tbl *lua.LTable) (*RecordedTable, *ChangeLog) {
+	log := &ChangeLog{}
+	return &RecordedTable{tbl: tbl, log: log}, log
+}
+
+// Table returns the wrapped table.
+func (r *RecordedTable) Table() *lua.LTable {
+	return r.tbl
+}
+
+// Set sets the value at path like SetPath and records the change. Failed
+// edits are not recorded.
+func (r *RecordedTable) Set(path string, value lua.LValue) error {
+	old, err := setPath(r.tbl, path, value)
+	if err != nil {
+		return err
+	}
+	r.log.changes = append(r.log.changes, Change{Path: path, Old: old, New: value})
+	return nil
+}
+
+// Delete deletes the key at path and records the change.
+func (r *RecordedTable) Delete(path string) error {
+	return r.Set(path, lua.LNil)
+}
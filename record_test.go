@@ -0,0 +1,86 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestRecord(t *testing.T) {
+	t.Parallel()
+
+	build := func() *lua.LTable {
+		game := newTable()
+		game.RawSetString("dollars", lua.LNumber(4))
+		game.RawSetString("round", lua.LNumber(1))
+		tbl := newTable()
+		tbl.RawSetString("GAME", game)
+		tbl.RawSetString("VERSION", lua.LString(CurrentVersion))
+		return tbl
+	}
+	original := build()
+	tbl := build()
+
+	rec, log := Record(tbl)
+	edits := []struct {
+		path  string
+		value lua.LValue
+	}{
+		{"GAME.dollars", lua.LNumber(100)},
+		{"GAME.dollars", lua.LNumber(200)},
+		{"GAME.seed", lua.LString("ABC123")},
+		{"GAME.round", lua.LNil},
+		{"VERSION", lua.LNil},
+	}
+	for _, edit := range edits {
+		if err := rec.Set(edit.path, edit.value); err != nil {
+			t.Fatalf("Set(%q) error: %v", edit.path, err)
+		}
+	}
+	if err := rec.Set("GAME.dollars.x", lua.LTrue); err == nil {
+		t.Errorf("Set() through a number succeeded")
+	}
+
+	want := []Change{
+		{"GAME.dollars", lua.LNumber(4), lua.LNumber(100)},
+		{"GAME.dollars", lua.LNumber(100), lua.LNumber(200)},
+		{"GAME.seed", lua.LNil, lua.LString("ABC123")},
+		{"GAME.round", lua.LNumber(1), lua.LNil},
+		{"VERSION", lua.LString(CurrentVersion), lua.LNil},
+	}
+	got := log.Changes()
+	if len(got) != len(want) {
+		t.Fatalf("got %d changes; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("change %d: got %v; want %v", i, got[i], want[i])
+		}
+	}
+
+	edited := rec.Table()
+	if v := lookupPath(edited, "GAME.dollars"); v != lua.LNumber(200) {
+		t.Errorf("got dollars %v after edits; want 200", v)
+	}
+
+	if err := log.Reverse(edited); err != nil {
+		t.Fatalf("Reverse() error: %v", err)
+	}
+	if !Equal(edited, original) {
+		t.Errorf("table differs from the original after Reverse")
+	}
+
+	replayed := build()
+	if err := log.Replay(replayed); err != nil {
+		t.Fatalf("Replay() error: %v", err)
+	}
+	if v := lookupPath(replayed, "GAME.seed"); v != lua.LString("ABC123") {
+		t.Errorf("got seed %v after Replay; want ABC123", v)
+	}
+	if v := lookupPath(replayed, "VERSION"); v != lua.LNil {
+		t.Errorf("got VERSION %v after Replay; want nil", v)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Repair makes a best-effort attempt to recover a corrupted jkr file, such as
+// one cut short by a crash. It closes unterminated strings, removes stray
+// separators and unmatched closing braces, drops a trailing field that was
+// cut off and adds missing closing braces, then re-marshals the table. It
+// returns the repaired file together with a description of each fix. A file
+// that already decodes is returned unchanged with no fixes. Repair fails if
+// the source still does not decode after these fixes.
+func Repair(in []byte) ([]byte, []string, error) {
+	// a truncated stream still yields everything before the cut
+	src, derr := Decompress(in)
+	if len(src) == 0 && derr != nil {
+		return nil, nil, derr
+	}
+
+	var tbl lua.LTable
+	if derr == nil && decode(src, &tbl, newOptions(nil)) == nil {
+		return in, nil, nil
+	}
+
+	var fixes []string
+	if derr != nil {
+		fixes = append(fixes, fmt.Sprintf("recovered %d bytes from a damaged compressed stream: %v", len(src), derr))
+	}
+	fixed, sourceFixes := repairSource(src)
+	fixes = append(fixes, sourceFixes...)
+	if err := decode(fixed, &tbl, newOptions(nil)); err != nil {
+		return nil, fixes, fmt.Errorf("jkr: could not repair: %w", err)
+	}
+
+	out, err := Marshal(&tbl)
+	if err != nil {
+		return nil, fixes, err
+	}
+	return out, fixes, nil
+}
+
+// repairSource rewrites src with the fixes Repair describes, returning the
+// new source and what was changed
+func repairSource(src []byte) ([]byte, []string) {
+	var fixes []string
+	fixf := func(format string, args ...any) {
+		fixes = append(fixes, fmt.Sprintf(format, args...))
+	}
+
+	p := &parser{src: src}
+	out := make([]byte, 0, len(src)+16)
+	// fieldStart holds, per open table, where its current field begins in out
+	var fieldStart []int
+	for p.pos < len(src) {
+		start := p.pos
+		switch c := src[p.pos]; {
+		case c == '"' || c == '\'':
+			end, ok := scanShortString(src, start)
+			out = append(out, src[start:end]...)
+			if !ok {
+				out = append(out, c)
+				fixf("closed string opened at offset %d", start)
+			}
+			p.pos = end
+		case c == '[' && p.longBracketLevel() >= 0:
+			level := p.longBracketLevel()
+			if _, err := p.parseLongString(); err != nil {
+				out = append(out, src[start:]...)
+				out = append(out, "]"+strings.Repeat("=", level)+"]"...)
+				fixf("closed long string opened at offset %d", start)
+			} else {
+				out = append(out, src[start:p.pos]...)
+			}
+		case c == '-' && p.pos+1 < len(src) && src[p.pos+1] == '-':
+			p.skipSpace()
+			out = append(out, src[start:p.pos]...)
+		case c == '{':
+			out = append(out, c)
+			fieldStart = append(fieldStart, len(out))
+			p.pos++
+		case c == '}':
+			p.pos++
+			if len(fieldStart) == 0 {
+				fixf("removed unmatched '}' at offset %d", start)
+				continue
+			}
+			fieldStart = fieldStart[:len(fieldStart)-1]
+			out = append(out, c)
+		case c == ',' || c == ';':
+			p.pos++
+			if prev := lastNonSpace(out); prev == '{' || prev == ',' || prev == ';' {
+				fixf("removed stray %q at offset %d", c, start)
+				continue
+			}
+			out = append(out, c)
+			if len(fieldStart) > 0 {
+				fieldStart[len(fieldStart)-1] = len(out)
+			}
+		default:
+			out = append(out, c)
+			p.pos++
+		}
+	}
+
+	if n := len(fieldStart); n > 0 {
+		closing := strings.Repeat("}", n)
+		var tbl lua.LTable
+		if decode(append(slices.Clip(out), closing...), &tbl, newOptions(nil)) != nil {
+			if cut := bytes.TrimSpace(out[fieldStart[n-1]:]); len(cut) > 0 {
+				fixf("dropped incomplete field %q at end of input", cut)
+			}
+			out = out[:fieldStart[n-1]]
+		}
+		out = append(out, closing...)
+		fixf("added %d missing closing braces", n)
+	}
+	return out, fixes
+}
+
+// scanShortString returns the offset just past the quoted string starting at
+// start, and false if the string is cut off by a line break or the end of src
+func scanShortString(src []byte, start int) (int, bool) {
+	quote := src[start]
+	for i := start + 1; i < len(src); i++ {
+		switch src[i] {
+		case '\\':
+			i++
+		case quote:
+			return i + 1, true
+		case '\n', '\r':
+			return i, false
+		}
+	}
+	return len(src), false
+}
+
+// lastNonSpace returns the last byte of b that is not whitespace, or 0
+func lastNonSpace(b []byte) byte {
+	b = bytes.TrimRight(b, " \t\r\n\v\f")
+	if len(b) == 0 {
+		return 0
+	}
+	return b[len(b)-1]
+}
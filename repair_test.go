@@ -0,0 +1,76 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		src       string
+		expected  string
+		fixes     int
+		expectErr bool
+	}{
+		{"already valid", `return {["a"]=1,}`, `return {["a"]=1,}`, 0, false},
+		{"missing closing brace", `return {["a"]=1,["b"]={["c"]=2,}`, `return {["a"]=1,["b"]={["c"]=2,},}`, 1, false},
+		{"dangling comma", `return {["a"]=1,,["b"]=2,}`, `return {["a"]=1,["b"]=2,}`, 1, false},
+		{"leading comma", `return {,1,2}`, `return {1,2,}`, 1, false},
+		{"truncated field", `return {["a"]=1,["b"]={["c"]=`, `return {["a"]=1,["b"]={},}`, 2, false},
+		{"unterminated string", `return {["a"]="unfinished`, `return {["a"]="unfinished",}`, 2, false},
+		{"extra closing brace", `return {["a"]=1,}}`, `return {["a"]=1,}`, 1, false},
+		{"unrepairable", `return {["a"]=1 2}`, "", 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			in := compressLua(t, test.src)
+			out, fixes, err := Repair(in)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Repair() error: %v (fixes %q)", err, fixes)
+			}
+			if len(fixes) != test.fixes {
+				t.Errorf("got fixes %q; want %d", fixes, test.fixes)
+			}
+			if got := decompress(t, out); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+			if test.fixes == 0 && !bytes.Equal(out, in) {
+				t.Errorf("valid input was rewritten")
+			}
+		})
+	}
+}
+
+func TestRepairTruncatedStream(t *testing.T) {
+	t.Parallel()
+
+	data, err := Marshal(wideTable(50, 10))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	out, fixes, err := Repair(data[:len(data)*2/3])
+	if err != nil {
+		t.Fatalf("Repair() error: %v (fixes %q)", err, fixes)
+	}
+	if len(fixes) == 0 {
+		t.Errorf("got no fixes for a truncated stream")
+	}
+	if _, err := Decompress(out); err != nil {
+		t.Errorf("repaired output does not decompress: %v", err)
+	}
+}
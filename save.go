@@ -0,0 +1,83 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"io"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Save is a decoded jkr file together with the options it is read and
+// written with, for callers who want one value to load, edit and store
+// instead of the separate functions it is built on. Paths are dotted like
+// those of SetPath, such as "GAME.dollars".
+type Save struct {
+	// Table is the decoded top-level table. It can be used directly with
+	// the rest of the package.
+	Table *lua.LTable
+	opts  []Option
+}
+
+// NewSave returns an empty Save that loads and stores with opts.
+func NewSave(opts ...Option) *Save {
+	return &Save{Table: newTable(), opts: opts}
+}
+
+// Load decodes a jkr stream from r, replacing the Save's table. The table is
+// left unchanged if decoding fails.
+func (s *Save) Load(r io.Reader) error {
+	tbl := newTable()
+	if err := UnmarshalRead(r, tbl, s.opts...); err != nil {
+		return err
+	}
+	s.Table = tbl
+	return nil
+}
+
+// Store writes the Save's table to w as a jkr stream.
+func (s *Save) Store(w io.Writer) error {
+	return MarshalWrite(w, s.Table, s.opts...)
+}
+
+// Get returns the value at path, or lua.LNil if there is none.
+func (s *Save) Get(path string) lua.LValue {
+	return lookupPath(s.Table, path)
+}
+
+// Set sets the value at path like SetPath, deleting the key if v is lua.LNil.
+func (s *Save) Set(path string, v lua.LValue) error {
+	return SetPath(s.Table, path, v)
+}
+
+// GetString returns the string at path, reporting false if the value there is
+// not a string.
+func (s *Save) GetString(path string) (string, bool) {
+	v, ok := s.Get(path).(lua.LString)
+	return string(v), ok
+}
+
+// GetNumber returns the number at path, reporting false if the value there is
+// not a number.
+func (s *Save) GetNumber(path string) (float64, bool) {
+	v, ok := s.Get(path).(lua.LNumber)
+	return float64(v), ok
+}
+
+// GetBool returns the boolean at path, reporting false if the value there is
+// not a boolean.
+func (s *Save) GetBool(path string) (bool, bool) {
+	v, ok := s.Get(path).(lua.LBool)
+	return bool(v), ok
+}
+
+// GetSub returns the table at path, reporting false if the value there is not
+// a table.
+func (s *Save) GetSub(path string) (*lua.LTable, bool) {
+	v, ok := s.Get(path).(*lua.LTable)
+	return v, ok
+}
@@ -0,0 +1,75 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestSave(t *testing.T) {
+	t.Parallel()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	s := NewSave()
+	if err := s.Load(bytes.NewReader(raw)); err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	dollars, ok := s.GetNumber("GAME.dollars")
+	if !ok || dollars != 4 {
+		t.Errorf("got GAME.dollars %v, %v; want 4, true", dollars, ok)
+	}
+	if seed, ok := s.GetString("GAME.pseudorandom.seed"); !ok || seed != "ABCD1234" {
+		t.Errorf("got seed %q, %v; want \"ABCD1234\", true", seed, ok)
+	}
+	if won, ok := s.GetBool("GAME.won"); !ok || won {
+		t.Errorf("got GAME.won %v, %v; want false, true", won, ok)
+	}
+	if _, ok := s.GetSub("GAME.round_resets"); !ok {
+		t.Errorf("GAME.round_resets is not a table")
+	}
+	if _, ok := s.GetNumber("GAME.pseudorandom.seed"); ok {
+		t.Errorf("Number() accepted a string")
+	}
+	if v := s.Get("GAME.missing.key"); v != lua.LNil {
+		t.Errorf("got %v for a missing path; want nil", v)
+	}
+
+	if err := s.Set("GAME.dollars", lua.LNumber(100)); err != nil {
+		t.Fatalf("Set() error: %v", err)
+	}
+	if err := s.Set("GAME.missing.key", lua.LTrue); err == nil {
+		t.Errorf("expected error setting through a missing table, got nil")
+	}
+
+	var buf bytes.Buffer
+	if err := s.Store(&buf); err != nil {
+		t.Fatalf("Store() error: %v", err)
+	}
+	reloaded := NewSave()
+	if err := reloaded.Load(&buf); err != nil {
+		t.Fatalf("Load() of stored save error: %v", err)
+	}
+	if dollars, _ := reloaded.GetNumber("GAME.dollars"); dollars != 100 {
+		t.Errorf("got GAME.dollars %v after Store; want 100", dollars)
+	}
+	if !Equal(reloaded.Table, s.Table) {
+		t.Errorf("reloaded save differs from the stored one")
+	}
+
+	if err := reloaded.Load(bytes.NewReader([]byte("not flate"))); err == nil {
+		t.Errorf("expected error loading garbage, got nil")
+	}
+	if !Equal(reloaded.Table, s.Table) {
+		t.Errorf("failed Load() replaced the table")
+	}
+}
@@ -0,0 +1,178 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"io"
+	"strconv"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// KeyInfo describes a single key of a table and the type of its value.
+type KeyInfo struct {
+	Key  lua.LValue
+	Type lua.LValueType
+}
+
+// TopLevelKeys lists the keys of the top-level table of a jkr stream in source
+// order, together with the type of their values. Nested tables are skipped
+// without being built, which makes this much cheaper than a full decode.
+// Keys written as nil are left out and a repeated key keeps its first
+// position.
+func TopLevelKeys(in io.Reader) ([]KeyInfo, error) {
+	zr := DecompressReader(in)
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{src: content, opts: newOptions(nil)}
+	parens, err := p.openTopLevel()
+	if err != nil {
+		return nil, err
+	}
+	// the top-level table counts towards the depth even though it is not
+	// skipped like the nested ones
+	p.depth = 1
+
+	var keys []KeyInfo
+	index := make(map[lua.LValue]int)
+	err = p.parseFields(func(key lua.LValue) error {
+		typ, err := p.skipValue()
+		if err != nil {
+			return err
+		}
+		i, seen := index[key]
+		switch {
+		case !seen && typ != lua.LTNil:
+			index[key] = len(keys)
+			keys = append(keys, KeyInfo{Key: key, Type: typ})
+		case seen && typ != lua.LTNil:
+			keys[i].Type = typ
+		case seen:
+			keys = append(keys[:i], keys[i+1:]...)
+			delete(index, key)
+			for k, j := range index {
+				if j > i {
+					index[k] = j - 1
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := p.closeTopLevel(parens); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ValidateStream checks that a jkr stream is structurally valid, with
+// balanced braces, brackets and quotes and a well-formed table constructor,
+// without building any tables. It returns the first violation as a
+// *SyntaxError carrying its offset into the decompressed source, or an error
+// from decompression. It is cheaper than a full decode for rejecting input,
+// but it is not a streaming check: the whole decompressed source is read into
+// memory before validation starts, so its memory use grows with the
+// decompressed size like Unmarshal's does.
+func ValidateStream(r io.Reader) error {
+	zr := DecompressReader(r)
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+
+	p := &parser{src: content, opts: newOptions(nil)}
+	parens, err := p.openTopLevel()
+	if err != nil {
+		return err
+	}
+	if _, err := p.skipValue(); err != nil {
+		return err
+	}
+	return p.closeTopLevel(parens)
+}
+
+// ReadPath returns the value at the dotted path in a jkr stream, such as
+// "GAME.dollars", or lua.LNil if there is none. Path segments are matched
+// like the rest of the package matches them, trying a string key before an
+// integer key. Only the tables along the path are descended into; every
+// sibling is skipped without being built, which makes targeted reads of a
+// large save much cheaper than a full decode.
+func ReadPath(r io.Reader, path string, opts ...Option) (lua.LValue, error) {
+	o := newOptions(opts)
+	zr := DecompressReader(limitInput(r, o))
+	defer zr.Close()
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{src: content, opts: o}
+	parens, err := p.openTopLevel()
+	if err != nil {
+		return nil, err
+	}
+	v, err := p.extract(splitPath(path))
+	if err != nil {
+		return nil, err
+	}
+	if err := p.closeTopLevel(parens); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// extract parses the value at the cursor if path is empty, and otherwise
+// looks up path inside it, skipping everything else
+func (p *parser) extract(path []string) (lua.LValue, error) {
+	if len(path) == 0 {
+		return p.parseValue()
+	}
+	p.skipSpace()
+	if p.pos >= len(p.src) || p.src[p.pos] != '{' {
+		_, err := p.skipValue()
+		return lua.LNil, err
+	}
+
+	p.depth++
+	defer func() { p.depth-- }()
+	if err := p.opts.checkDepth(p.depth); err != nil {
+		return nil, err
+	}
+
+	segment := path[0]
+	var numKey lua.LValue = lua.LNil
+	if i, err := strconv.Atoi(segment); err == nil {
+		numKey = lua.LNumber(i)
+	}
+	var byString, byNumber lua.LValue = lua.LNil, lua.LNil
+	err := p.parseFields(func(key lua.LValue) error {
+		var err error
+		switch key {
+		case lua.LString(segment):
+			byString, err = p.extract(path[1:])
+		case numKey:
+			byNumber, err = p.extract(path[1:])
+		default:
+			_, err = p.skipValue()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if byString != lua.LNil {
+		return byString, nil
+	}
+	return byNumber, nil
+}
@@ -0,0 +1,199 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestTopLevelKeys(t *testing.T) {
+	t.Parallel()
+
+	src := `return {["cardAreas"]={["deck"]={["cards"]={[1]={["label"]="}{\"",},},},},` +
+		`["GAME"]={["dollars"]=4,},["STATE"]=5,["VERSION"]="1.0.1o-FULL",` +
+		`["removed"]=true,["removed"]=nil,[1]=false,["STATE"]="five",}`
+
+	keys, err := TopLevelKeys(bytes.NewReader(compressLua(t, src)))
+	if err != nil {
+		t.Fatalf("TopLevelKeys() error: %v", err)
+	}
+	want := []KeyInfo{
+		{lua.LString("cardAreas"), lua.LTTable},
+		{lua.LString("GAME"), lua.LTTable},
+		{lua.LString("STATE"), lua.LTString},
+		{lua.LString("VERSION"), lua.LTString},
+		{lua.LNumber(1), lua.LTBool},
+	}
+	if !slices.Equal(keys, want) {
+		t.Errorf("got %v; want %v", keys, want)
+	}
+}
+
+func TestTopLevelKeysFixture(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to open fixture: %v", err)
+	}
+	defer f.Close()
+
+	keys, err := TopLevelKeys(f)
+	if err != nil {
+		t.Fatalf("TopLevelKeys() error: %v", err)
+	}
+	var got []string
+	for _, k := range keys {
+		got = append(got, k.Key.String())
+	}
+	slices.Sort(got)
+	if want := []string{"ACTION", "BACK", "BLIND", "GAME", "STATE", "VERSION", "cardAreas"}; !slices.Equal(got, want) {
+		t.Errorf("got keys %q; want %q", got, want)
+	}
+}
+
+func TestTopLevelKeysUnbalanced(t *testing.T) {
+	t.Parallel()
+
+	src := `return {["GAME"]={["dollars"]=4,["nested"]={},["STATE"]=5,}`
+	if _, err := TopLevelKeys(bytes.NewReader(compressLua(t, src))); err == nil {
+		t.Errorf("expected error for unbalanced table, got nil")
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		src       string
+		expectErr bool
+	}{
+		{"balanced", `return {["a"]={["b"]={1,2,"}{",},},["c"]=[[a]b]],}`, false},
+		{"empty", `return {}`, false},
+		{"unclosed table", `return {["a"]={["b"]=1,}`, true},
+		{"extra brace", `return {["a"]=1,}}`, true},
+		{"unclosed bracket", `return {["a"=1,}`, true},
+		{"unclosed string", `return {["a"]="b,}`, true},
+		{"missing value", `return {["a"]=,}`, true},
+		{"not a table", `return 42`, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := ValidateStream(bytes.NewReader(compressLua(t, test.src)))
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ValidateStream() error: %v", err)
+			}
+		})
+	}
+
+	var syntaxErr *SyntaxError
+	err := ValidateStream(bytes.NewReader(compressLua(t, `return {["a"]=1 ["b"]=2}`)))
+	if !errors.As(err, &syntaxErr) || syntaxErr.Offset != 16 {
+		t.Errorf("got %v; want a *SyntaxError at offset 16", err)
+	}
+}
+
+func TestReadPath(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	full, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+
+	for _, path := range []string{"GAME.dollars", "VERSION", "GAME", "cardAreas.jokers.cards.1", "GAME.missing", "VERSION.x", "missing"} {
+		t.Run(path, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := ReadPath(bytes.NewReader(data), path)
+			if err != nil {
+				t.Fatalf("ReadPath() error: %v", err)
+			}
+			want := lookupPath(full, path)
+			if wt, ok := want.(*lua.LTable); ok {
+				gt, ok := got.(*lua.LTable)
+				if !ok || !Equal(gt, wt) {
+					t.Errorf("got %v; want table equal to %v", got, want)
+				}
+				return
+			}
+			if got != want {
+				t.Errorf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReadPathKeys(t *testing.T) {
+	t.Parallel()
+
+	src := `return {["2"]="string",[2]="number",[3]="only number",["a"]={["b"]=1,},["a"]={["b"]=2,},["x"]="}"}`
+	tests := []struct {
+		path string
+		want lua.LValue
+	}{
+		{"2", lua.LString("string")},
+		{"3", lua.LString("only number")},
+		{"a.b", lua.LNumber(2)},
+		{"x", lua.LString("}")},
+	}
+
+	for _, test := range tests {
+		got, err := ReadPath(bytes.NewReader(compressLua(t, src)), test.path)
+		if err != nil {
+			t.Fatalf("ReadPath(%q) error: %v", test.path, err)
+		}
+		if got != test.want {
+			t.Errorf("ReadPath(%q) = %v; want %v", test.path, got, test.want)
+		}
+	}
+
+	if _, err := ReadPath(bytes.NewReader(compressLua(t, `return {["a"]={["b"]=1,}`)), "a.b"); err == nil {
+		t.Errorf("expected error for unbalanced input, got nil")
+	}
+}
+
+func BenchmarkReadPath(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		b.Fatalf("failed to read fixture: %v", err)
+	}
+	b.Run("ReadPath", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := ReadPath(bytes.NewReader(data), "GAME.dollars"); err != nil {
+				b.Fatalf("ReadPath() error: %v", err)
+			}
+		}
+	})
+	b.Run("Unmarshal", func(b *testing.B) {
+		for b.Loop() {
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				b.Fatalf("Unmarshal() error: %v", err)
+			}
+			lookupPath(&out, "GAME.dollars")
+		}
+	})
+}
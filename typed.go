@@ -0,0 +1,148 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"fmt"
+	"io"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// ValueKind is the kind of a Value.
+type ValueKind int
+
+const (
+	// KindNil is the kind of the zero Value.
+	KindNil ValueKind = iota
+	// KindString is the kind of a string, read with Value.Str.
+	KindString
+	// KindNumber is the kind of a number, read with Value.Num.
+	KindNumber
+	// KindBool is the kind of a boolean, read with Value.Bool.
+	KindBool
+	// KindTable is the kind of a table, read with Value.Table.
+	KindTable
+)
+
+func (k ValueKind) String() string {
+	switch k {
+	case KindNil:
+		return "nil"
+	case KindString:
+		return "string"
+	case KindNumber:
+		return "number"
+	case KindBool:
+		return "bool"
+	case KindTable:
+		return "table"
+	default:
+		return "unknown"
+	}
+}
+
+// A Value is a jkr value that can be consumed without the gopher-lua API. The
+// zero Value is nil.
+type Value struct {
+	kind   ValueKind
+	str    string
+	num    float64
+	b      bool
+	fields []Field
+}
+
+// A Field is a single key-value pair of a table Value.
+type Field struct {
+	Key, Value Value
+}
+
+// StringValue returns a Value for a string.
+func StringValue(s string) Value {
+	return Value{kind: KindString, str: s}
+}
+
+// NumberValue returns a Value for a number.
+func NumberValue(f float64) Value {
+	return Value{kind: KindNumber, num: f}
+}
+
+// BoolValue returns a Value for a boolean.
+func BoolValue(b bool) Value {
+	return Value{kind: KindBool, b: b}
+}
+
+// TableValue returns a Value for a table with the given fields, in order.
+func TableValue(fields ...Field) Value {
+	return Value{kind: KindTable, fields: fields}
+}
+
+// Kind returns the kind of v.
+func (v Value) Kind() ValueKind {
+	return v.kind
+}
+
+// Str returns the string held by v. It panics if v is not a string.
+func (v Value) Str() string {
+	v.mustBe(KindString, "Str")
+	return v.str
+}
+
+// Num returns the number held by v. It panics if v is not a number.
+func (v Value) Num() float64 {
+	v.mustBe(KindNumber, "Num")
+	return v.num
+}
+
+// Bool returns the boolean held by v. It panics if v is not a boolean.
+func (v Value) Bool() bool {
+	v.mustBe(KindBool, "Bool")
+	return v.b
+}
+
+// Table returns the fields of v. It panics if v is not a table.
+func (v Value) Table() []Field {
+	v.mustBe(KindTable, "Table")
+	return v.fields
+}
+
+func (v Value) mustBe(kind ValueKind, method string) {
+	if v.kind != kind {
+		panic(fmt.Sprintf("jkr: Value.%s called on %s value", method, v.kind))
+	}
+}
+
+// ReadValue decodes a jkr stream like UnmarshalRead and returns it as a table
+// Value, with fields in the deterministic key order Marshal writes them in.
+func ReadValue(r io.Reader, opts ...Option) (Value, error) {
+	var tbl lua.LTable
+	if err := UnmarshalRead(r, &tbl, opts...); err != nil {
+		return Value{}, err
+	}
+	return toValue(&tbl), nil
+}
+
+// toValue converts a decoded Lua value, which never holds a cycle
+func toValue(lv lua.LValue) Value {
+	switch lv := lv.(type) {
+	case lua.LString:
+		return StringValue(string(lv))
+	case lua.LNumber:
+		return NumberValue(float64(lv))
+	case lua.LBool:
+		return BoolValue(bool(lv))
+	case *lua.LTable:
+		entries := sortedEntries(lv)
+		fields := make([]Field, len(entries))
+		for i, en := range entries {
+			fields[i] = Field{toValue(en.key), toValue(en.value)}
+		}
+		return TableValue(fields...)
+	default:
+		return Value{}
+	}
+}
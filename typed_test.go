@@ -0,0 +1,93 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadValue(t *testing.T) {
+	t.Parallel()
+
+	data := compressLua(t, `return {["name"]="P1",["won"]=true,["dollars"]=4.5,`+
+		`["hands"]={"Pair","Flush"},[2]=false,}`)
+
+	got, err := ReadValue(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadValue() error: %v", err)
+	}
+	want := TableValue(
+		Field{NumberValue(2), BoolValue(false)},
+		Field{StringValue("dollars"), NumberValue(4.5)},
+		Field{StringValue("hands"), TableValue(
+			Field{NumberValue(1), StringValue("Pair")},
+			Field{NumberValue(2), StringValue("Flush")},
+		)},
+		Field{StringValue("name"), StringValue("P1")},
+		Field{StringValue("won"), BoolValue(true)},
+	)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+
+	if _, err := ReadValue(bytes.NewReader([]byte("not a jkr stream"))); err == nil {
+		t.Errorf("expected error for invalid stream, got nil")
+	}
+}
+
+func TestValueAccessors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		value Value
+		kind  ValueKind
+		get   func(Value) any
+		want  any
+	}{
+		{"string", StringValue("Joker"), KindString, func(v Value) any { return v.Str() }, "Joker"},
+		{"number", NumberValue(1.5), KindNumber, func(v Value) any { return v.Num() }, 1.5},
+		{"bool", BoolValue(true), KindBool, func(v Value) any { return v.Bool() }, true},
+		{"table", TableValue(Field{StringValue("a"), NumberValue(1)}), KindTable,
+			func(v Value) any { return v.Table() }, []Field{{StringValue("a"), NumberValue(1)}}},
+		{"nil", Value{}, KindNil, nil, nil},
+	}
+
+	accessors := map[ValueKind]func(Value){
+		KindString: func(v Value) { v.Str() },
+		KindNumber: func(v Value) { v.Num() },
+		KindBool:   func(v Value) { v.Bool() },
+		KindTable:  func(v Value) { v.Table() },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := test.value.Kind(); got != test.kind {
+				t.Errorf("got kind %v; want %v", got, test.kind)
+			}
+			if test.get != nil {
+				if got := test.get(test.value); !reflect.DeepEqual(got, test.want) {
+					t.Errorf("got %v; want %v", got, test.want)
+				}
+			}
+			for kind, access := range accessors {
+				if kind == test.kind {
+					continue
+				}
+				func() {
+					defer func() {
+						if recover() == nil {
+							t.Errorf("expected panic accessing %v value as %v", test.kind, kind)
+						}
+					}()
+					access(test.value)
+				}()
+			}
+		})
+	}
+}
@@ -8,41 +8,194 @@ package jkr
 
 import (
 	"bytes"
-	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"strings"
+	"io/fs"
+	"os"
 
 	lua "github.com/yuin/gopher-lua"
 )
 
-func Unmarshal(in []byte, out *lua.LTable) (err error) {
+func Unmarshal(in []byte, out *lua.LTable, opts ...Option) (err error) {
 	br := bytes.NewReader(in)
-	return UnmarshalRead(br, out)
+	return UnmarshalRead(br, out, opts...)
 }
 
-func UnmarshalRead(in io.Reader, out *lua.LTable) (err error) {
-	zr := flate.NewReader(in)
+func UnmarshalRead(in io.Reader, out *lua.LTable, opts ...Option) (err error) {
+	return unmarshalRead(context.Background(), in, out, newOptions(opts))
+}
+
+// ReadContext decodes a jkr stream like UnmarshalRead, but gives up once ctx
+// is done, returning ErrTimeout if its deadline passed and ctx's error
+// otherwise.
+func ReadContext(ctx context.Context, r io.Reader, opts ...Option) (*lua.LTable, error) {
+	out := &lua.LTable{}
+	if err := unmarshalRead(ctx, r, out, newOptions(opts)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func unmarshalRead(ctx context.Context, in io.Reader, out *lua.LTable, o options) error {
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+
+	zr := DecompressReader(limitInput(withContext(ctx, in), o))
 	defer zr.Close()
 
 	content, err := io.ReadAll(zr)
+	if err == nil {
+		err = decodeContext(ctx, content, out, o)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+	return err
+}
+
+// withContext makes reads from r fail once ctx is done. Readers that
+// implement io.ByteReader are returned as they are, since flate reads them
+// byte by byte without buffering ahead, which must be preserved for streams
+// holding several tables; the parser still checks ctx for those.
+func withContext(ctx context.Context, r io.Reader) io.Reader {
+	if _, ok := r.(io.ByteReader); ok || ctx.Done() == nil {
+		return r
+	}
+	return contextReader{ctx, r}
+}
+
+// contextReader fails reads once ctx is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// ReadWithSource decodes a jkr stream and also returns its decompressed Lua
+// source, decompressing only once.
+func ReadWithSource(r io.Reader, opts ...Option) (*lua.LTable, []byte, error) {
+	o := newOptions(opts)
+	zr := DecompressReader(limitInput(r, o))
+	defer zr.Close()
+
+	content, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out := &lua.LTable{}
+	if err := decode(content, out, o); err != nil {
+		return nil, nil, err
+	}
+	return out, content, nil
+}
+
+// ReadPlain decodes uncompressed Lua source, such as the plaintext
+// return {...} some old or modded setups store, without going through flate.
+func ReadPlain(r io.Reader, opts ...Option) (*lua.LTable, error) {
+	content, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	l := lua.NewState()
-	defer l.Close()
-	if err := l.DoString(fmt.Sprintf("zw_data = (%s)", strings.TrimPrefix(string(content), "return "))); err != nil {
-		return err
+	out := &lua.LTable{}
+	if err := decode(content, out, newOptions(opts)); err != nil {
+		return nil, err
 	}
+	return out, nil
+}
 
-	zwData, ok := l.GetGlobal("zw_data").(*lua.LTable)
-	if !ok {
-		return errors.New("unable to typecast as lua.LTable")
+// ReadWithDefaults decodes a jkr stream and merges it over defaults with
+// Merge, so that keys missing from the stream are filled in from defaults
+// while keys present in the stream win. defaults is not modified.
+func ReadWithDefaults(r io.Reader, defaults *lua.LTable, opts ...Option) (*lua.LTable, error) {
+	var tbl lua.LTable
+	if err := UnmarshalRead(r, &tbl, opts...); err != nil {
+		return nil, err
 	}
+	return Merge(defaults, &tbl), nil
+}
 
-	*out = *zwData
+// ReadFile reads and decodes the named jkr file.
+func ReadFile(name string, opts ...Option) (*lua.LTable, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	return err
+	out := &lua.LTable{}
+	if err := UnmarshalRead(f, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReadFS reads and decodes the named jkr file from fsys, such as an embed.FS.
+func ReadFS(fsys fs.FS, name string, opts ...Option) (*lua.LTable, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := &lua.LTable{}
+	if err := UnmarshalRead(f, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Decompress returns the decompressed Lua source of a jkr file.
+func Decompress(in []byte) ([]byte, error) {
+	zr := DecompressReader(bytes.NewReader(in))
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// DecompressReader returns a reader that lazily yields the decompressed Lua
+// source of a jkr stream, including its leading "return ".
+//
+// Balatro writes raw deflate data, but a stream wrapped in a zlib or gzip
+// container, as some sync and backup tools store copies, is detected by its
+// header and unwrapped transparently.
+func DecompressReader(in io.Reader) io.ReadCloser {
+	return &decompressReader{in: in}
+}
+
+// limitInput applies the WithMaxCompressedSize limit to in
+func limitInput(in io.Reader, o options) io.Reader {
+	if o.maxCompressed <= 0 {
+		return in
+	}
+	// allow one byte past the limit so that exceeding it can be told apart
+	// from ending exactly on it
+	return &sizeLimitReader{r: io.LimitReader(in, o.maxCompressed+1), max: o.maxCompressed}
+}
+
+// sizeLimitReader fails once more than max bytes have been read from r
+type sizeLimitReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.max {
+		return 0, fmt.Errorf("%w: more than %d bytes", ErrCompressedSizeExceeded, l.max)
+	}
+	return n, err
 }
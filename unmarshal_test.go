@@ -6,7 +6,16 @@ package jkr
 import (
 	"bytes"
 	"compress/flate"
+	"context"
+	"embed"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
 )
@@ -147,3 +156,558 @@ func deepEquals(L *lua.LState, a, b *lua.LTable) bool {
 	L.Pop(1)
 	return res
 }
+
+func TestDecompressReader(t *testing.T) {
+	t.Parallel()
+
+	const source = `return {["foo"]="bar",["nested"]={[1]=42,},}`
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("failed to create flate writer: %v", err)
+	}
+	if _, err := w.Write([]byte(source)); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	w.Close()
+
+	r := DecompressReader(&buf)
+	defer r.Close()
+
+	var out strings.Builder
+	if _, err := io.Copy(&out, r); err != nil {
+		t.Fatalf("io.Copy error: %v", err)
+	}
+	if got := out.String(); got != source {
+		t.Errorf("got %q; want %q", got, source)
+	}
+}
+
+func TestUnmarshalFixtures(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		file  string
+		key   string
+		value lua.LValue
+	}{
+		{"settings.jkr", "language", lua.LString("en-us")},
+		{"meta.jkr", "unlocked", nil},
+		{"profile.jkr", "name", lua.LString("P1")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := os.ReadFile(filepath.Join("testdata", test.file))
+			if err != nil {
+				t.Fatalf("failed to read fixture %q: %v", test.file, err)
+			}
+
+			var out lua.LTable
+			if err := Unmarshal(data, &out); err != nil {
+				t.Fatalf("Unmarshal() error for %q: %v", test.file, err)
+			}
+
+			got := out.RawGetString(test.key)
+			if test.value == nil {
+				if got.Type() != lua.LTTable {
+					t.Errorf("got %s for key %q; want table", got.Type(), test.key)
+				}
+				return
+			}
+			if got != test.value {
+				t.Errorf("got %v for key %q; want %v", got, test.key, test.value)
+			}
+		})
+	}
+}
+
+func TestUnmarshalNotATable(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("failed to create flate writer: %v", err)
+	}
+	if _, err := w.Write([]byte(`return "1.0.1o-FULL"`)); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	w.Close()
+
+	var out lua.LTable
+	err = Unmarshal(buf.Bytes(), &out)
+	if !errors.Is(err, ErrNotATable) {
+		t.Fatalf("got error %v; want %v", err, ErrNotATable)
+	}
+	if !strings.Contains(err.Error(), "string") {
+		t.Errorf("error %q does not name the top-level type", err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if got := tbl.RawGetString("VERSION"); got != lua.LString("1.0.1o-FULL") {
+		t.Errorf("got VERSION %v; want %q", got, "1.0.1o-FULL")
+	}
+
+	if _, err := ReadFile(filepath.Join("testdata", "missing.jkr")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got error %v; want %v", err, os.ErrNotExist)
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	data, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		b.Fatalf("failed to read fixture: %v", err)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var out lua.LTable
+		if err := Unmarshal(data, &out); err != nil {
+			b.Fatalf("Unmarshal() error: %v", err)
+		}
+	}
+}
+
+func BenchmarkReadFile(b *testing.B) {
+	name := filepath.Join("testdata", "save.jkr")
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := ReadFile(name); err != nil {
+			b.Fatalf("ReadFile() error: %v", err)
+		}
+	}
+}
+
+func TestUnmarshalNilKeys(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("failed to create flate writer: %v", err)
+	}
+	if _, err := w.Write([]byte(`return {["x"]=nil,["y"]=1,["nested"]={["z"]=nil,},}`)); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	w.Close()
+
+	keys := NilKeys{}
+	var out lua.LTable
+	if err := Unmarshal(buf.Bytes(), &out, WithNilKeys(keys)); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+
+	if got := out.RawGetString("x"); got != lua.LNil {
+		t.Errorf("got %v for key %q; want nil", got, "x")
+	}
+	if !keys.Has(&out, lua.LString("x")) {
+		t.Errorf("key %q was not recorded as explicitly nil", "x")
+	}
+	if keys.Has(&out, lua.LString("y")) {
+		t.Errorf("key %q was recorded as explicitly nil", "y")
+	}
+	if keys.Has(&out, lua.LString("absent")) {
+		t.Errorf("key %q was recorded as explicitly nil", "absent")
+	}
+	nested := out.RawGetString("nested").(*lua.LTable)
+	if !keys.Has(nested, lua.LString("z")) {
+		t.Errorf("nested key %q was not recorded as explicitly nil", "z")
+	}
+}
+
+func TestUnmarshalBOMAndCRLF(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		lua  string
+	}{
+		{"leading BOM", "\xEF\xBB\xBFreturn {[\"foo\"]=\"bar\",[1]=42,}"},
+		{"CRLF around tokens", "return\r\n{\r\n[\"foo\"]\r\n=\r\n\"bar\"\r\n,\r\n[1]=42\r\n}\r\n"},
+		{"BOM and CRLF", "\xEF\xBB\xBFreturn {\r\n[\"foo\"]=\"bar\",\r\n[1]=42,\r\n}\r\n"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out lua.LTable
+			if err := Unmarshal(compressLua(t, test.lua), &out); err != nil {
+				t.Fatalf("Unmarshal() error for %q: %v", test.name, err)
+			}
+			if got := out.RawGetString("foo"); got != lua.LString("bar") {
+				t.Errorf("got %v for key %q; want %q", got, "foo", "bar")
+			}
+			if got := out.RawGetInt(1); got != lua.LNumber(42) {
+				t.Errorf("got %v for key 1; want 42", got)
+			}
+		})
+	}
+}
+
+// compressLua deflates Lua source the way Balatro does
+func compressLua(t testing.TB, src string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		t.Fatalf("failed to create flate writer: %v", err)
+	}
+	if _, err := w.Write([]byte(src)); err != nil {
+		t.Fatalf("failed to write data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close flate writer: %v", err)
+	}
+	return buf.Bytes()
+}
+
+//go:embed testdata
+var testdataFS embed.FS
+
+func TestReadFS(t *testing.T) {
+	t.Parallel()
+
+	tbl, err := ReadFS(testdataFS, "testdata/settings.jkr")
+	if err != nil {
+		t.Fatalf("ReadFS() error: %v", err)
+	}
+	if got := tbl.RawGetString("language"); got != lua.LString("en-us") {
+		t.Errorf("got language %v; want %q", got, "en-us")
+	}
+
+	if _, err := ReadFS(testdataFS, "testdata/missing.jkr"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v; want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestReadWithSource(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "profile.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	tbl, src, err := ReadWithSource(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ReadWithSource() error: %v", err)
+	}
+	want, err := Decompress(data)
+	if err != nil {
+		t.Fatalf("Decompress() error: %v", err)
+	}
+	if !bytes.Equal(src, want) {
+		t.Errorf("got source %q; want %q", src, want)
+	}
+
+	var out lua.LTable
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !deepEquals(L, tbl, &out) {
+		t.Errorf("ReadWithSource() table differs from Unmarshal()")
+	}
+}
+
+func TestReadPlain(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	src := `return {["foo"]="bar",["n"]=42,["nested"]={[1]=true,},}`
+	tbl, err := ReadPlain(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("ReadPlain() error: %v", err)
+	}
+
+	var want lua.LTable
+	if err := Unmarshal(compressLua(t, src), &want); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if !deepEquals(L, tbl, &want) {
+		t.Errorf("ReadPlain() table differs from Unmarshal() of the same source")
+	}
+
+	if _, err := ReadPlain(bytes.NewReader(compressLua(t, src))); err == nil {
+		t.Errorf("ReadPlain() accepted compressed input")
+	}
+}
+
+func TestUnmarshalMaxCompressedSize(t *testing.T) {
+	t.Parallel()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		limit     int64
+		expectErr bool
+	}{
+		{"no limit", 0, false},
+		{"exactly at limit", int64(len(data)), false},
+		{"one byte over", int64(len(data)) - 1, true},
+		{"far over", 16, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out lua.LTable
+			err := Unmarshal(data, &out, WithMaxCompressedSize(test.limit))
+			if test.expectErr != errors.Is(err, ErrCompressedSizeExceeded) {
+				t.Errorf("got error %v; want ErrCompressedSizeExceeded %t", err, test.expectErr)
+			}
+			if !test.expectErr && err != nil {
+				t.Errorf("Unmarshal() error: %v", err)
+			}
+		})
+	}
+}
+
+func TestReadWithDefaults(t *testing.T) {
+	t.Parallel()
+
+	defaults := compileTable(t, `return {["GAME"]={["dollars"]=4,["stake"]=1,},["STATE"]=1,}`)
+	src := `return {["GAME"]={["dollars"]=25,},["VERSION"]="1.0.1o-FULL",}`
+
+	got, err := ReadWithDefaults(bytes.NewReader(compressLua(t, src)), defaults)
+	if err != nil {
+		t.Fatalf("ReadWithDefaults() error: %v", err)
+	}
+	want := compileTable(t, `return {["GAME"]={["dollars"]=25,["stake"]=1,},["STATE"]=1,["VERSION"]="1.0.1o-FULL",}`)
+	if !Equal(got, want) {
+		data, _ := Serialize(got)
+		t.Errorf("got %s", data)
+	}
+
+	if _, err := ReadWithDefaults(bytes.NewReader([]byte("not flate")), defaults); err == nil {
+		t.Errorf("expected error for invalid input, got nil")
+	}
+}
+
+func TestUnmarshalOptionalReturn(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		src       string
+		expectErr bool
+	}{
+		{"with return", `return {["a"]=1,[1]="x",}`, false},
+		{"bare table", `{["a"]=1,[1]="x",}`, false},
+		{"bare with comment", "-- header\n{[\"a\"]=1,[1]=\"x\",}", false},
+		{"return without space", `return{["a"]=1,[1]="x",}`, false},
+		{"return only", `return`, true},
+		{"misspelled return", `returns {["a"]=1,}`, true},
+		{"return twice", `return return {["a"]=1,}`, true},
+		{"parenthesized", `return ({["a"]=1,[1]="x",})`, false},
+		{"parenthesized without return", `({["a"]=1,[1]="x",})`, false},
+		{"nested parentheses", "return ( ( {[\"a\"]=1,[1]=\"x\",} ) );\n", false},
+		{"unclosed parenthesis", `return ({["a"]=1,[1]="x",}`, true},
+		{"extra closing parenthesis", `return ({["a"]=1,[1]="x",}))`, true},
+	}
+
+	want := newTable()
+	want.RawSetString("a", lua.LNumber(1))
+	want.RawSetInt(1, lua.LString("x"))
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			var out lua.LTable
+			err := Unmarshal(compressLua(t, test.src), &out)
+			if test.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unmarshal() error: %v", err)
+			}
+			if !Equal(&out, want) {
+				t.Errorf("got a different table for %q", test.src)
+			}
+		})
+	}
+}
+
+func TestReadContext(t *testing.T) {
+	t.Parallel()
+
+	big, err := Marshal(wideTable(100, 100))
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+
+	t.Run("infinite loop payload", func(t *testing.T) {
+		t.Parallel()
+
+		for _, src := range []string{
+			`while true do end return {}`,
+			`return {(function() while true do end end)()}`,
+		} {
+			_, err := ReadContext(context.Background(), bytes.NewReader(compressLua(t, src)), WithTimeout(time.Second))
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Errorf("got %v for %q; want a *SyntaxError", err, src)
+			}
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		t.Parallel()
+
+		var out lua.LTable
+		if err := Unmarshal(big, &out, WithTimeout(time.Nanosecond)); !errors.Is(err, ErrTimeout) {
+			t.Errorf("got %v; want ErrTimeout", err)
+		}
+		if err := Unmarshal(big, &out, WithTimeout(time.Minute)); err != nil {
+			t.Errorf("Unmarshal() error: %v", err)
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+		defer cancel()
+		// hide io.ByteReader so that decompression checks the context too
+		r := struct{ io.Reader }{bytes.NewReader(big)}
+		if _, err := ReadContext(ctx, r); !errors.Is(err, ErrTimeout) || !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v; want ErrTimeout", err)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := ReadContext(ctx, bytes.NewReader(big)); !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v; want context.Canceled", err)
+		}
+	})
+
+	t.Run("no deadline", func(t *testing.T) {
+		t.Parallel()
+
+		tbl, err := ReadContext(context.Background(), bytes.NewReader(big))
+		if err != nil {
+			t.Fatalf("ReadContext() error: %v", err)
+		}
+		if !Equal(tbl, wideTable(100, 100)) {
+			t.Errorf("ReadContext() table differs from the marshaled one")
+		}
+	})
+}
+
+func TestUnmarshalErrorLayers(t *testing.T) {
+	t.Parallel()
+
+	valid := compressLua(t, `return {["a"]=1,}`)
+	tests := []struct {
+		name string
+		in   []byte
+		want error
+	}{
+		{"not flate", []byte("not a jkr file"), ErrDecompress},
+		{"empty", nil, ErrDecompress},
+		{"truncated", valid[:len(valid)/2], ErrDecompress},
+		{"gzip header only", []byte{0x1f, 0x8b, 0x08}, ErrDecompress},
+		{"garbage Lua", compressLua(t, `return {["a"]=`), ErrParse},
+		{"not a table", compressLua(t, `return "x"`), ErrParse},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			other := ErrParse
+			if test.want == ErrParse {
+				other = ErrDecompress
+			}
+
+			var out lua.LTable
+			err := Unmarshal(test.in, &out)
+			if !errors.Is(err, test.want) || errors.Is(err, other) {
+				t.Errorf("Unmarshal() got %v; want only %v", err, test.want)
+			}
+			_, err = NewReader(bytes.NewReader(test.in)).Read()
+			if len(test.in) == 0 {
+				// an empty input holds no stream at all for a Reader
+				if err != io.EOF {
+					t.Errorf("Read() got %v; want io.EOF", err)
+				}
+				return
+			}
+			if !errors.Is(err, test.want) || errors.Is(err, other) {
+				t.Errorf("Read() got %v; want only %v", err, test.want)
+			}
+		})
+	}
+
+	if err := Unmarshal(compressLua(t, `return "x"`), &lua.LTable{}); !errors.Is(err, ErrNotATable) {
+		t.Errorf("got %v; want ErrNotATable", err)
+	}
+}
+
+// FuzzRoundTrip checks that any input Unmarshal accepts marshals back to a
+// table that decodes equal to the first. Each input is tried both as a jkr
+// file and as the source inside one, since mutated deflate data rarely gets
+// as far as the parser.
+func FuzzRoundTrip(f *testing.F) {
+	for _, name := range []string{"save.jkr", "profile.jkr", "meta.jkr", "settings.jkr"} {
+		data, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatalf("failed to read %s: %v", name, err)
+		}
+		f.Add(data)
+		content, err := io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+		if err != nil {
+			f.Fatalf("failed to decompress %s: %v", name, err)
+		}
+		f.Add(content)
+	}
+	f.Add([]byte(`return {["a"]={1,2,3},[1]="\x00\\",[-2.5e-3]=true,}`))
+	f.Add([]byte(`return {1e400,[-1e400]=-0,["s"]=[[long]],}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, in := range [][]byte{data, compressLua(t, string(data))} {
+			var first lua.LTable
+			if err := Unmarshal(in, &first); err != nil {
+				continue
+			}
+			out, err := Marshal(&first)
+			if err != nil {
+				t.Fatalf("Marshal() error after Unmarshal: %v", err)
+			}
+			var second lua.LTable
+			if err := Unmarshal(out, &second); err != nil {
+				t.Fatalf("Unmarshal() error on marshaled table: %v", err)
+			}
+			if !Equal(&first, &second) {
+				t.Fatalf("table differs after round trip:\n%s", decompress(t, out))
+			}
+		}
+	})
+}
@@ -0,0 +1,52 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"fmt"
+	"slices"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Schema maps dotted paths such as "GAME.dollars" to the type the value at
+// that path must have. Every listed path is required.
+type Schema map[string]lua.LValueType
+
+// SchemaError describes a value that does not match its Schema entry. Got is
+// lua.LTNil when the path is missing.
+type SchemaError struct {
+	Path string
+	Want lua.LValueType
+	Got  lua.LValueType
+}
+
+func (e *SchemaError) Error() string {
+	if e.Got == lua.LTNil {
+		return fmt.Sprintf("jkr: %s: missing, want %s", e.Path, e.Want)
+	}
+	return fmt.Sprintf("jkr: %s: got %s, want %s", e.Path, e.Got, e.Want)
+}
+
+// Validate checks tbl against schema and returns every violation, ordered by
+// path. It returns nil if tbl conforms.
+func Validate(tbl *lua.LTable, schema Schema) []error {
+	paths := make([]string, 0, len(schema))
+	for path := range schema {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+
+	var errs []error
+	for _, path := range paths {
+		want := schema[path]
+		if got := lookupPath(tbl, path).Type(); got != want {
+			errs = append(errs, &SchemaError{Path: path, Want: want, Got: got})
+		}
+	}
+	return errs
+}
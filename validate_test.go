@@ -0,0 +1,88 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"errors"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	schema := Schema{
+		"GAME.dollars":             lua.LTNumber,
+		"GAME.pseudorandom.seed":   lua.LTString,
+		"cardAreas.jokers.cards":   lua.LTTable,
+		"cardAreas.jokers.cards.1": lua.LTTable,
+		"VERSION":                  lua.LTString,
+	}
+
+	tests := []struct {
+		name     string
+		setup    func(*lua.LState) *lua.LTable
+		expected []SchemaError
+	}{
+		{
+			"conforming",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				game := L.NewTable()
+				game.RawSetString("dollars", lua.LNumber(4))
+				pseudorandom := L.NewTable()
+				pseudorandom.RawSetString("seed", lua.LString("ABCD1234"))
+				game.RawSetString("pseudorandom", pseudorandom)
+				tbl.RawSetString("GAME", game)
+				cards := L.NewTable()
+				cards.RawSetInt(1, L.NewTable())
+				jokers := L.NewTable()
+				jokers.RawSetString("cards", cards)
+				areas := L.NewTable()
+				areas.RawSetString("jokers", jokers)
+				tbl.RawSetString("cardAreas", areas)
+				tbl.RawSetString("VERSION", lua.LString("1.0.1o-FULL"))
+				return tbl
+			}, nil},
+		{
+			"non-conforming",
+			func(L *lua.LState) *lua.LTable {
+				tbl := L.NewTable()
+				game := L.NewTable()
+				game.RawSetString("dollars", lua.LString("4"))
+				game.RawSetString("pseudorandom", lua.LString("ABCD1234"))
+				tbl.RawSetString("GAME", game)
+				return tbl
+			}, []SchemaError{
+				{"GAME.dollars", lua.LTNumber, lua.LTString},
+				{"GAME.pseudorandom.seed", lua.LTString, lua.LTNil},
+				{"VERSION", lua.LTString, lua.LTNil},
+				{"cardAreas.jokers.cards", lua.LTTable, lua.LTNil},
+				{"cardAreas.jokers.cards.1", lua.LTTable, lua.LTNil},
+			}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			L := lua.NewState()
+			defer L.Close()
+
+			errs := Validate(test.setup(L), schema)
+			if len(errs) != len(test.expected) {
+				t.Fatalf("got %d errors %v; want %d", len(errs), errs, len(test.expected))
+			}
+			for i, err := range errs {
+				var serr *SchemaError
+				if !errors.As(err, &serr) {
+					t.Fatalf("got error %v; want *SchemaError", err)
+				}
+				if *serr != test.expected[i] {
+					t.Errorf("got %+v; want %+v", *serr, test.expected[i])
+				}
+			}
+		})
+	}
+}
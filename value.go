@@ -0,0 +1,724 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// An UnmarshalTypeError describes a Lua value that cannot be stored in a Go
+// value of a specific type.
+type UnmarshalTypeError struct {
+	Value string       // Lua type of the value, such as "string"
+	Type  reflect.Type // Go type it could not be assigned to
+	Path  string       // dotted path of the value
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("jkr: cannot unmarshal %s into Go value of type %s", e.Value, e.Type)
+	}
+	return fmt.Sprintf("jkr: cannot unmarshal %s into Go value of type %s at %s", e.Value, e.Type, e.Path)
+}
+
+var (
+	luaValueType = reflect.TypeFor[lua.LValue]()
+	luaTableType = reflect.TypeFor[*lua.LTable]()
+	timeType     = reflect.TypeFor[time.Time]()
+	bytesType    = reflect.TypeFor[[]byte]()
+)
+
+// TimeFormat selects how MarshalValue writes time.Time values.
+type TimeFormat int
+
+const (
+	// TimeUnix writes times as a number of seconds since the Unix epoch, with
+	// any sub-second part as a fraction. Lua numbers are float64, so the
+	// fraction only keeps about microsecond precision.
+	TimeUnix TimeFormat = iota
+	// TimeRFC3339 writes times as an RFC 3339 string with nanoseconds.
+	TimeRFC3339
+)
+
+// WithTimeFormat sets how MarshalValue writes time.Time values. The default
+// is TimeUnix. UnmarshalValue accepts both forms regardless.
+func WithTimeFormat(format TimeFormat) Option {
+	return func(o *options) {
+		o.timeFormat = format
+	}
+}
+
+// UnmarshalValue decodes a jkr file into the Go value pointed to by v.
+//
+// Tables decode into structs, maps, slices and arrays, strings into strings,
+// numbers into any integer or floating point type that can hold them exactly
+// and booleans into bools. Struct fields are matched by the name in their jkr
+// tag, or by their Go name if they have none, and fields tagged "-" are
+// skipped. Keys without a matching field are ignored. Slices and arrays are
+// filled from the integer keys 1..n, which must have no holes. An empty interface receives a string,
+// float64, bool, []any for array tables or map[string]any for other tables.
+// Fields of type lua.LValue or *lua.LTable receive the raw Lua value. A
+// []byte receives the bytes of a string and a time.Time is read from either
+// Unix seconds or an RFC 3339 string.
+func UnmarshalValue(in []byte, v any, opts ...Option) error {
+	var tbl lua.LTable
+	if err := Unmarshal(in, &tbl, opts...); err != nil {
+		return err
+	}
+	return tableToValue(&tbl, v, newOptions(opts))
+}
+
+// Decode decodes a jkr file into a new value of type T.
+func Decode[T any](in []byte, opts ...Option) (T, error) {
+	var v T
+	err := UnmarshalValue(in, &v, opts...)
+	return v, err
+}
+
+// MarshalValue encodes the Go value v as a jkr file.
+//
+// Structs, maps, slices and arrays encode as tables, strings as strings,
+// integer and floating point numbers as numbers and bools as booleans. Struct
+// fields use the name in their jkr tag, or their Go name if they have none.
+// Fields tagged "-" are skipped, and fields tagged with the omitempty option
+// are skipped when they hold their zero value. Slices and arrays use the
+// integer keys 1..n, and map keys must be strings or numbers. Nil pointers,
+// maps, slices and interfaces encode as nil and therefore drop their key.
+// Values of type lua.LValue are written as they are, a []byte is written as
+// a string and a time.Time is written according to WithTimeFormat. v must
+// encode to a table. With WithExplicitNil, nil fields and map entries keep
+// their key.
+func MarshalValue(v any, opts ...Option) ([]byte, error) {
+	o := newOptions(opts)
+	if o.explicitNil && o.nilKeys == nil {
+		// collect the nil keys for Marshal to write
+		o.nilKeys = make(NilKeys)
+		opts = append(slices.Clip(opts), WithNilKeys(o.nilKeys))
+	}
+	tbl, err := valueToTable(v, o)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(tbl, opts...)
+}
+
+// Encode encodes v as a jkr file. It is the generic counterpart of Decode.
+func Encode[T any](v T, opts ...Option) ([]byte, error) {
+	return MarshalValue(v, opts...)
+}
+
+// WithTypeHook registers how MarshalValue writes values of type t, for types
+// the default mapping does not know about. The hook receives the value and
+// returns the Lua value to write in its place.
+func WithTypeHook(t reflect.Type, hook func(any) (lua.LValue, error)) Option {
+	return func(o *options) {
+		if o.encodeHooks == nil {
+			o.encodeHooks = make(map[reflect.Type]func(any) (lua.LValue, error))
+		}
+		o.encodeHooks[t] = hook
+	}
+}
+
+// WithUnmarshalTypeHook registers how UnmarshalValue reads values of type t.
+// The hook receives the Lua value, which is never nil, and must return a
+// value assignable to t. It is the counterpart of WithTypeHook.
+func WithUnmarshalTypeHook(t reflect.Type, hook func(lua.LValue) (any, error)) Option {
+	return func(o *options) {
+		if o.decodeHooks == nil {
+			o.decodeHooks = make(map[reflect.Type]func(lua.LValue) (any, error))
+		}
+		o.decodeHooks[t] = hook
+	}
+}
+
+// WithDisallowUnknownFields makes UnmarshalValue fail when a table decoded
+// into a struct has a key that no field of the struct maps to. By default
+// such keys are ignored, since saves hold far more keys than most callers
+// need.
+func WithDisallowUnknownFields() Option {
+	return func(o *options) {
+		o.disallowUnknown = true
+	}
+}
+
+// valueToTable converts the Go value v into a table
+func valueToTable(v any, o options) (*lua.LTable, error) {
+	e := &valueEncoder{opts: o, visited: make(map[uintptr]bool)}
+	lv, err := e.encode(reflect.ValueOf(v), nil)
+	if err != nil {
+		return nil, err
+	}
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %s", ErrNotATable, lv.Type())
+	}
+	return tbl, nil
+}
+
+// An UnsupportedTypeError is returned by MarshalValue when a Go value of an
+// unsupported type is encountered.
+type UnsupportedTypeError struct {
+	Type reflect.Type
+	Path string
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("jkr: unsupported type %s", e.Type)
+	}
+	return fmt.Sprintf("jkr: unsupported type %s at %s", e.Type, e.Path)
+}
+
+// valueEncoder holds the state of a single reflection encode
+type valueEncoder struct {
+	opts    options
+	visited map[uintptr]bool
+}
+
+func (e *valueEncoder) encode(rv reflect.Value, path []string) (lua.LValue, error) {
+	if !rv.IsValid() {
+		return lua.LNil, nil
+	}
+	if hook, ok := e.opts.encodeHooks[rv.Type()]; ok {
+		lv, err := hook(rv.Interface())
+		if err != nil {
+			return nil, fmt.Errorf("jkr: type hook for %s at %s: %w", rv.Type(), strings.Join(path, "."), err)
+		}
+		return lv, nil
+	}
+	if rv.Type().Implements(luaValueType) {
+		if (rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface) && rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return rv.Interface().(lua.LValue), nil
+	}
+
+	switch rv.Type() {
+	case timeType:
+		return e.encodeTime(rv.Interface().(time.Time)), nil
+	case bytesType:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return lua.LString(rv.Bytes()), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		if rv.Kind() == reflect.Pointer {
+			ptr := rv.Pointer()
+			if e.visited[ptr] {
+				return nil, fmt.Errorf("jkr: circular reference detected at %s", strings.Join(path, "."))
+			}
+			e.visited[ptr] = true
+			defer delete(e.visited, ptr)
+		}
+		return e.encode(rv.Elem(), path)
+	case reflect.String:
+		return lua.LString(rv.String()), nil
+	case reflect.Bool:
+		return lua.LBool(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		if e.opts.safeNumbers && (i > 1<<53 || i < -1<<53) {
+			return nil, fmt.Errorf("%w: %d at %s", ErrPrecisionLoss, i, strings.Join(path, "."))
+		}
+		return lua.LNumber(i), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if e.opts.safeNumbers && u > 1<<53 {
+			return nil, fmt.Errorf("%w: %d at %s", ErrPrecisionLoss, u, strings.Join(path, "."))
+		}
+		return lua.LNumber(u), nil
+	case reflect.Float32, reflect.Float64:
+		return lua.LNumber(rv.Float()), nil
+	case reflect.Struct:
+		return e.encodeStruct(rv, path)
+	case reflect.Map:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		ptr := rv.Pointer()
+		if e.visited[ptr] {
+			return nil, fmt.Errorf("jkr: circular reference detected at %s", strings.Join(path, "."))
+		}
+		e.visited[ptr] = true
+		defer delete(e.visited, ptr)
+		return e.encodeMap(rv, path)
+	case reflect.Slice:
+		if rv.IsNil() {
+			return lua.LNil, nil
+		}
+		return e.encodeSlice(rv, path)
+	case reflect.Array:
+		return e.encodeSlice(rv, path)
+	default:
+		return nil, &UnsupportedTypeError{Type: rv.Type(), Path: strings.Join(path, ".")}
+	}
+}
+
+// encodeTime writes t in the configured TimeFormat
+func (e *valueEncoder) encodeTime(t time.Time) lua.LValue {
+	if e.opts.timeFormat == TimeRFC3339 {
+		return lua.LString(t.Format(time.RFC3339Nano))
+	}
+	return lua.LNumber(float64(t.Unix()) + float64(t.Nanosecond())/1e9)
+}
+
+func (e *valueEncoder) encodeStruct(rv reflect.Value, path []string) (lua.LValue, error) {
+	tbl := newTable()
+	for _, f := range structFields(rv.Type()) {
+		fv, err := rv.FieldByIndexErr(f.index)
+		if err != nil {
+			// nil embedded pointer
+			continue
+		}
+		if f.omitEmpty && fv.IsZero() {
+			continue
+		}
+		lv, err := e.encode(fv, append(path, f.name))
+		if err != nil {
+			return nil, err
+		}
+		e.setField(tbl, lua.LString(f.name), lv)
+	}
+	return tbl, nil
+}
+
+func (e *valueEncoder) encodeMap(rv reflect.Value, path []string) (lua.LValue, error) {
+	tbl := newTable()
+	// in key order rather than Go's random map order, so that the error
+	// reported for several bad entries is always the same
+	keys := rv.MapKeys()
+	slices.SortFunc(keys, compareMapKeys)
+	for _, k := range keys {
+		key, err := e.encode(k, path)
+		if err != nil {
+			return nil, err
+		}
+		switch key.Type() {
+		case lua.LTString, lua.LTNumber:
+		default:
+			return nil, &UnsupportedTypeError{Type: rv.Type(), Path: strings.Join(path, ".")}
+		}
+		lv, err := e.encode(rv.MapIndex(k), append(path, key.String()))
+		if err != nil {
+			return nil, err
+		}
+		e.setField(tbl, key, lv)
+	}
+	return tbl, nil
+}
+
+// setField stores lv under key in tbl, recording the key if lv is nil and
+// WithExplicitNil is enabled
+func (e *valueEncoder) setField(tbl *lua.LTable, key, lv lua.LValue) {
+	if lv == lua.LNil && e.opts.explicitNil {
+		e.opts.nilKeys[tbl] = append(e.opts.nilKeys[tbl], key)
+		return
+	}
+	tbl.RawSet(key, lv)
+}
+
+// compareMapKeys orders Go map keys, numerically for numbers and by their
+// formatted text otherwise
+func compareMapKeys(a, b reflect.Value) int {
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return cmp.Compare(a.Uint(), b.Uint())
+	case reflect.Float32, reflect.Float64:
+		return cmp.Compare(a.Float(), b.Float())
+	case reflect.String:
+		return cmp.Compare(a.String(), b.String())
+	default:
+		return cmp.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+	}
+}
+
+func (e *valueEncoder) encodeSlice(rv reflect.Value, path []string) (lua.LValue, error) {
+	tbl := newTable()
+	for i := range rv.Len() {
+		lv, err := e.encode(rv.Index(i), append(path, strconv.Itoa(i+1)))
+		if err != nil {
+			return nil, err
+		}
+		tbl.RawSetInt(i+1, lv)
+	}
+	return tbl, nil
+}
+
+// tableToValue stores tbl in the Go value pointed to by v
+func tableToValue(tbl *lua.LTable, v any, o options) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return errors.New("jkr: UnmarshalValue requires a non-nil pointer")
+	}
+	d := &valueDecoder{opts: o}
+	return d.decode(tbl, rv.Elem(), nil)
+}
+
+// valueDecoder holds the state of a single reflection decode
+type valueDecoder struct {
+	opts options
+}
+
+func (d *valueDecoder) decode(lv lua.LValue, rv reflect.Value, path []string) error {
+	switch rv.Type() {
+	case luaValueType:
+		rv.Set(reflect.ValueOf(&lv).Elem())
+		return nil
+	case luaTableType:
+		if tbl, ok := lv.(*lua.LTable); ok {
+			rv.Set(reflect.ValueOf(tbl))
+			return nil
+		}
+		return d.typeError(lv, rv, path)
+	}
+
+	if lv == lua.LNil {
+		return nil
+	}
+
+	if hook, ok := d.opts.decodeHooks[rv.Type()]; ok {
+		v, err := hook(lv)
+		if err != nil {
+			return fmt.Errorf("jkr: type hook for %s at %s: %w", rv.Type(), strings.Join(path, "."), err)
+		}
+		hv := reflect.ValueOf(v)
+		if !hv.IsValid() || !hv.Type().AssignableTo(rv.Type()) {
+			return fmt.Errorf("jkr: type hook for %s at %s returned %T", rv.Type(), strings.Join(path, "."), v)
+		}
+		rv.Set(hv)
+		return nil
+	}
+
+	switch rv.Type() {
+	case timeType:
+		return d.decodeTime(lv, rv, path)
+	case bytesType:
+		s, ok := lv.(lua.LString)
+		if !ok {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetBytes([]byte(s))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer:
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.decode(lv, rv.Elem(), path)
+	case reflect.Interface:
+		if rv.NumMethod() != 0 {
+			return d.typeError(lv, rv, path)
+		}
+		val, err := d.toAny(lv, path)
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(val))
+		return nil
+	case reflect.String:
+		s, ok := lv.(lua.LString)
+		if !ok {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetString(string(s))
+		return nil
+	case reflect.Bool:
+		b, ok := lv.(lua.LBool)
+		if !ok {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetBool(bool(b))
+		return nil
+	case reflect.Float32, reflect.Float64:
+		n, ok := lv.(lua.LNumber)
+		if !ok || rv.OverflowFloat(float64(n)) {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetFloat(float64(n))
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := lv.(lua.LNumber)
+		f := float64(n)
+		if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 || rv.OverflowInt(int64(f)) {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetInt(int64(f))
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, ok := lv.(lua.LNumber)
+		f := float64(n)
+		if !ok || f != math.Trunc(f) || f < 0 || f >= math.MaxUint64 || rv.OverflowUint(uint64(f)) {
+			return d.typeError(lv, rv, path)
+		}
+		rv.SetUint(uint64(f))
+		return nil
+	}
+
+	tbl, ok := lv.(*lua.LTable)
+	if !ok {
+		return d.typeError(lv, rv, path)
+	}
+	switch rv.Kind() {
+	case reflect.Struct:
+		return d.decodeStruct(tbl, rv, path)
+	case reflect.Map:
+		return d.decodeMap(tbl, rv, path)
+	case reflect.Slice, reflect.Array:
+		return d.decodeSlice(tbl, rv, path)
+	default:
+		return d.typeError(lv, rv, path)
+	}
+}
+
+// decodeTime accepts both Unix seconds and RFC 3339 strings, whatever the
+// configured TimeFormat
+func (d *valueDecoder) decodeTime(lv lua.LValue, rv reflect.Value, path []string) error {
+	var t time.Time
+	switch v := lv.(type) {
+	case lua.LNumber:
+		sec, frac := math.Modf(float64(v))
+		t = time.Unix(int64(sec), int64(math.Round(frac*1e9))).UTC()
+	case lua.LString:
+		var err error
+		if t, err = time.Parse(time.RFC3339Nano, string(v)); err != nil {
+			return fmt.Errorf("jkr: cannot unmarshal %q into time.Time at %s: %w", v, strings.Join(path, "."), err)
+		}
+	default:
+		return d.typeError(lv, rv, path)
+	}
+	rv.Set(reflect.ValueOf(t))
+	return nil
+}
+
+func (d *valueDecoder) decodeStruct(tbl *lua.LTable, rv reflect.Value, path []string) error {
+	fields := structFields(rv.Type())
+	if d.opts.disallowUnknown {
+		if err := checkUnknownFields(tbl, fields, path); err != nil {
+			return err
+		}
+	}
+	for _, f := range fields {
+		lv := tbl.RawGetString(f.name)
+		if lv == lua.LNil {
+			continue
+		}
+		fv, err := fieldByIndexAlloc(rv, f.index)
+		if err != nil {
+			return err
+		}
+		if err := d.decode(lv, fv, append(path, f.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnknownFields reports the first key of tbl, in sorted order, that none
+// of fields maps to
+func checkUnknownFields(tbl *lua.LTable, fields []field, path []string) error {
+	var unknown []lua.LValue
+	forEach(tbl, func(key, _ lua.LValue) {
+		if s, ok := key.(lua.LString); ok && slices.ContainsFunc(fields, func(f field) bool { return f.name == string(s) }) {
+			return
+		}
+		unknown = append(unknown, key)
+	})
+	if len(unknown) == 0 {
+		return nil
+	}
+	key := slices.MinFunc(unknown, compareKeys)
+	return fmt.Errorf("jkr: unknown field %s", strings.Join(append(path, key.String()), "."))
+}
+
+func (d *valueDecoder) decodeMap(tbl *lua.LTable, rv reflect.Value, path []string) error {
+	t := rv.Type()
+	if rv.IsNil() {
+		rv.Set(reflect.MakeMap(t))
+	}
+
+	// in key order, so that the error reported for several bad entries is
+	// always the same
+	for _, en := range sortedEntries(tbl) {
+		keyPath := append(path, en.key.String())
+		kv := reflect.New(t.Key()).Elem()
+		if err := d.decodeKey(en.key, kv); err != nil {
+			return &UnmarshalTypeError{Value: en.key.Type().String() + " key", Type: t.Key(), Path: strings.Join(keyPath, ".")}
+		}
+		ev := reflect.New(t.Elem()).Elem()
+		if err := d.decode(en.value, ev, keyPath); err != nil {
+			return err
+		}
+		rv.SetMapIndex(kv, ev)
+	}
+	return nil
+}
+
+// decodeKey converts a table key into a map key, accepting numeric keys for
+// string maps and numeric strings for integer maps
+func (d *valueDecoder) decodeKey(key lua.LValue, kv reflect.Value) error {
+	switch kv.Kind() {
+	case reflect.String:
+		kv.SetString(key.String())
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		if s, ok := key.(lua.LString); ok {
+			f, err := strconv.ParseFloat(string(s), 64)
+			if err != nil {
+				return err
+			}
+			key = lua.LNumber(f)
+		}
+	}
+	return d.decode(key, kv, nil)
+}
+
+func (d *valueDecoder) decodeSlice(tbl *lua.LTable, rv reflect.Value, path []string) error {
+	var n, count int
+	var err error
+	forEach(tbl, func(key, _ lua.LValue) {
+		i, ok := arrayIndex(key)
+		if !ok {
+			if err == nil {
+				err = &UnmarshalTypeError{Value: key.Type().String() + " key", Type: rv.Type(), Path: strings.Join(path, ".")}
+			}
+			return
+		}
+		n = max(n, int(i))
+		count++
+	})
+	if err != nil {
+		return err
+	}
+	if count != n {
+		return &UnmarshalTypeError{Value: "sparse table", Type: rv.Type(), Path: strings.Join(path, ".")}
+	}
+
+	if rv.Kind() == reflect.Slice {
+		rv.Set(reflect.MakeSlice(rv.Type(), n, n))
+	} else if n > rv.Len() {
+		return &UnmarshalTypeError{Value: fmt.Sprintf("table of %d elements", n), Type: rv.Type(), Path: strings.Join(path, ".")}
+	}
+	for i := range n {
+		if err := d.decode(rawGetIndex(tbl, int64(i+1)), rv.Index(i), append(path, strconv.Itoa(i+1))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toAny converts lv into its natural Go representation
+func (d *valueDecoder) toAny(lv lua.LValue, path []string) (any, error) {
+	switch v := lv.(type) {
+	case lua.LString:
+		return string(v), nil
+	case lua.LNumber:
+		return float64(v), nil
+	case lua.LBool:
+		return bool(v), nil
+	case *lua.LTable:
+		if Kind(v) == Array {
+			var out []any
+			if err := d.decodeSlice(v, reflect.ValueOf(&out).Elem(), path); err != nil {
+				return nil, err
+			}
+			return out, nil
+		}
+		out := map[string]any{}
+		if err := d.decodeMap(v, reflect.ValueOf(&out).Elem(), path); err != nil {
+			return nil, err
+		}
+		return out, nil
+	default:
+		return nil, &UnmarshalTypeError{Value: lv.Type().String(), Type: reflect.TypeFor[any](), Path: strings.Join(path, ".")}
+	}
+}
+
+func (d *valueDecoder) typeError(lv lua.LValue, rv reflect.Value, path []string) error {
+	return &UnmarshalTypeError{Value: lv.Type().String(), Type: rv.Type(), Path: strings.Join(path, ".")}
+}
+
+// field describes a struct field mapped to a table key
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// structFields returns the fields of t that map to table keys, including those
+// promoted from untagged embedded structs
+func structFields(t reflect.Type) []field {
+	var fields []field
+	for _, sf := range reflect.VisibleFields(t) {
+		if sf.Anonymous && sf.Tag.Get("jkr") == "" && isStructOrStructPointer(sf.Type) {
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+		tag := sf.Tag.Get("jkr")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name:      name,
+			index:     sf.Index,
+			omitEmpty: opts == "omitempty",
+		})
+	}
+	return fields
+}
+
+func isStructOrStructPointer(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct
+}
+
+// fieldByIndexAlloc is reflect.Value.FieldByIndex allocating nil embedded
+// struct pointers on the way
+func fieldByIndexAlloc(rv reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && rv.Kind() == reflect.Pointer {
+			if rv.IsNil() {
+				if !rv.CanSet() {
+					return reflect.Value{}, fmt.Errorf("jkr: cannot set embedded pointer to unexported struct %s", rv.Type().Elem())
+				}
+				rv.Set(reflect.New(rv.Type().Elem()))
+			}
+			rv = rv.Elem()
+		}
+		rv = rv.Field(x)
+	}
+	return rv, nil
+}
@@ -0,0 +1,458 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+type testBlind struct {
+	Name     string `jkr:"name"`
+	Chips    int    `jkr:"chips"`
+	Disabled bool   `jkr:"disabled"`
+}
+
+type testSave struct {
+	Version string         `jkr:"VERSION"`
+	State   int            `jkr:"STATE"`
+	Blind   *testBlind     `jkr:"BLIND"`
+	Hands   []string       `jkr:"hands"`
+	Usage   map[string]int `jkr:"usage"`
+	Raw     *lua.LTable    `jkr:"raw"`
+	Ignored string         `jkr:"-"`
+	Dollars float64
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	data := compressLua(t, `return {["VERSION"]="1.0.1o-FULL",["STATE"]=5,`+
+		`["BLIND"]={["name"]="Small Blind",["chips"]=450,["disabled"]=false,["extra"]=1,},`+
+		`["hands"]={[1]="Pair",[2]="Flush",},["usage"]={["b_red"]=3,},["raw"]={[1]=true,},`+
+		`["-"]="skipped",["Dollars"]=4.5,["unknown"]={},}`)
+
+	got, err := Decode[testSave](data)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if got.Raw == nil || got.Raw.RawGetInt(1) != lua.LTrue {
+		t.Errorf("got raw table %v; want {true}", got.Raw)
+	}
+	got.Raw = nil
+
+	want := testSave{
+		Version: "1.0.1o-FULL",
+		State:   5,
+		Blind:   &testBlind{Name: "Small Blind", Chips: 450},
+		Hands:   []string{"Pair", "Flush"},
+		Usage:   map[string]int{"b_red": 3},
+		Dollars: 4.5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestDecodeMap(t *testing.T) {
+	t.Parallel()
+
+	data := compressLua(t, `return {["name"]="P1",["stake"]=1,["won"]=true,`+
+		`["hands"]={[1]="Pair",[2]="Flush",},["MEMORY"]={["deck"]="Red Deck",[1]=2,},}`)
+
+	got, err := Decode[map[string]any](data)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	want := map[string]any{
+		"name":   "P1",
+		"stake":  float64(1),
+		"won":    true,
+		"hands":  []any{"Pair", "Flush"},
+		"MEMORY": map[string]any{"deck": "Red Deck", "1": float64(2)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v; want %#v", got, want)
+	}
+}
+
+func TestDecodeTypeError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		lua  string
+		path string
+	}{
+		{"string into int", `return {["STATE"]="5"}`, "STATE"},
+		{"fraction into int", `return {["STATE"]=5.5}`, "STATE"},
+		{"nested", `return {["BLIND"]={["chips"]=true}}`, "BLIND.chips"},
+		{"sparse slice", `return {["hands"]={[1]="Pair",[3]="Flush"}}`, "hands"},
+		{"string key in slice", `return {["hands"]={["x"]="Pair"}}`, "hands"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := Decode[testSave](compressLua(t, test.lua))
+			var terr *UnmarshalTypeError
+			if !errors.As(err, &terr) {
+				t.Fatalf("got error %v; want *UnmarshalTypeError", err)
+			}
+			if terr.Path != test.path {
+				t.Errorf("got path %q; want %q", terr.Path, test.path)
+			}
+		})
+	}
+}
+
+func TestUnmarshalValueNonPointer(t *testing.T) {
+	t.Parallel()
+
+	var save testSave
+	if err := UnmarshalValue(compressLua(t, `return {}`), save); err == nil {
+		t.Errorf("expected error for non-pointer, got nil")
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	raw := &lua.LTable{Metatable: lua.LNil}
+	raw.RawSetInt(1, lua.LTrue)
+	want := testSave{
+		Version: "1.0.1o-FULL",
+		State:   5,
+		Blind:   &testBlind{Name: "Small Blind", Chips: 450, Disabled: true},
+		Hands:   []string{"Pair", "Flush"},
+		Usage:   map[string]int{"b_red": 3, "b_blue": 1},
+		Raw:     raw,
+		Ignored: "not written",
+		Dollars: 4.5,
+	}
+
+	data, err := Encode(want)
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	got, err := Decode[testSave](data)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+
+	if got.Raw == nil || got.Raw.RawGetInt(1) != lua.LTrue {
+		t.Errorf("got raw table %v; want {true}", got.Raw)
+	}
+	got.Raw, want.Raw = nil, nil
+	want.Ignored = ""
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v; want %+v", got, want)
+	}
+}
+
+func TestEncodeOmitEmpty(t *testing.T) {
+	t.Parallel()
+
+	type withOmitEmpty struct {
+		Kept    int    `jkr:"kept"`
+		Omitted string `jkr:"omitted,omitempty"`
+		Nil     *int   `jkr:"nil"`
+	}
+
+	data, err := Encode(withOmitEmpty{})
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	if got, want := decompress(t, data), `return {["kept"]=0,}`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestMarshalValueExplicitNil(t *testing.T) {
+	t.Parallel()
+
+	type withNil struct {
+		Kept  int            `jkr:"kept"`
+		Nil   *int           `jkr:"nil"`
+		Empty string         `jkr:"empty,omitempty"`
+		Extra map[string]any `jkr:"extra"`
+	}
+	v := withNil{Kept: 1, Extra: map[string]any{"a": nil, "b": true}}
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		expected string
+	}{
+		{
+			name:     "default drops nil",
+			expected: `return {["extra"]={["b"]=true,},["kept"]=1,}`,
+		},
+		{
+			name:     "explicit nil",
+			opts:     []Option{WithExplicitNil(true)},
+			expected: `return {["extra"]={["b"]=true,["a"]=nil,},["kept"]=1,["nil"]=nil,}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			data, err := MarshalValue(v, append(test.opts, WithDeterministic(true))...)
+			if err != nil {
+				t.Fatalf("MarshalValue() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.expected {
+				t.Errorf("got %q; want %q", got, test.expected)
+			}
+
+			// Lua drops the nil keys again
+			var out withNil
+			if err := UnmarshalValue(data, &out); err != nil {
+				t.Fatalf("UnmarshalValue() error: %v", err)
+			}
+			if !reflect.DeepEqual(out, withNil{Kept: 1, Extra: map[string]any{"b": true}}) {
+				t.Errorf("got %+v after round trip", out)
+			}
+		})
+	}
+
+	t.Run("nil keys round trip", func(t *testing.T) {
+		t.Parallel()
+		src := compressLua(t, `return {["a"]=nil,[1]="x",["b"]={["c"]=nil,},}`)
+		keys := NilKeys{}
+		var tbl lua.LTable
+		if err := Unmarshal(src, &tbl, WithNilKeys(keys)); err != nil {
+			t.Fatalf("Unmarshal() error: %v", err)
+		}
+		data, err := Marshal(&tbl, WithNilKeys(keys), WithExplicitNil(true))
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		if got, want := decompress(t, data), `return {"x",["b"]={["c"]=nil,},["a"]=nil,}`; got != want {
+			t.Errorf("got %q; want %q", got, want)
+		}
+	})
+}
+
+func TestEncodeError(t *testing.T) {
+	t.Parallel()
+
+	type cyclic struct {
+		Next *cyclic
+	}
+	loop := &cyclic{}
+	loop.Next = loop
+
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{"unsupported type", struct{ C chan int }{make(chan int)}},
+		{"not a table", "foo"},
+		{"bool map key", map[bool]int{true: 1}},
+		{"circular reference", loop},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			if _, err := MarshalValue(test.value); err == nil {
+				t.Errorf("expected error for %q, got nil", test.name)
+			}
+		})
+	}
+}
+
+func TestMarshalValueTimeAndBytes(t *testing.T) {
+	t.Parallel()
+
+	type withTime struct {
+		Saved time.Time  `jkr:"saved"`
+		Blob  []byte     `jkr:"blob"`
+		Maybe *time.Time `jkr:"maybe"`
+	}
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		saved time.Time
+		want  string
+	}{
+		{
+			"unix",
+			nil,
+			time.Date(2024, 2, 20, 12, 30, 0, 0, time.UTC),
+			`return {["blob"]="\x00jkr",["saved"]=1708432200,}`,
+		},
+		{
+			"rfc3339",
+			[]Option{WithTimeFormat(TimeRFC3339)},
+			time.Date(2024, 2, 20, 12, 30, 0, 123456789, time.UTC),
+			`return {["blob"]="\x00jkr",["saved"]="2024-02-20T12:30:00.123456789Z",}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			in := withTime{Saved: test.saved, Blob: []byte("\x00jkr")}
+			data, err := MarshalValue(in, test.opts...)
+			if err != nil {
+				t.Fatalf("MarshalValue() error: %v", err)
+			}
+			if got := decompress(t, data); got != test.want {
+				t.Errorf("got %q; want %q", got, test.want)
+			}
+
+			var out withTime
+			if err := UnmarshalValue(data, &out); err != nil {
+				t.Fatalf("UnmarshalValue() error: %v", err)
+			}
+			if !out.Saved.Equal(in.Saved) {
+				t.Errorf("got time %v; want %v", out.Saved, in.Saved)
+			}
+			if !bytes.Equal(out.Blob, in.Blob) {
+				t.Errorf("got bytes %q; want %q", out.Blob, in.Blob)
+			}
+			if out.Maybe != nil {
+				t.Errorf("got time %v for nil pointer; want nil", out.Maybe)
+			}
+		})
+	}
+}
+
+// testDecimal is a fixed-point number the default mapping knows nothing about
+type testDecimal struct {
+	cents int64
+}
+
+func TestMarshalValueTypeHook(t *testing.T) {
+	t.Parallel()
+
+	type priced struct {
+		Price testDecimal  `jkr:"price"`
+		Sale  *testDecimal `jkr:"sale"`
+	}
+
+	decimalType := reflect.TypeFor[testDecimal]()
+	encode := WithTypeHook(decimalType, func(v any) (lua.LValue, error) {
+		d := v.(testDecimal)
+		return lua.LString(fmt.Sprintf("%d.%02d", d.cents/100, d.cents%100)), nil
+	})
+	decode := WithUnmarshalTypeHook(decimalType, func(lv lua.LValue) (any, error) {
+		var units, cents int64
+		if _, err := fmt.Sscanf(lv.String(), "%d.%02d", &units, &cents); err != nil {
+			return nil, err
+		}
+		return testDecimal{units*100 + cents}, nil
+	})
+
+	in := priced{Price: testDecimal{1234}, Sale: &testDecimal{999}}
+	data, err := MarshalValue(in, encode)
+	if err != nil {
+		t.Fatalf("MarshalValue() error: %v", err)
+	}
+	if got, want := decompress(t, data), `return {["price"]="12.34",["sale"]="9.99",}`; got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+
+	var out priced
+	if err := UnmarshalValue(data, &out, decode); err != nil {
+		t.Fatalf("UnmarshalValue() error: %v", err)
+	}
+	if !reflect.DeepEqual(out, in) {
+		t.Errorf("got %+v; want %+v", out, in)
+	}
+
+	if err := UnmarshalValue(compressLua(t, `return {["price"]="abc"}`), &out, decode); err == nil {
+		t.Errorf("expected error from failing hook, got nil")
+	}
+}
+
+func TestMarshalValueSafeNumbers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		value     any
+		expectErr bool
+	}{
+		{"normal value", int64(42), false},
+		{"2^53", int64(1 << 53), false},
+		{"2^53+1", int64(1<<53 + 1), true},
+		{"-(2^53+1)", int64(-1<<53 - 1), true},
+		{"unsigned 2^53+1", uint64(1<<53 + 1), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			in := map[string]any{"n": test.value}
+			_, err := MarshalValue(in, WithSafeNumbers(true))
+			if test.expectErr != errors.Is(err, ErrPrecisionLoss) {
+				t.Errorf("got error %v; want ErrPrecisionLoss %t", err, test.expectErr)
+			}
+			if _, err := MarshalValue(in); err != nil {
+				t.Errorf("MarshalValue() without safe numbers error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownFields(t *testing.T) {
+	t.Parallel()
+
+	type blind struct {
+		Name  string `jkr:"name"`
+		Chips int    `jkr:"chips"`
+	}
+	type save struct {
+		State int    `jkr:"STATE"`
+		Blind *blind `jkr:"BLIND"`
+	}
+
+	tests := []struct {
+		name      string
+		src       string
+		opts      []Option
+		expectErr string
+	}{
+		{"lenient", `return {["STATE"]=5,["GAME"]={},["BLIND"]={["name"]="Small Blind",["chips"]=450,["mult"]=1,},}`, nil, ""},
+		{"strict known only", `return {["STATE"]=5,["BLIND"]={["name"]="Small Blind",},}`, []Option{WithDisallowUnknownFields()}, ""},
+		{"strict top level", `return {["STATE"]=5,["VERSION"]="x",["GAME"]={},}`, []Option{WithDisallowUnknownFields()}, "jkr: unknown field GAME"},
+		{"strict nested", `return {["STATE"]=5,["BLIND"]={["name"]="Small Blind",["mult"]=1,},}`, []Option{WithDisallowUnknownFields()}, "jkr: unknown field BLIND.mult"},
+		{"strict numeric key", `return {["STATE"]=5,[1]=true,}`, []Option{WithDisallowUnknownFields()}, "jkr: unknown field 1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := Decode[save](compressLua(t, test.src), test.opts...)
+			if test.expectErr != "" {
+				if err == nil || err.Error() != test.expectErr {
+					t.Errorf("got error %v; want %q", err, test.expectErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode() error: %v", err)
+			}
+			if got.State != 5 || got.Blind == nil || got.Blind.Name != "Small Blind" {
+				t.Errorf("got %+v; want state 5 and the small blind", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"context"
+	"slices"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// WalkFunc is called by Walk for every value in a table, with the keys
+// leading to it from the root. path is only valid during the call. Returning
+// an error stops the walk, and Walk returns that error.
+type WalkFunc func(path []string, value lua.LValue) error
+
+// Walk calls fn for every value in tbl, depth first in sorted key order,
+// descending into nested tables after calling fn for the table itself. A
+// table that refers back to one of its ancestors is passed to fn but not
+// descended into again.
+func Walk(tbl *lua.LTable, fn WalkFunc) error {
+	return WalkContext(context.Background(), tbl, fn)
+}
+
+// WalkContext is like Walk, but stops with ctx's error once ctx is done.
+// ctx is checked every so many values, to keep the cost negligible.
+func WalkContext(ctx context.Context, tbl *lua.LTable, fn WalkFunc) error {
+	w := &walker{ctx: ctx, fn: fn, visited: map[*lua.LTable]bool{tbl: true}}
+	return w.walk(tbl, nil)
+}
+
+// walker holds the state of a single Walk
+type walker struct {
+	ctx     context.Context
+	fn      WalkFunc
+	visited map[*lua.LTable]bool
+	steps   int
+}
+
+func (w *walker) walk(tbl *lua.LTable, path []string) error {
+	for _, en := range sortedEntries(tbl) {
+		w.steps++
+		if w.steps%1024 == 0 {
+			if err := w.ctx.Err(); err != nil {
+				return err
+			}
+		}
+
+		childPath := append(slices.Clip(path), en.key.String())
+		if err := w.fn(childPath, en.value); err != nil {
+			return err
+		}
+		child, ok := en.value.(*lua.LTable)
+		if !ok || w.visited[child] {
+			continue
+		}
+		w.visited[child] = true
+		err := w.walk(child, childPath)
+		delete(w.visited, child)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+
+	tbl := compileTable(t, `return {["b"]={["y"]=2,["x"]=1,},["a"]="first",[1]={"z",},}`)
+	tbl.RawGetString("b").(*lua.LTable).RawSetString("parent", tbl)
+
+	var got []string
+	err := Walk(tbl, func(path []string, value lua.LValue) error {
+		got = append(got, strings.Join(path, ".")+"="+value.Type().String())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	want := []string{"1=table", "1.1=string", "a=string", "b=table", "b.parent=table", "b.x=number", "b.y=number"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	stop := errors.New("stop")
+	var calls int
+	err = Walk(tbl, func([]string, lua.LValue) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("got %v after %d calls; want stop after 1", err, calls)
+	}
+}
+
+func TestWalkCyclicTables(t *testing.T) {
+	t.Parallel()
+
+	// a table holding itself, a nested table pointing back, and a table
+	// shared by two keys, which is not a cycle
+	tbl := newTable()
+	tbl.RawSetString("self", tbl)
+	child := newTable()
+	child.RawSetString("parent", tbl)
+	child.RawSetString("self", child)
+	tbl.RawSetString("child", child)
+	shared := compileTable(t, `return {["x"]=1,}`)
+	tbl.RawSetString("left", shared)
+	tbl.RawSetString("right", shared)
+
+	var got []string
+	err := Walk(tbl, func(path []string, value lua.LValue) error {
+		got = append(got, strings.Join(path, "."))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk() error: %v", err)
+	}
+	want := []string{"child", "child.parent", "child.self", "left", "left.x", "right", "right.x", "self"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestWalkContext(t *testing.T) {
+	t.Parallel()
+
+	tbl := wideTable(1000, 100)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const cancelAt = 5000
+	var calls int
+	err := WalkContext(ctx, tbl, func([]string, lua.LValue) error {
+		calls++
+		if calls == cancelAt {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v; want context.Canceled", err)
+	}
+	if calls > cancelAt+1024 {
+		t.Errorf("walk went on for %d values after cancellation", calls-cancelAt)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+package jkr
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Writer writes tables to an underlying io.Writer, each as its own complete
+// jkr stream, reusing its compressor between tables. With WithBufferedWrites,
+// the many small writes made by the compressor reach the underlying writer as
+// a single write per table.
+type Writer struct {
+	iw io.Writer
+	// out is bw if writes are buffered, and iw otherwise
+	out  io.Writer
+	bw   *bufio.Writer
+	zw   *flate.Writer
+	opts []Option
+	err  error
+	// open is set while a stream started by Append is unfinished
+	open bool
+}
+
+// NewWriter returns a Writer that writes to w, marshaling every table with
+// opts.
+func NewWriter(w io.Writer, opts ...Option) *Writer {
+	o := newOptions(opts)
+	out, bw := w, (*bufio.Writer)(nil)
+	if o.bufferedWrites {
+		bw = bufio.NewWriter(w)
+		out = bw
+	}
+	zw, err := flate.NewWriter(out, o.compressionLevel)
+	if err != nil {
+		err = fmt.Errorf("jkr: %w", err)
+	}
+	return &Writer{
+		iw:   w,
+		out:  out,
+		bw:   bw,
+		zw:   zw,
+		opts: opts,
+		err:  err,
+	}
+}
+
+// Write marshals tbl with the Writer's options and flushes it to the
+// underlying writer, after finishing any stream started by Append.
+func (w *Writer) Write(tbl *lua.LTable) error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	data, err := Serialize(tbl, w.opts...)
+	if err != nil {
+		return err
+	}
+
+	w.zw.Reset(w.out)
+	if _, err := w.zw.Write(data); err != nil {
+		return err
+	}
+	if err := w.zw.Flush(); err != nil {
+		return err
+	}
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	return w.flushBuffer()
+}
+
+// CurrentVersion is the newest Balatro version whose save format this package
+// is known to write correctly.
+const CurrentVersion = "1.0.1o-FULL"
+
+// A VersionWarning reports that a table being written was saved by a Balatro
+// version other than CurrentVersion, so its structure may not match what the
+// current game expects. It is informational; the table is still written.
+type VersionWarning struct {
+	Want string
+	Got  string
+}
+
+func (w *VersionWarning) Error() string {
+	return fmt.Sprintf("jkr: table has VERSION %q, current is %q", w.Got, w.Want)
+}
+
+// WriteChecked is like Write but also compares the table's top-level VERSION
+// against CurrentVersion, returning a *VersionWarning if they differ. Tables
+// without a string VERSION, such as settings.jkr, are never warned about.
+func (w *Writer) WriteChecked(tbl *lua.LTable) (*VersionWarning, error) {
+	if err := w.Write(tbl); err != nil {
+		return nil, err
+	}
+	version, ok := tbl.RawGetString("VERSION").(lua.LString)
+	if !ok || string(version) == CurrentVersion {
+		return nil, nil
+	}
+	return &VersionWarning{Want: CurrentVersion, Got: string(version)}, nil
+}
+
+// Append marshals tbl with the Writer's options into the current stream
+// without finishing it, starting a new stream if there is none, so that
+// consecutive tables share one stream and compress against each other.
+// Nothing is guaranteed to reach the underlying writer until Flush or Close.
+// A Reader reads the tables back one at a time, but Balatro only loads files
+// holding a single table.
+func (w *Writer) Append(tbl *lua.LTable) error {
+	if w.err != nil {
+		return w.err
+	}
+	data, err := Serialize(tbl, w.opts...)
+	if err != nil {
+		return err
+	}
+
+	if !w.open {
+		w.zw.Reset(w.out)
+		w.open = true
+	}
+	if _, err := w.zw.Write(data); err != nil {
+		return err
+	}
+	// separate the chunk from the one the next Append writes
+	_, err = w.zw.Write([]byte("\n"))
+	return err
+}
+
+// Flush finishes the stream started by Append, if any, and writes all
+// buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.open {
+		w.open = false
+		if err := w.zw.Close(); err != nil {
+			return err
+		}
+	}
+	return w.flushBuffer()
+}
+
+// flushBuffer writes any buffered data to the underlying writer
+func (w *Writer) flushBuffer() error {
+	if w.bw == nil {
+		return nil
+	}
+	return w.bw.Flush()
+}
+
+// Close finishes the stream started by Append, if any, and flushes any
+// buffered data. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.Flush()
+}
+
+// Transform reads a jkr stream from r, calls fn to modify the decoded table,
+// and writes the result to w as a new jkr stream, such as for bumping a field
+// across many saves. The compressed output goes straight to w, and the
+// compressor is taken from a pool shared with Marshal, so a batch of
+// transforms does not allocate one per file. Nothing is written if reading or
+// fn fails. opts apply to both the read and the write.
+func Transform(r io.Reader, w io.Writer, fn func(*lua.LTable) error, opts ...Option) error {
+	tbl := newTable()
+	if err := UnmarshalRead(r, tbl, opts...); err != nil {
+		return err
+	}
+	if err := fn(tbl); err != nil {
+		return err
+	}
+	return MarshalWrite(w, tbl, opts...)
+}
@@ -0,0 +1,312 @@
+/* Any copyright is dedicated to the Public Domain.
+ * https://creativecommons.org/publicdomain/zero/1.0/ */
+
+package jkr
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestWriter(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	first := L.NewTable()
+	first.RawSetString("foo", lua.LString("bar"))
+	second := L.NewTable()
+	second.RawSetInt(1, lua.LNumber(42))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, tbl := range []*lua.LTable{first, second} {
+		if err := w.Write(tbl); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	var want []byte
+	for _, tbl := range []*lua.LTable{first, second} {
+		data, err := Marshal(tbl)
+		if err != nil {
+			t.Fatalf("Marshal() error: %v", err)
+		}
+		want = append(want, data...)
+	}
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Writer output differs from consecutive Marshal calls")
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	for _, want := range []*lua.LTable{first, second} {
+		var got lua.LTable
+		if err := UnmarshalRead(r, &got); err != nil {
+			t.Fatalf("UnmarshalRead() error: %v", err)
+		}
+		if !deepEquals(L, want, &got) {
+			t.Errorf("tables not equal after Write")
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes left after reading every table", r.Len())
+	}
+}
+
+func TestWriterAppend(t *testing.T) {
+	t.Parallel()
+	L := lua.NewState()
+	defer L.Close()
+
+	var tables []*lua.LTable
+	for i := range 3 {
+		tbl := L.NewTable()
+		tbl.RawSetString("index", lua.LNumber(i))
+		tbl.RawSetString("name", lua.LString("j_joker"))
+		tables = append(tables, tbl)
+	}
+	last := L.NewTable()
+	last.RawSetInt(1, lua.LString("written"))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, tbl := range tables {
+		if err := w.Append(tbl); err != nil {
+			t.Fatalf("Append() error: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+	appended := buf.Len()
+
+	// a Write after Append finishes the appended stream first
+	if err := w.Append(tables[0]); err != nil {
+		t.Fatalf("Append() error: %v", err)
+	}
+	if err := w.Write(last); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	var separate bytes.Buffer
+	sw := NewWriter(&separate)
+	for _, tbl := range tables {
+		if err := sw.Write(tbl); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+	}
+	if appended >= separate.Len() {
+		t.Errorf("appended streams are %d bytes, want fewer than %d written separately", appended, separate.Len())
+	}
+
+	r := NewReader(bytes.NewReader(buf.Bytes()))
+	for i, want := range append(tables, tables[0], last) {
+		got, err := r.Read()
+		if err != nil {
+			t.Fatalf("Read() table %d error: %v", i, err)
+		}
+		if !deepEquals(L, want, got) {
+			t.Errorf("table %d not equal after Append", i)
+		}
+	}
+	if _, err := r.Read(); err != io.EOF {
+		t.Errorf("Read() after last table error = %v, want io.EOF", err)
+	}
+}
+
+func TestWriterWriteChecked(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		version lua.LValue
+		warning *VersionWarning
+	}{
+		{"current version", lua.LString(CurrentVersion), nil},
+		{"older version", lua.LString("1.0.0n-FULL"), &VersionWarning{Want: CurrentVersion, Got: "1.0.0n-FULL"}},
+		{"no version", lua.LNil, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tbl := newTable()
+			tbl.RawSetString("VERSION", test.version)
+			tbl.RawSetString("STATE", lua.LNumber(1))
+
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			warning, err := w.WriteChecked(tbl)
+			if err != nil {
+				t.Fatalf("WriteChecked() error: %v", err)
+			}
+			if !reflect.DeepEqual(warning, test.warning) {
+				t.Errorf("got warning %v; want %v", warning, test.warning)
+			}
+
+			want, err := Marshal(tbl)
+			if err != nil {
+				t.Fatalf("Marshal() error: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), want) {
+				t.Errorf("WriteChecked output differs from Marshal")
+			}
+		})
+	}
+}
+
+func TestWriterOptions(t *testing.T) {
+	t.Parallel()
+
+	tbl := newTable()
+	tbl.RawSetString("b", lua.LNumber(2))
+	tbl.RawSetString("a", lua.LNumber(1))
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf, WithDeterministic(true), WithIndent("  "))
+	if err := w.Write(tbl); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error: %v", err)
+	}
+
+	want := "return {\n  [\"a\"] = 1,\n  [\"b\"] = 2,\n}"
+	if got := decompress(t, buf.Bytes()); got != want {
+		t.Errorf("got %q; want %q", got, want)
+	}
+}
+
+func TestWriterBufferedWrites(t *testing.T) {
+	t.Parallel()
+
+	// small enough to fit the buffer in a single write
+	tbl := compileTable(t, `return {["foo"]="bar",["list"]={1,2,3},["n"]=4.5,}`)
+
+	outputs := make([][]byte, 2)
+	for i, buffered := range []bool{false, true} {
+		var buf bytes.Buffer
+		sink := &writeCounter{w: &buf}
+		w := NewWriter(sink, WithBufferedWrites(buffered))
+		if err := w.Write(tbl); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+		if buffered && sink.writes != 1 {
+			t.Errorf("buffered Write() made %d writes; want 1", sink.writes)
+		}
+		if !buffered && sink.writes < 2 {
+			t.Errorf("unbuffered Write() made %d writes; want several", sink.writes)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close() error: %v", err)
+		}
+		outputs[i] = buf.Bytes()
+	}
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("buffered output differs from unbuffered output")
+	}
+}
+
+// writeCounter counts the writes made to w
+type writeCounter struct {
+	w      io.Writer
+	writes int
+}
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	c.writes++
+	return c.w.Write(p)
+}
+
+func BenchmarkWriter(b *testing.B) {
+	tbl := &lua.LTable{Metatable: lua.LNil}
+	tbl.RawSetString("foo", lua.LString("bar"))
+	tbl.RawSetInt(1, lua.LNumber(42))
+
+	for _, buffered := range []bool{true, false} {
+		name := "unbuffered"
+		if buffered {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			f := createBenchFile(b)
+			for b.Loop() {
+				w := NewWriter(f, WithBufferedWrites(buffered))
+				for range 10000 {
+					if err := w.Write(tbl); err != nil {
+						b.Fatalf("Write() error: %v", err)
+					}
+				}
+				if err := w.Close(); err != nil {
+					b.Fatalf("Close() error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// createBenchFile creates a temporary file that is removed with the benchmark
+func createBenchFile(b *testing.B) *os.File {
+	b.Helper()
+	f, err := os.Create(filepath.Join(b.TempDir(), "bench.jkr"))
+	if err != nil {
+		b.Fatalf("failed to create file: %v", err)
+	}
+	b.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestTransform(t *testing.T) {
+	t.Parallel()
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "save.jkr"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	var buf bytes.Buffer
+	err = Transform(bytes.NewReader(raw), &buf, func(tbl *lua.LTable) error {
+		tbl.RawSetString("VERSION", lua.LString(CurrentVersion))
+		tbl.RawSetString("edited", lua.LTrue)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Transform() error: %v", err)
+	}
+
+	var want, got lua.LTable
+	if err := Unmarshal(raw, &want); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	want.RawSetString("VERSION", lua.LString(CurrentVersion))
+	want.RawSetString("edited", lua.LTrue)
+	if err := Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("Unmarshal() of transformed output error: %v", err)
+	}
+	if !Equal(&got, &want) {
+		t.Errorf("transformed table differs from the expected edit")
+	}
+
+	buf.Reset()
+	fail := errors.New("fail")
+	err = Transform(bytes.NewReader(raw), &buf, func(*lua.LTable) error { return fail })
+	if !errors.Is(err, fail) {
+		t.Errorf("got %v; want the mutator's error", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Transform() wrote %d bytes after the mutator failed", buf.Len())
+	}
+}